@@ -0,0 +1,145 @@
+// Package api holds the plumbing shared by the versioned REST API: request
+// IDs, the JSON error envelope every /api/v1 error is returned in and request
+// validation.
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Prefix is the path the current API version is served under.
+const Prefix = "/api/v1"
+
+// RequestIDHeader carries a request's ID. Clients may set it to correlate
+// their logs; otherwise one is generated. It is echoed on every response.
+const RequestIDHeader = "X-Request-ID"
+
+// CodeValidationFailed is the error code of requests with invalid fields.
+const CodeValidationFailed = "validation_failed"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestIDKey struct{}
+
+// RequestID gives every request an ID, taken from RequestIDHeader when the
+// client sent a usable one.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestIDFrom returns the ID RequestID gave a request.
+func RequestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Versioned reports whether a request was made to the versioned API.
+func Versioned(r *http.Request) bool {
+	return r.URL.Path == Prefix || strings.HasPrefix(r.URL.Path, Prefix+"/")
+}
+
+// Code returns the error code for an HTTP status, such as "bad_request".
+func Code(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.NewReplacer("-", " ", "'", "").Replace(strings.ToLower(text))
+	return strings.Join(strings.Fields(text), "_")
+}
+
+// WriteError writes an error envelope.
+func WriteError(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(model.ErrorEnvelope{Error: model.APIError{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: RequestIDFrom(r),
+	}})
+}
+
+// Errors turns the plain text errors handlers write with http.Error into
+// error envelopes for requests to the versioned API. The text up to the first
+// ": " becomes the message and the rest the details, so "Invalid query: no
+// metric" has the message "Invalid query". Responses that are already JSON,
+// and requests to unversioned paths, are left alone.
+func Errors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Versioned(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if !ew.capturing {
+			return
+		}
+		message := strings.TrimSpace(ew.body.String())
+		var details interface{}
+		if i := strings.Index(message, ": "); i >= 0 {
+			message, details = message[:i], message[i+2:]
+		}
+		if message == "" {
+			message = http.StatusText(ew.status)
+		}
+		WriteError(w, r, ew.status, Code(ew.status), message, details)
+	})
+}
+
+// errorWriter buffers error responses that are not JSON so Errors can
+// rewrite them.
+type errorWriter struct {
+	http.ResponseWriter
+	status    int
+	capturing bool
+	written   bool
+	body      bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	if w.written {
+		return
+	}
+	w.written = true
+	if status >= http.StatusBadRequest && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/json") {
+		w.status, w.capturing = status, true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capturing {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
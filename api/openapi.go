@@ -0,0 +1,480 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Version is the version of the API document.
+const Version = "1.0.0"
+
+// Param is a query, path or header parameter, or a multipart form field.
+type Param struct {
+	Name        string
+	In          string
+	Description string
+	Required    bool
+	Binary      bool
+}
+
+// Operation documents an endpoint. Body is a value of the JSON request body's
+// type and Form lists multipart fields instead. A successful response is
+// either Reply as it is or Answer wrapped as {"status": "success", "answer":
+// ...}, with budget alerts when Alerts is set.
+type Operation struct {
+	Method  string
+	Path    string
+	ID      string
+	Summary string
+	Tag     string
+	Params  []Param
+	Body    interface{}
+	Form    []Param
+	Answer  interface{}
+	Alerts  bool
+	Reply   interface{}
+	Status  int
+	Admin   bool
+}
+
+// Parameters shared by several operations.
+var (
+	timeZoneParam      = Param{Name: "tz", In: "query", Description: "IANA time zone to read the dataset in; defaults to the household's"}
+	promptVersionParam = Param{Name: "X-Prompt-Version", In: "header", Description: "Prompt template version; defaults to the current one"}
+	langParam          = Param{Name: "lang", In: "query", Description: "Language of the summary, such as id or en; defaults to Accept-Language"}
+)
+
+// Operations lists every endpoint under Prefix. The document served at
+// /openapi.json is built from it and the model types it names, and a test
+// checks it against the routes and handler types in main.go.
+var Operations = []Operation{
+	{
+		Method: "POST", Path: "/upload", ID: "upload", Tag: "analysis",
+		Summary: "Upload a dataset and ask the table model about it",
+		Params:  []Param{timeZoneParam, promptVersionParam, langParam},
+		Form: []Param{
+			{Name: "file", Description: "CSV, JSON, NDJSON, XLSX or XML meter export", Required: true, Binary: true},
+			{Name: "query", Description: "Question about the dataset", Required: true},
+			{Name: "format", Description: "File format, when it cannot be told from the name"},
+			{Name: "sheet", Description: "XLSX sheet to read"},
+			{Name: "delimiter", Description: "CSV delimiter"},
+			{Name: "quote", Description: "CSV quote character"},
+			{Name: "decimal", Description: "Decimal separator"},
+			{Name: "header", Description: "Whether the file has a header row"},
+			{Name: "encoding", Description: "Text encoding"},
+			{Name: "clean", Description: "Run the cleaning stage"},
+			{Name: "interval", Description: "Resample interval such as 15m or 1h"},
+			{Name: "fill", Description: "Gap fill method: none, zero, forward or interpolate"},
+		},
+		Reply: model.UploadReply{},
+	},
+	{
+		Method: "POST", Path: "/chat", ID: "chat", Tag: "analysis",
+		Summary: "Ask about the household's dataset or about saving energy",
+		Params:  []Param{promptVersionParam},
+		Body:    model.ChatRequest{},
+		Reply:   model.ChatReply{},
+	},
+	{
+		Method: "POST", Path: "/query", ID: "query", Tag: "analysis",
+		Summary: "Answer a question or a structured query from the dataset",
+		Params:  []Param{timeZoneParam, promptVersionParam},
+		Body:    model.QueryRequest{},
+		Reply:   model.QueryReply{},
+	},
+	{
+		Method: "POST", Path: "/ingest", ID: "ingest", Tag: "datasets",
+		Summary: "Append readings as a JSON reading, a JSON array or NDJSON",
+		Body:    []model.Reading{},
+		Answer:  model.IngestReport{},
+		Alerts:  true,
+	},
+	{
+		Method: "GET", Path: "/dataset", ID: "getDataset", Tag: "datasets",
+		Summary: "Get the household's stored readings",
+		Params:  []Param{timeZoneParam},
+		Answer:  []model.Reading{},
+	},
+	{
+		Method: "PUT", Path: "/dataset", ID: "replaceDataset", Tag: "datasets",
+		Summary: "Replace the household's dataset with readings in kWh per interval; nothing is stored when any is invalid",
+		Body:    []model.Reading{},
+		Answer:  model.IngestReport{},
+		Alerts:  true,
+	},
+	{
+		Method: "DELETE", Path: "/dataset", ID: "deleteDataset", Tag: "datasets",
+		Summary: "Delete the household's dataset",
+		Answer:  "",
+	},
+	{
+		Method: "GET", Path: "/datasets", ID: "listDatasets", Tag: "admin",
+		Summary: "List the size of every household's dataset",
+		Answer:  []model.DatasetSummary{},
+		Admin:   true,
+	},
+	{
+		Method: "GET", Path: "/analytics/carbon", ID: "carbon", Tag: "analytics",
+		Summary: "Estimate the dataset's carbon emissions",
+		Params: []Param{timeZoneParam,
+			{Name: "bucket", In: "query", Description: "Period to group emissions by: hour or day"}},
+		Answer: model.CarbonReport{},
+	},
+	{
+		Method: "GET", Path: "/datasets/compare", ID: "compare", Tag: "analytics",
+		Summary: "Compare the energy used in two periods",
+		Params: []Param{timeZoneParam,
+			{Name: "mode", In: "query", Description: "day, week or weekday_weekend"},
+			{Name: "base", In: "query", Description: "Base period, such as 2024-03-01 or 2024-W09; defaults to the one before the target"},
+			{Name: "target", In: "query", Description: "Target period; defaults to the latest"}},
+		Answer: model.ComparisonReport{},
+	},
+	{
+		Method: "GET", Path: "/goals", ID: "getBudget", Tag: "goals",
+		Summary: "Get the household's monthly budget",
+		Answer:  model.Budget{},
+	},
+	{
+		Method: "PUT", Path: "/goals", ID: "setBudget", Tag: "goals",
+		Summary: "Set the household's monthly budget",
+		Body:    model.Budget{},
+		Answer:  model.Budget{},
+		Alerts:  true,
+	},
+	{
+		Method: "DELETE", Path: "/goals", ID: "deleteBudget", Tag: "goals",
+		Summary: "Delete the household's monthly budget",
+		Answer:  "",
+	},
+	{
+		Method: "GET", Path: "/goals/alerts", ID: "listAlerts", Tag: "goals",
+		Summary: "List the household's budget alerts",
+		Answer:  []model.BudgetAlert{},
+	},
+	{
+		Method: "GET", Path: "/prompts", ID: "listPrompts", Tag: "settings",
+		Summary: "List the prompt template versions",
+		Reply:   model.PromptVersions{},
+	},
+	{
+		Method: "GET", Path: "/admin/usage", ID: "usageReport", Tag: "admin",
+		Summary: "Report model usage and cost",
+		Params: []Param{
+			{Name: "from", In: "query", Description: "First day, YYYY-MM-DD"},
+			{Name: "to", In: "query", Description: "Last day, YYYY-MM-DD"}},
+		Reply: model.UsageReport{},
+		Admin: true,
+	},
+	{
+		Method: "GET", Path: "/household", ID: "getHousehold", Tag: "settings",
+		Summary: "Get the household's settings",
+		Answer:  model.HouseholdSettings{},
+	},
+	{
+		Method: "PUT", Path: "/household", ID: "setHousehold", Tag: "settings",
+		Summary: "Set the household's time zone",
+		Body:    model.HouseholdSettings{},
+		Answer:  model.HouseholdSettings{},
+	},
+	{
+		Method: "GET", Path: "/sources", ID: "listSources", Tag: "datasets",
+		Summary: "List the units the household's sources report in",
+		Answer:  []model.SourceUnit{},
+	},
+	{
+		Method: "PUT", Path: "/sources/{appliance}", ID: "setSource", Tag: "datasets",
+		Summary: "Set the unit an appliance reports in",
+		Params:  []Param{{Name: "appliance", In: "path", Required: true}},
+		Body:    model.SourceUnit{},
+		Answer:  model.SourceUnit{},
+	},
+	{
+		Method: "DELETE", Path: "/sources/{appliance}", ID: "deleteSource", Tag: "datasets",
+		Summary: "Delete an appliance's unit",
+		Params:  []Param{{Name: "appliance", In: "path", Required: true}},
+		Answer:  "",
+	},
+	{
+		Method: "POST", Path: "/notifications/webhooks", ID: "subscribe", Tag: "notifications",
+		Summary: "Subscribe a webhook to the household's events, or any household's with the admin token",
+		Body:    model.WebhookSubscription{},
+		Answer:  model.WebhookSubscription{},
+		Status:  http.StatusCreated,
+	},
+	{
+		Method: "GET", Path: "/notifications/webhooks", ID: "listWebhooks", Tag: "notifications",
+		Summary: "List the household's webhook subscriptions, or all of them with the admin token",
+		Answer:  []model.WebhookSubscription{},
+	},
+	{
+		Method: "DELETE", Path: "/notifications/webhooks/{id}", ID: "unsubscribe", Tag: "notifications",
+		Summary: "Delete one of the household's webhook subscriptions",
+		Params:  []Param{{Name: "id", In: "path", Required: true}},
+		Answer:  "",
+	},
+	{
+		Method: "GET", Path: "/notifications/dead-letters", ID: "listDeadLetters", Tag: "admin",
+		Summary: "List events that could not be delivered",
+		Answer:  []model.DeadLetter{},
+		Admin:   true,
+	},
+	{
+		Method: "GET", Path: "/openapi.json", ID: "openapi", Tag: "settings",
+		Summary: "Get this document",
+		Reply:   map[string]interface{}{},
+	},
+}
+
+// OpenAPI builds the OpenAPI 3 document of Operations.
+func OpenAPI() map[string]interface{} {
+	g := &schemaGenerator{schemas: map[string]interface{}{}}
+	g.schema(reflect.TypeOf(model.ErrorEnvelope{}))
+
+	paths := map[string]map[string]interface{}{}
+	for _, op := range Operations {
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = g.operation(op)
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Energy usage assistant API",
+			"version": Version,
+			"description": "Upload household energy readings, ask about them and manage budgets, sources and notifications. " +
+				"Errors are returned as {\"error\": {code, message, details, request_id}}. " +
+				"/upload and /chat are also served without the /api/v1 prefix for existing clients.",
+		},
+		"servers": []interface{}{map[string]string{"url": Prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"parameters": map[string]interface{}{
+				"Household": parameter(Param{Name: "X-Household-ID", In: "header", Description: "Household the request is for; defaults to \"default\""}),
+				"User":      parameter(Param{Name: "X-User-ID", In: "header", Description: "User model usage is accounted to"}),
+				"RequestID": parameter(Param{Name: RequestIDHeader, In: "header", Description: "ID to correlate the request with; one is generated when missing"}),
+			},
+			"responses": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"description": "Error envelope",
+					"content":     jsonContent(ref("ErrorEnvelope")),
+				},
+			},
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// OpenAPIHandler serves the document as JSON.
+func OpenAPIHandler() http.HandlerFunc {
+	document, err := json.MarshalIndent(OpenAPI(), "", "  ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err != nil {
+			http.Error(w, "Failed to build document: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(document)
+	}
+}
+
+func (g *schemaGenerator) operation(op Operation) map[string]interface{} {
+	params := []interface{}{
+		map[string]string{"$ref": "#/components/parameters/Household"},
+		map[string]string{"$ref": "#/components/parameters/User"},
+		map[string]string{"$ref": "#/components/parameters/RequestID"},
+	}
+	for _, p := range op.Params {
+		params = append(params, parameter(p))
+	}
+	result := map[string]interface{}{
+		"operationId": op.ID,
+		"summary":     op.Summary,
+		"tags":        []string{op.Tag},
+		"parameters":  params,
+	}
+
+	switch {
+	case len(op.Form) > 0:
+		properties := map[string]interface{}{}
+		var required []string
+		for _, field := range op.Form {
+			schema := map[string]interface{}{"type": "string", "description": field.Description}
+			if field.Binary {
+				schema["format"] = "binary"
+			}
+			properties[field.Name] = schema
+			if field.Required {
+				required = append(required, field.Name)
+			}
+		}
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{"multipart/form-data": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "object", "properties": properties, "required": required},
+			}},
+		}
+	case op.Body != nil:
+		result["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  jsonContent(g.schema(reflect.TypeOf(op.Body))),
+		}
+	}
+
+	var reply map[string]interface{}
+	if op.Reply != nil {
+		reply = g.schema(reflect.TypeOf(op.Reply))
+	} else {
+		properties := map[string]interface{}{
+			"status": map[string]interface{}{"type": "string", "enum": []string{"success"}},
+			"answer": g.schema(reflect.TypeOf(op.Answer)),
+		}
+		if op.Alerts {
+			properties["alerts"] = g.schema(reflect.TypeOf([]model.BudgetAlert{}))
+		}
+		reply = map[string]interface{}{"type": "object", "properties": properties, "required": []string{"status", "answer"}}
+	}
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	result["responses"] = map[string]interface{}{
+		strconv.Itoa(status): map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     jsonContent(reply),
+		},
+		"default": map[string]string{"$ref": "#/components/responses/Error"},
+	}
+	if op.Admin {
+		result["security"] = []interface{}{map[string][]string{"adminToken": {}}}
+	}
+	return result
+}
+
+func parameter(p Param) map[string]interface{} {
+	return map[string]interface{}{
+		"name":        p.Name,
+		"in":          p.In,
+		"description": p.Description,
+		"required":    p.Required || p.In == "path",
+		"schema":      map[string]string{"type": "string"},
+	}
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// schemaGenerator turns Go types into JSON schemas following encoding/json's
+// rules. Named structs become component schemas.
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+)
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawType, t == interfaceType:
+		return map[string]interface{}{}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := g.schema(t.Elem())
+		if _, isRef := schema["$ref"]; isRef {
+			return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return ref(t.Name())
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, field := range JSONFields(t) {
+		properties[field.Name] = g.schema(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// JSONField is a struct field as encoding/json sees it.
+type JSONField struct {
+	Name      string
+	Type      reflect.Type
+	OmitEmpty bool
+}
+
+// JSONFields returns the fields encoding/json encodes for a struct type,
+// with the fields of embedded structs promoted, sorted by name.
+func JSONFields(t reflect.Type) []JSONField {
+	var fields []JSONField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			fields = append(fields, JSONFields(field.Type)...)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields = append(fields, JSONField{Name: name, Type: field.Type, OmitEmpty: strings.Contains(options, "omitempty")})
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// MaxQueryLength is the longest question, in characters, the API accepts.
+const MaxQueryLength = 2000
+
+// ValidateQuery checks a question sent in field.
+func ValidateQuery(field, query string) []model.FieldError {
+	switch {
+	case strings.TrimSpace(query) == "":
+		return []model.FieldError{{Field: field, Message: "is required"}}
+	case utf8.RuneCountInString(query) > MaxQueryLength:
+		return []model.FieldError{{Field: field, Message: fmt.Sprintf("must be at most %d characters", MaxQueryLength)}}
+	}
+	return nil
+}
+
+func ValidateChatRequest(request model.ChatRequest) []model.FieldError {
+	return ValidateQuery("query", request.Query)
+}
+
+// ValidateQueryRequest requires a question or a structured query.
+func ValidateQueryRequest(request model.QueryRequest) []model.FieldError {
+	if request.Structured != nil && request.Query == "" {
+		return nil
+	}
+	if request.Structured == nil && strings.TrimSpace(request.Query) == "" {
+		return []model.FieldError{{Field: "query", Message: "query or structured is required"}}
+	}
+	return ValidateQuery("query", request.Query)
+}
+
+// WriteValidationError rejects a request with invalid fields: as an error
+// envelope listing them on the versioned API and as plain text elsewhere.
+func WriteValidationError(w http.ResponseWriter, r *http.Request, fields []model.FieldError) {
+	if Versioned(r) {
+		WriteError(w, r, http.StatusBadRequest, CodeValidationFailed, "Invalid request", fields)
+		return
+	}
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	http.Error(w, "Invalid request: "+strings.Join(messages, "; "), http.StatusBadRequest)
+}
@@ -0,0 +1,404 @@
+// Package client is a typed Go client for the /api/v1 endpoints described by
+// the API's OpenAPI document: uploads, chat, analytics and the management of
+// datasets, budgets, settings and notifications.
+//
+//	c := client.New("http://localhost:8080")
+//	c.Household = "home-1"
+//	reply, err := c.Chat(ctx, "Berapa total konsumsi energi?")
+//
+// Errors returned by the API are *Error values carrying its error envelope.
+// A test checks that every operation in api.Operations has a method here that
+// uses its path and types.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"a21hc3NpZ25tZW50/api"
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Client calls the API at BaseURL. Household, User, PromptVersion and
+// TimeZone, when set, are sent with every request that uses them.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+
+	Household     string
+	User          string
+	PromptVersion string
+	TimeZone      string
+	// AdminToken authorizes the admin endpoints.
+	AdminToken string
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), HTTPClient: http.DefaultClient}
+}
+
+// Error is an error response from the API.
+type Error struct {
+	Status int
+	model.APIError
+}
+
+func (e *Error) Error() string {
+	message := fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+	if details, ok := e.Details.(string); ok && details != "" {
+		message += ": " + details
+	}
+	return message
+}
+
+// UploadOptions are the optional fields of an upload.
+type UploadOptions struct {
+	model.ImportOptions
+	Clean    bool
+	Interval string
+	Fill     string
+	Lang     string
+}
+
+// Upload sends a dataset and a question about it. The file is streamed to
+// the server as it is read.
+func (c *Client) Upload(ctx context.Context, filename string, file io.Reader, query string, options *UploadOptions) (model.UploadReply, error) {
+	fields := map[string]string{"query": query}
+	params := url.Values{}
+	if options != nil {
+		fields["format"] = options.Format
+		fields["sheet"] = options.Sheet
+		fields["delimiter"] = options.Delimiter
+		fields["quote"] = options.Quote
+		fields["decimal"] = options.Decimal
+		fields["header"] = options.Header
+		fields["encoding"] = options.Encoding
+		fields["interval"] = options.Interval
+		fields["fill"] = options.Fill
+		if options.Clean {
+			fields["clean"] = "true"
+		}
+		if options.Lang != "" {
+			params.Set("lang", options.Lang)
+		}
+	}
+
+	body, pipe := io.Pipe()
+	form := multipart.NewWriter(pipe)
+	go func() {
+		pipe.CloseWithError(writeUploadForm(form, filename, file, fields))
+	}()
+
+	var reply model.UploadReply
+	err := c.do(ctx, "POST", "/upload", c.zoned(params), form.FormDataContentType(), body, &reply)
+	body.Close()
+	return reply, err
+}
+
+// writeUploadForm writes the file of an upload and then its fields.
+func writeUploadForm(form *multipart.Writer, filename string, file io.Reader, fields map[string]string) error {
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return err
+	}
+	for name, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := form.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
+
+func (c *Client) Chat(ctx context.Context, query string) (model.ChatReply, error) {
+	var reply model.ChatReply
+	err := c.doJSON(ctx, "POST", "/chat", nil, model.ChatRequest{Query: query}, &reply)
+	return reply, err
+}
+
+// Query answers a question, or a structured query when request.Structured
+// is set, from the household's dataset.
+func (c *Client) Query(ctx context.Context, request model.QueryRequest) (model.QueryReply, error) {
+	var reply model.QueryReply
+	err := c.doJSON(ctx, "POST", "/query", c.zoned(nil), request, &reply)
+	return reply, err
+}
+
+// Ingest appends readings to the household's dataset and returns the
+// ingestion report and any budget alerts raised.
+func (c *Client) Ingest(ctx context.Context, readings []model.Reading) (model.IngestReport, []model.BudgetAlert, error) {
+	var report model.IngestReport
+	alerts, err := c.answer(ctx, "POST", "/ingest", nil, readings, &report)
+	return report, alerts, err
+}
+
+// Dataset returns the household's stored readings.
+func (c *Client) Dataset(ctx context.Context) ([]model.Reading, error) {
+	var readings []model.Reading
+	_, err := c.answer(ctx, "GET", "/dataset", c.zoned(nil), nil, &readings)
+	return readings, err
+}
+
+// ReplaceDataset replaces the household's dataset with readings in kWh per
+// interval and returns the report and any budget alerts raised. Nothing is
+// stored when any reading is invalid.
+func (c *Client) ReplaceDataset(ctx context.Context, readings []model.Reading) (model.IngestReport, []model.BudgetAlert, error) {
+	var report model.IngestReport
+	alerts, err := c.answer(ctx, "PUT", "/dataset", nil, readings, &report)
+	return report, alerts, err
+}
+
+func (c *Client) DeleteDataset(ctx context.Context) error {
+	_, err := c.answer(ctx, "DELETE", "/dataset", nil, nil, nil)
+	return err
+}
+
+// Datasets lists the size of every household's dataset. It needs
+// AdminToken.
+func (c *Client) Datasets(ctx context.Context) ([]model.DatasetSummary, error) {
+	var summaries []model.DatasetSummary
+	_, err := c.answer(ctx, "GET", "/datasets", nil, nil, &summaries)
+	return summaries, err
+}
+
+// Carbon estimates emissions per bucket, "hour" or "day".
+func (c *Client) Carbon(ctx context.Context, bucket string) (model.CarbonReport, error) {
+	var report model.CarbonReport
+	_, err := c.answer(ctx, "GET", "/analytics/carbon", c.zoned(query("bucket", bucket)), nil, &report)
+	return report, err
+}
+
+// Compare compares two periods of the dataset. Empty periods default to the
+// two latest.
+func (c *Client) Compare(ctx context.Context, mode, base, target string) (model.ComparisonReport, error) {
+	var report model.ComparisonReport
+	_, err := c.answer(ctx, "GET", "/datasets/compare", c.zoned(query("mode", mode, "base", base, "target", target)), nil, &report)
+	return report, err
+}
+
+func (c *Client) Budget(ctx context.Context) (model.Budget, error) {
+	var budget model.Budget
+	_, err := c.answer(ctx, "GET", "/goals", nil, nil, &budget)
+	return budget, err
+}
+
+// SetBudget sets the household's budget and returns the alerts it raises
+// against the current dataset.
+func (c *Client) SetBudget(ctx context.Context, budget model.Budget) (model.Budget, []model.BudgetAlert, error) {
+	var saved model.Budget
+	alerts, err := c.answer(ctx, "PUT", "/goals", nil, budget, &saved)
+	return saved, alerts, err
+}
+
+func (c *Client) DeleteBudget(ctx context.Context) error {
+	_, err := c.answer(ctx, "DELETE", "/goals", nil, nil, nil)
+	return err
+}
+
+func (c *Client) Alerts(ctx context.Context) ([]model.BudgetAlert, error) {
+	var alerts []model.BudgetAlert
+	_, err := c.answer(ctx, "GET", "/goals/alerts", nil, nil, &alerts)
+	return alerts, err
+}
+
+func (c *Client) Settings(ctx context.Context) (model.HouseholdSettings, error) {
+	var settings model.HouseholdSettings
+	_, err := c.answer(ctx, "GET", "/household", nil, nil, &settings)
+	return settings, err
+}
+
+func (c *Client) SetTimeZone(ctx context.Context, zone string) (model.HouseholdSettings, error) {
+	var settings model.HouseholdSettings
+	_, err := c.answer(ctx, "PUT", "/household", nil, model.HouseholdSettings{TimeZone: zone}, &settings)
+	return settings, err
+}
+
+func (c *Client) Sources(ctx context.Context) ([]model.SourceUnit, error) {
+	var units []model.SourceUnit
+	_, err := c.answer(ctx, "GET", "/sources", nil, nil, &units)
+	return units, err
+}
+
+func (c *Client) SetSource(ctx context.Context, unit model.SourceUnit) (model.SourceUnit, error) {
+	var saved model.SourceUnit
+	_, err := c.answer(ctx, "PUT", "/sources/"+url.PathEscape(unit.Appliance), nil, unit, &saved)
+	return saved, err
+}
+
+func (c *Client) DeleteSource(ctx context.Context, appliance string) error {
+	_, err := c.answer(ctx, "DELETE", "/sources/"+url.PathEscape(appliance), nil, nil, nil)
+	return err
+}
+
+func (c *Client) Subscribe(ctx context.Context, subscription model.WebhookSubscription) (model.WebhookSubscription, error) {
+	var saved model.WebhookSubscription
+	_, err := c.answer(ctx, "POST", "/notifications/webhooks", nil, subscription, &saved)
+	return saved, err
+}
+
+// Webhooks lists the household's webhook subscriptions, or every one with
+// AdminToken.
+func (c *Client) Webhooks(ctx context.Context) ([]model.WebhookSubscription, error) {
+	var subscriptions []model.WebhookSubscription
+	_, err := c.answer(ctx, "GET", "/notifications/webhooks", nil, nil, &subscriptions)
+	return subscriptions, err
+}
+
+func (c *Client) Unsubscribe(ctx context.Context, id string) error {
+	_, err := c.answer(ctx, "DELETE", "/notifications/webhooks/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+// DeadLetters lists the events that could not be delivered. It needs
+// AdminToken.
+func (c *Client) DeadLetters(ctx context.Context) ([]model.DeadLetter, error) {
+	var letters []model.DeadLetter
+	_, err := c.answer(ctx, "GET", "/notifications/dead-letters", nil, nil, &letters)
+	return letters, err
+}
+
+func (c *Client) Prompts(ctx context.Context) (model.PromptVersions, error) {
+	var versions model.PromptVersions
+	err := c.doJSON(ctx, "GET", "/prompts", nil, nil, &versions)
+	return versions, err
+}
+
+// OpenAPI returns the API's OpenAPI document.
+func (c *Client) OpenAPI(ctx context.Context) (map[string]interface{}, error) {
+	var document map[string]interface{}
+	err := c.doJSON(ctx, "GET", "/openapi.json", nil, nil, &document)
+	return document, err
+}
+
+// Usage reports model usage on the days from from to to (YYYY-MM-DD, empty
+// for open bounds). It needs AdminToken.
+func (c *Client) Usage(ctx context.Context, from, to string) (model.UsageReport, error) {
+	var report model.UsageReport
+	err := c.doJSON(ctx, "GET", "/admin/usage", query("from", from, "to", to), nil, &report)
+	return report, err
+}
+
+// answer calls an endpoint that replies {"status", "answer", "alerts"},
+// decodes the answer into out and returns the alerts.
+func (c *Client) answer(ctx context.Context, method, path string, params url.Values, in, out interface{}) ([]model.BudgetAlert, error) {
+	var reply struct {
+		Answer json.RawMessage     `json:"answer"`
+		Alerts []model.BudgetAlert `json:"alerts"`
+	}
+	if err := c.doJSON(ctx, method, path, params, in, &reply); err != nil {
+		return nil, err
+	}
+	if out != nil {
+		if err := json.Unmarshal(reply.Answer, out); err != nil {
+			return nil, fmt.Errorf("invalid answer: %v", err)
+		}
+	}
+	return reply.Alerts, nil
+}
+
+func (c *Client) doJSON(ctx context.Context, method, path string, params url.Values, in, out interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		content, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(content), "application/json"
+	}
+	return c.do(ctx, method, path, params, contentType, body, out)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, params url.Values, contentType string, body io.Reader, out interface{}) error {
+	target := c.BaseURL + api.Prefix + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for header, value := range map[string]string{
+		"X-Household-ID":   c.Household,
+		"X-User-ID":        c.User,
+		"X-Prompt-Version": c.PromptVersion,
+	} {
+		if value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	if c.AdminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AdminToken)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		apiErr := &Error{Status: resp.StatusCode}
+		var envelope model.ErrorEnvelope
+		if err := json.Unmarshal(content, &envelope); err == nil && envelope.Error.Code != "" {
+			apiErr.APIError = envelope.Error
+		} else {
+			apiErr.Code = api.Code(resp.StatusCode)
+			apiErr.Message = strings.TrimSpace(string(content))
+		}
+		return apiErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("invalid response: %v", err)
+	}
+	return nil
+}
+
+// zoned adds the client's time zone to params.
+func (c *Client) zoned(params url.Values) url.Values {
+	if params == nil {
+		params = url.Values{}
+	}
+	if c.TimeZone != "" {
+		params.Set("tz", c.TimeZone)
+	}
+	return params
+}
+
+// query builds parameters from name, value pairs, leaving out empty values.
+func query(pairs ...string) url.Values {
+	params := url.Values{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] != "" {
+			params.Set(pairs[i], pairs[i+1])
+		}
+	}
+	return params
+}
@@ -0,0 +1,129 @@
+// Command eval runs an evaluation suite of questions with expected answers
+// against the sample datasets and reports how well the answers score.
+//
+//	go run ./cmd/eval -provider model -record eval/recorded.json
+//	go run ./cmd/eval -provider replay -format markdown
+//
+// The replay provider scores the responses recorded in eval/recorded.json,
+// so a suite can be scored again offline. No recording is committed, as it
+// belongs to the models and endpoint it was made against: record one with
+// -provider model and HUGGINGFACE_TOKEN set, pointing HF_INFERENCE_ENDPOINT
+// at another inference API if needed.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/fileRepository"
+	"a21hc3NpZ25tZW50/service"
+
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	suitePath := flag.String("suite", "eval/suite.json", "evaluation suite")
+	dataDir := flag.String("data", "sample data", "directory of the suite's datasets")
+	provider := flag.String("provider", "analytics", "answer provider: model, replay or analytics")
+	replayPath := flag.String("replay", "eval/recorded.json", "recorded responses for the replay provider")
+	recordPath := flag.String("record", "", "file to record the provider's responses to")
+	format := flag.String("format", "json", "report format: json or markdown")
+	out := flag.String("out", "", "report file (default stdout)")
+	flag.Parse()
+
+	files := &repository.FileRepository{}
+	fileService := &service.FileService{
+		Repo:      files,
+		Importers: service.NewDefaultImporterRegistry(model.ImportMapping{}),
+	}
+
+	content, err := files.ReadFile(*suitePath)
+	if err != nil {
+		log.Fatal("Error reading suite: ", err)
+	}
+	suite, err := service.ParseEvalSuite(content)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var answers service.AnswerProvider
+	switch *provider {
+	case "model":
+		_ = godotenv.Load()
+		token := os.Getenv("HUGGINGFACE_TOKEN")
+		if token == "" {
+			log.Fatal("HUGGINGFACE_TOKEN is not set")
+		}
+		endpoint := os.Getenv("HF_INFERENCE_ENDPOINT")
+		translation := service.NewTranslationService(token)
+		if endpoint != "" {
+			translation = service.NewTranslationServiceAt(token, endpoint)
+		}
+		answers = &service.ModelProvider{
+			AI:          &service.AIService{Client: &http.Client{}, Guard: service.NewPromptGuard(), Endpoint: endpoint},
+			Token:       token,
+			Translation: translation,
+		}
+	case "replay":
+		recorded, err := files.ReadFile(*replayPath)
+		if err != nil {
+			log.Fatal("Error reading recorded responses; record them with -provider model -record: ", err)
+		}
+		replay := &service.ReplayProvider{}
+		if err := json.Unmarshal(recorded, &replay.Responses); err != nil {
+			log.Fatal("Invalid recorded responses: ", err)
+		}
+		answers = replay
+	case "analytics":
+		answers = &service.AnalyticsProvider{}
+	default:
+		log.Fatalf("Unknown provider %q", *provider)
+	}
+	var recorder *service.RecordingProvider
+	if *recordPath != "" {
+		recorder = &service.RecordingProvider{Provider: answers}
+		answers = recorder
+	}
+
+	evaluator := &service.Evaluator{
+		Provider: answers,
+		LoadTable: func(dataset string) (map[string][]string, error) {
+			content, err := files.ReadFile(filepath.Join(*dataDir, dataset))
+			if err != nil {
+				return nil, err
+			}
+			table, _, err := fileService.ImportFile(string(content), model.ImportOptions{})
+			return table, err
+		},
+	}
+	report := evaluator.Run(suite)
+
+	if recorder != nil {
+		recorded, _ := json.MarshalIndent(recorder.Responses, "", "  ")
+		if err := files.SaveFile(*recordPath, append(recorded, '\n')); err != nil {
+			log.Fatal("Error saving recorded responses: ", err)
+		}
+	}
+
+	var output []byte
+	switch *format {
+	case "json":
+		output, _ = json.MarshalIndent(report, "", "  ")
+		output = append(output, '\n')
+	case "markdown":
+		output = []byte(service.EvalMarkdown(report))
+	default:
+		log.Fatalf("Unknown format %q", *format)
+	}
+	if *out == "" {
+		fmt.Print(string(output))
+	} else if err := files.SaveFile(*out, output); err != nil {
+		log.Fatal("Error saving report: ", err)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	datasetRepository "a21hc3NpZ25tZW50/repository/datasetRepository"
+	"a21hc3NpZ25tZW50/service"
+)
+
+// NewHandler serves the API as main does, calling the models at endpoint.
+func NewHandler(token, endpoint string) http.Handler {
+	aiService = newAIService(endpoint)
+	return newHandler(token, newTranslationService(token, endpoint))
+}
+
+// The services main shares between handlers, for tests to set up and check.
+var (
+	Datasets *datasetRepository.DatasetRepository = datasetRepo
+	Usage    *service.UsageService                = usageService
+)
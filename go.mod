@@ -1,6 +1,6 @@
 module a21hc3NpZ25tZW50
 
-go 1.18
+go 1.19
 
 require (
 	github.com/gorilla/mux v1.8.1
@@ -10,12 +10,12 @@ require (
 	github.com/onsi/ginkgo/v2 v2.1.3
 	github.com/onsi/gomega v1.18.1
 	github.com/rs/cors v1.11.1
+	golang.org/x/text v0.20.0
 )
 
 require (
 	github.com/gorilla/securecookie v1.1.2 // indirect
 	golang.org/x/net v0.31.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
-	golang.org/x/text v0.20.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/smtp"
 	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
+	_ "time/tzdata"
 
+	"a21hc3NpZ25tZW50/api"
+	"a21hc3NpZ25tZW50/model"
+	datasetRepository "a21hc3NpZ25tZW50/repository/datasetRepository"
 	repository "a21hc3NpZ25tZW50/repository/fileRepository"
+	goalRepository "a21hc3NpZ25tZW50/repository/goalRepository"
+	householdRepository "a21hc3NpZ25tZW50/repository/householdRepository"
+	notificationRepository "a21hc3NpZ25tZW50/repository/notificationRepository"
+	sourceRepository "a21hc3NpZ25tZW50/repository/sourceRepository"
+	usageRepository "a21hc3NpZ25tZW50/repository/usageRepository"
 	"a21hc3NpZ25tZW50/service"
 
 	"github.com/gorilla/mux"
@@ -20,16 +39,348 @@ import (
 
 // Initialize the services
 var fileService = &service.FileService{
-    Repo: &repository.FileRepository{},
+    Repo:      &repository.FileRepository{},
+    Importers: service.NewDefaultImporterRegistry(model.ImportMapping{}),
 }
 var aiService *service.AIService
+var datasetRepo = datasetRepository.NewDatasetRepository()
+var carbonService = service.NewCarbonService(service.DefaultEmissionFactor)
+var comparisonService = &service.ComparisonService{}
+var queryService = &service.QueryService{}
+var retrievalService = service.NewRetrievalService()
+var promptGuard = service.NewPromptGuard()
+var promptService = service.DefaultPrompts()
+var goalService = &service.GoalService{
+    Repo: goalRepository.NewGoalRepository(),
+}
+var householdService = service.NewHouseholdService(householdRepository.NewHouseholdRepository())
+var unitService = service.NewUnitService(sourceRepository.NewSourceRepository())
+var ingestService = &service.IngestService{
+    Repo:       datasetRepo,
+    Households: householdService,
+    Units:      unitService,
+}
+var notificationService = service.NewNotificationService(service.NewWebhookClient(service.WebhookTimeout), notificationRepository.NewNotificationRepository())
+var usageService = service.NewUsageService(usageRepository.NewUsageRepository())
+// adminToken authorizes the /admin endpoints; they are closed when empty.
+var adminToken string
+// maxUploadBytes caps the /upload request body; files larger than
+// streamThreshold are parsed with FileService.StreamFile.
+var maxUploadBytes int64 = 512 << 20
+var streamThreshold int64 = 8 << 20
+// maxIngestBytes caps the /ingest request body.
+var maxIngestBytes int64 = 10 << 20
 var store = sessions.NewCookieStore([]byte("my-key"))
 
+// uploadMemoryBytes is how much of an upload form is held in memory; larger
+// files are spooled to a temporary file.
+const uploadMemoryBytes = 8 << 20
+
+// uploadForm parses a multipart upload, whose fields may come before or
+// after its "file" part, and opens the file. The fields and the URL query
+// values are in r.Form. The caller removes the spooled copy of the file with
+// r.MultipartForm.RemoveAll.
+func uploadForm(r *http.Request) (multipart.File, *multipart.FileHeader, error) {
+    if err := r.ParseMultipartForm(uploadMemoryBytes); err != nil {
+        return nil, nil, err
+    }
+    return r.FormFile("file")
+}
+
+// bodyTooLarge reports whether err comes from reading past the limit of an
+// http.MaxBytesReader.
+func bodyTooLarge(err error) bool {
+    var tooLarge *http.MaxBytesError
+    return errors.As(err, &tooLarge)
+}
+
 func getSession(r *http.Request) *sessions.Session {
     session, _ := store.Get(r, "chat-session")
     return session
 }
 
+// householdID identifies whose dataset a request works on. It is taken from
+// the X-Household-ID header or the "household" form/query value.
+func householdID(r *http.Request) string {
+    if id := r.Header.Get("X-Household-ID"); id != "" {
+        return id
+    }
+    if id := r.FormValue("household"); id != "" {
+        return id
+    }
+    return "default"
+}
+
+// userID identifies who made a request, for usage accounting. It is taken
+// from the X-User-ID header or the "user" form/query value. Nothing
+// authenticates it, so quotas keyed on it and on householdID are advisory.
+func userID(r *http.Request) string {
+    if id := r.Header.Get("X-User-ID"); id != "" {
+        return id
+    }
+    if id := r.FormValue("user"); id != "" {
+        return id
+    }
+    return "anonymous"
+}
+
+// meteredServices returns copies of the AI and translation services that
+// record model calls for the request's user and household under endpoint.
+// It fails with service.ErrQuotaExceeded once either has used its daily
+// quota.
+func meteredServices(r *http.Request, endpoint string, translationService *service.TranslationService) (*service.AIService, *service.TranslationService, error) {
+    scope := model.UsageScope{User: userID(r), Household: householdID(r), Endpoint: endpoint}
+    if err := usageService.CheckQuota(scope.User, scope.Household); err != nil {
+        return nil, nil, err
+    }
+    return aiService.WithScope(scope), translationService.WithScope(scope), nil
+}
+
+// requestZone returns the time zone a request asks for with the "tz" value,
+// or the household's time zone.
+func requestZone(r *http.Request, household string) (*time.Location, error) {
+    if zone := r.FormValue("tz"); zone != "" {
+        return service.LoadZone(zone)
+    }
+    return householdService.Location(household), nil
+}
+
+// localReadings parses the household's dataset and expresses its times in
+// loc. Readings stored without a timestamp are read in the household's zone.
+func localReadings(household string, table map[string][]string, loc *time.Location) ([]model.Reading, error) {
+    readings, err := service.ParseReadings(table)
+    if err != nil {
+        return nil, err
+    }
+    if err := service.ResolveTimes(readings, householdService.Location(household)); err != nil {
+        return nil, err
+    }
+    if err := service.ResolveTimes(readings, loc); err != nil {
+        return nil, err
+    }
+    return readings, nil
+}
+
+// supportedUpload reports whether an uploaded file may be one of the formats
+// FileService.ImportFile understands. The actual format is sniffed from the
+// content; this only rejects files that are clearly something else.
+func supportedUpload(filename, contentType string) bool {
+    switch strings.ToLower(path.Ext(filename)) {
+    case ".csv", ".txt", ".json", ".ndjson", ".jsonl", ".xlsx", ".xml":
+        return true
+    case "":
+        return contentType == "" || strings.HasPrefix(contentType, "text/") ||
+            strings.Contains(contentType, "json") || strings.Contains(contentType, "xml") ||
+            strings.Contains(contentType, "spreadsheetml") || contentType == "application/octet-stream"
+    }
+    return false
+}
+
+// evaluateGoals checks the household's budget against its current dataset.
+func evaluateGoals(household string) []model.BudgetAlert {
+    table, ok := datasetRepo.Get(household)
+    if !ok {
+        return nil
+    }
+    loc := householdService.Location(household)
+    readings, err := localReadings(household, table, loc)
+    if err != nil {
+        log.Println("Failed to read dataset for goals:", err)
+        return nil
+    }
+    alerts, err := goalService.Evaluate(household, readings)
+    if err != nil {
+        log.Println("Failed to evaluate goals:", err)
+        return nil
+    }
+    return alerts
+}
+
+// datasetAnomalies detects anomalous readings in the household's dataset.
+func datasetAnomalies(household string) []model.Anomaly {
+    readings, err := datasetReadings(household)
+    if err != nil {
+        return nil
+    }
+    return service.DetectAnomalies(readings, 0)
+}
+
+// publishNewAnomalies publishes an event for each anomaly in the household's
+// dataset that was not among before, the anomalies detected before new
+// readings were added.
+func publishNewAnomalies(household string, before []model.Anomaly) {
+    seen := map[string]bool{}
+    for _, a := range before {
+        seen[a.Date+" "+a.Time+" "+a.Appliance] = true
+    }
+    for _, a := range datasetAnomalies(household) {
+        if !seen[a.Date+" "+a.Time+" "+a.Appliance] {
+            notificationService.PublishAsync(service.NewEvent(service.EventAnomaly, household, a))
+        }
+    }
+}
+
+// runAnalysis is the analysis pipeline behind /upload: it asks the table model
+// the query and, once it has answered, adds the readings of an energy table
+// that are not yet stored to the household's dataset, commits the meter
+// samples of normalizer, evaluates goals and publishes notification events
+// for new anomalies, budget alerts and the finished analysis. A failed
+// analysis stores nothing, so the upload can be retried. Other tables are
+// analyzed but not stored.
+// The guard report lists the cells withheld from the table model.
+func runAnalysis(ai *service.AIService, household string, table map[string][]string, normalizer *service.Normalizer, query, token string, translationService *service.TranslationService) (string, []model.BudgetAlert, model.GuardReport, error) {
+    // A query rejected as prompt injection stores and publishes nothing.
+    if err := promptGuard.CheckQuery(query); err != nil {
+        return "", nil, model.GuardReport{}, err
+    }
+
+    response, guardReport, err := ai.AnalyzeTable(service.AnalysisTable(table), query, token, translationService)
+    if err != nil {
+        return "", nil, guardReport, err
+    }
+
+    anomalies := datasetAnomalies(household)
+    if added, err := ingestService.Store(household, table); err != nil {
+        log.Println("Uploaded table not stored:", err)
+    } else {
+        normalizer.Commit()
+        if added > 0 {
+            publishNewAnomalies(household, anomalies)
+        }
+    }
+
+    alerts := evaluateGoals(household)
+    for _, alert := range alerts {
+        notificationService.PublishAsync(service.NewEvent(service.EventBudgetAlert, household, alert))
+    }
+
+    notificationService.PublishAsync(service.NewEvent(service.EventAnalysisComplete, household, map[string]string{
+        "query":  query,
+        "answer": response,
+    }))
+    return response, alerts, guardReport, nil
+}
+
+// aiErrorStatus is the status for a failed model call: 400 for queries
+// rejected as prompt injection, 502 for answers withheld by the output check,
+// 429 once a usage quota is exceeded and fallback otherwise.
+func aiErrorStatus(err error, fallback int) int {
+    switch {
+    case errors.Is(err, service.ErrQuotaExceeded):
+        return http.StatusTooManyRequests
+    case errors.Is(err, service.ErrPromptInjection):
+        return http.StatusBadRequest
+    case errors.Is(err, service.ErrUnsafeOutput):
+        return http.StatusBadGateway
+    }
+    return fallback
+}
+
+// ingestReadings appends device readings to the household's live dataset and
+// evaluates goals against the updated data, publishing new anomalies and
+// budget alerts.
+func ingestReadings(household string, readings []model.Reading) (model.IngestReport, []model.BudgetAlert) {
+    anomalies := datasetAnomalies(household)
+    report := ingestService.Ingest(household, readings)
+    if report.Accepted == 0 {
+        return report, nil
+    }
+    publishNewAnomalies(household, anomalies)
+
+    alerts := evaluateGoals(household)
+    for _, alert := range alerts {
+        notificationService.PublishAsync(service.NewEvent(service.EventBudgetAlert, household, alert))
+    }
+    return report, alerts
+}
+
+// datasetContext summarizes the household's uploaded data for chat grounding.
+func datasetContext(household string) string {
+    table, ok := datasetRepo.Get(household)
+    if !ok {
+        return ""
+    }
+    readings, err := localReadings(household, table, householdService.Location(household))
+    if err != nil {
+        return ""
+    }
+    summary := carbonService.Summary(carbonService.Compute(readings, "day"))
+    if report, err := comparisonService.Compare(readings, service.CompareDay, "", ""); err == nil {
+        summary += "\n" + comparisonService.Summary(report)
+    }
+    return summary
+}
+
+// datasetReadings returns the household's dataset as readings in its time
+// zone, in the order of the stored rows.
+func datasetReadings(household string) ([]model.Reading, error) {
+    table, ok := datasetRepo.Get(household)
+    if !ok {
+        return nil, errors.New("no data uploaded for this household")
+    }
+    return localReadings(household, table, householdService.Location(household))
+}
+
+// promptVersion resolves the prompt template version a request asks for with
+// the X-Prompt-Version header or the "prompt_version" value.
+func promptVersion(r *http.Request) (string, error) {
+    version := r.Header.Get("X-Prompt-Version")
+    if version == "" {
+        version = r.FormValue("prompt_version")
+    }
+    return promptService.Resolve(version)
+}
+
+// requestLanguage is the "lang" value, else the primary language of the
+// Accept-Language header, else the default prompt language.
+func requestLanguage(r *http.Request) string {
+    if lang := r.FormValue("lang"); lang != "" {
+        return strings.ToLower(lang)
+    }
+    if accept := r.Header.Get("Accept-Language"); accept != "" {
+        tag := strings.TrimSpace(strings.Split(strings.Split(accept, ",")[0], ";")[0])
+        if tag = strings.ToLower(strings.Split(tag, "-")[0]); tag != "" && tag != "*" {
+            return tag
+        }
+    }
+    return service.DefaultPromptLanguage
+}
+
+// usageSummary renders the upload summary and recommendations for a table in
+// the energy schema.
+func usageSummary(table map[string][]string, version, lang string) (string, []string, error) {
+    readings, err := service.ParseReadings(table)
+    if err != nil {
+        return "", nil, nil
+    }
+    usage, recommendations, ok := service.SummarizeUsage(readings, 2)
+    if !ok {
+        return "", nil, nil
+    }
+    summary, _, err := promptService.Render(version, service.PromptUploadSummary, lang, usage)
+    if err != nil {
+        return "", nil, err
+    }
+    var advice []string
+    for _, recommendation := range recommendations {
+        text, _, err := promptService.Render(version, service.PromptRecommendation, lang, recommendation)
+        if err != nil {
+            return "", nil, err
+        }
+        advice = append(advice, text)
+    }
+    return summary, advice, nil
+}
+
+// analyticsTools gives the chat model tools over the household's readings.
+func analyticsTools(household string, readings []model.Reading) *service.AnalyticsTools {
+    tools := &service.AnalyticsTools{Readings: readings}
+    if budget, ok := goalService.Repo.GetBudget(household); ok {
+        tools.Budget = &budget
+    }
+    return tools
+}
+
 func main() {
     // Load the .env file
     err := godotenv.Load()
@@ -43,129 +394,989 @@ func main() {
         log.Fatal("HUGGINGFACE_TOKEN is not set in the .env file")
     }
 
-    // Initialize AIService
-    aiService = &service.AIService{
-        Client: &http.Client{},
+    // Configure upload limits
+    if limit := os.Getenv("MAX_UPLOAD_BYTES"); limit != "" {
+        value, err := strconv.ParseInt(limit, 10, 64)
+        if err != nil || value <= 0 {
+            log.Fatal("MAX_UPLOAD_BYTES must be a positive number")
+        }
+        maxUploadBytes = value
+    }
+    if limit := os.Getenv("MAX_INGEST_BYTES"); limit != "" {
+        value, err := strconv.ParseInt(limit, 10, 64)
+        if err != nil || value <= 0 {
+            log.Fatal("MAX_INGEST_BYTES must be a positive number")
+        }
+        maxIngestBytes = value
+    }
+    if threshold := os.Getenv("STREAM_THRESHOLD_BYTES"); threshold != "" {
+        value, err := strconv.ParseInt(threshold, 10, 64)
+        if err != nil || value < 0 {
+            log.Fatal("STREAM_THRESHOLD_BYTES must be a non-negative number")
+        }
+        streamThreshold = value
     }
 
-    // Set up the router
-    router := mux.NewRouter()
+    // Configure the time zone of households that have not set one
+    if zone := os.Getenv("DEFAULT_TIMEZONE"); zone != "" {
+        loc, err := service.LoadZone(zone)
+        if err != nil {
+            log.Fatal("DEFAULT_TIMEZONE: ", err)
+        }
+        householdService.DefaultZone = loc
+    }
+
+    // Configure carbon accounting: a static factor or an hourly intensity profile
+    if factor := os.Getenv("CARBON_FACTOR"); factor != "" {
+        value, err := strconv.ParseFloat(factor, 64)
+        if err != nil || value <= 0 {
+            log.Fatal("CARBON_FACTOR must be a positive number")
+        }
+        carbonService.Factor = value
+    }
+    if profilePath := os.Getenv("CARBON_PROFILE"); profilePath != "" {
+        content, err := fileService.Repo.ReadFile(profilePath)
+        if err != nil {
+            log.Fatal("Error reading CARBON_PROFILE: ", err)
+        }
+        if err := carbonService.LoadProfile(string(content)); err != nil {
+            log.Fatal("Error loading CARBON_PROFILE: ", err)
+        }
+    }
+
+    // Configure the optional SMTP notification channel
+    if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+        smtpPort := os.Getenv("SMTP_PORT")
+        if smtpPort == "" {
+            smtpPort = "25"
+        }
+        channel := &service.EmailChannel{
+            Addr: smtpHost + ":" + smtpPort,
+            From: os.Getenv("SMTP_FROM"),
+            To:   strings.Split(os.Getenv("SMTP_TO"), ","),
+        }
+        if username := os.Getenv("SMTP_USERNAME"); username != "" {
+            channel.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), smtpHost)
+        }
+        notificationService.Channels = append(notificationService.Channels, channel)
+    }
+
+    // Load importer mappings for Home Assistant and Green Button exports
+    if mappingPath := os.Getenv("IMPORT_MAPPING"); mappingPath != "" {
+        content, err := fileService.Repo.ReadFile(mappingPath)
+        if err != nil {
+            log.Fatal("Error reading IMPORT_MAPPING: ", err)
+        }
+        var mapping model.ImportMapping
+        if err := json.Unmarshal(content, &mapping); err != nil {
+            log.Fatal("Error parsing IMPORT_MAPPING: ", err)
+        }
+        fileService.Importers = service.NewDefaultImporterRegistry(mapping)
+    }
+
+    // Start the optional MQTT subscriber for smart-plug telemetry
+    if broker := os.Getenv("MQTT_BROKER"); broker != "" {
+        mapping := service.DefaultMQTTMapping
+        for env, field := range map[string]*string{
+            "MQTT_FIELD_HOUSEHOLD": &mapping.Household,
+            "MQTT_FIELD_DATE":      &mapping.Date,
+            "MQTT_FIELD_TIME":      &mapping.Time,
+            "MQTT_FIELD_TIMESTAMP": &mapping.Timestamp,
+            "MQTT_FIELD_APPLIANCE": &mapping.Appliance,
+            "MQTT_FIELD_ENERGY":    &mapping.Energy,
+            "MQTT_FIELD_ROOM":      &mapping.Room,
+            "MQTT_FIELD_STATUS":    &mapping.Status,
+        } {
+            if value := os.Getenv(env); value != "" {
+                *field = value
+            }
+        }
+
+        var topics []string
+        for _, topic := range strings.Split(os.Getenv("MQTT_TOPICS"), ",") {
+            if topic = strings.TrimSpace(topic); topic != "" {
+                topics = append(topics, topic)
+            }
+        }
+        if len(topics) == 0 {
+            log.Fatal("MQTT_TOPICS is required when MQTT_BROKER is set")
+        }
+
+        clientID := os.Getenv("MQTT_CLIENT_ID")
+        if clientID == "" {
+            clientID = "energy-backend"
+        }
+        subscriber := &service.MQTTSubscriber{
+            Broker:   broker,
+            ClientID: clientID,
+            Username: os.Getenv("MQTT_USERNAME"),
+            Password: os.Getenv("MQTT_PASSWORD"),
+            Topics:   topics,
+            Mapping:  mapping,
+            Handler: func(household string, readings []model.Reading) {
+                report, _ := ingestReadings(household, readings)
+                if len(report.Rejected) > 0 {
+                    log.Printf("MQTT readings rejected for %s: %+v\n", household, report.Rejected)
+                }
+            },
+        }
+        go func() {
+            log.Println("MQTT subscriber stopped:", subscriber.Run(context.Background()))
+        }()
+    }
+
+    // Load prompt templates from PROMPT_DIR over the built-in ones and
+    // reload them when the files change
+    if dir := os.Getenv("PROMPT_DIR"); dir != "" {
+        prompts, err := service.NewPromptService(dir)
+        if err != nil {
+            log.Fatal("Error loading PROMPT_DIR: ", err)
+        }
+        promptService = prompts
+    }
+    if version := os.Getenv("PROMPT_VERSION"); version != "" {
+        if err := promptService.SetDefaultVersion(version); err != nil {
+            log.Fatal("PROMPT_VERSION: ", err)
+        }
+    }
+    go promptService.Watch(context.Background(), 2*time.Second)
+
+    // Configure model prices per thousand tokens from a JSON file mapping
+    // model names to prices, daily token and cost quotas and how long usage
+    // is kept. Quotas are advisory: users and households are named by
+    // request headers that nothing authenticates.
+    if pricesPath := os.Getenv("MODEL_PRICES"); pricesPath != "" {
+        content, err := fileService.Repo.ReadFile(pricesPath)
+        if err != nil {
+            log.Fatal("Error reading MODEL_PRICES: ", err)
+        }
+        if err := json.Unmarshal(content, &usageService.Prices); err != nil {
+            log.Fatal("Invalid MODEL_PRICES: ", err)
+        }
+    }
+    for _, quota := range []struct {
+        name  string
+        quota *model.UsageQuota
+    }{
+        {"USER", &usageService.UserQuota},
+        {"HOUSEHOLD", &usageService.HouseholdQuota},
+    } {
+        if tokens := os.Getenv("QUOTA_" + quota.name + "_TOKENS"); tokens != "" {
+            value, err := strconv.Atoi(tokens)
+            if err != nil || value < 0 {
+                log.Fatal("QUOTA_" + quota.name + "_TOKENS must be a non-negative number")
+            }
+            quota.quota.Tokens = value
+        }
+        if cost := os.Getenv("QUOTA_" + quota.name + "_COST"); cost != "" {
+            value, err := strconv.ParseFloat(cost, 64)
+            if err != nil || value < 0 {
+                log.Fatal("QUOTA_" + quota.name + "_COST must be a non-negative number")
+            }
+            quota.quota.Cost = value
+        }
+    }
+    if days := os.Getenv("USAGE_RETENTION_DAYS"); days != "" {
+        value, err := strconv.Atoi(days)
+        if err != nil || value < 0 {
+            log.Fatal("USAGE_RETENTION_DAYS must be a non-negative number")
+        }
+        usageService.RetentionDays = value
+    }
+    adminToken = os.Getenv("ADMIN_TOKEN")
+
+    // Initialize AIService, calling HF_INFERENCE_ENDPOINT instead of the
+    // Hugging Face API when set
+    endpoint := os.Getenv("HF_INFERENCE_ENDPOINT")
+    aiService = newAIService(endpoint)
+
+    // Configure the backends tried after a query's routed ones, such as
+    // "chat:<model>" for another chat model, and how long each may take
+    if fallback := os.Getenv("MODEL_FALLBACK"); fallback != "" {
+        backends, err := service.ParseBackends(fallback)
+        if err != nil {
+            log.Fatal("MODEL_FALLBACK: ", err)
+        }
+        aiService.Router.Fallback = backends
+    }
+    if timeout := os.Getenv("MODEL_TIMEOUT"); timeout != "" {
+        value, err := time.ParseDuration(timeout)
+        if err != nil || value <= 0 {
+            log.Fatal("MODEL_TIMEOUT must be a positive duration such as 30s")
+        }
+        aiService.Router.Timeout = value
+    }
+
+    // Serve the API. Every endpoint is served under /api/v1; errors there
+    // are returned as JSON error envelopes.
+    translationService := newTranslationService(token, endpoint)
+    handler := newHandler(token, translationService)
+
+    // Enable CORS
+    corsHandler := cors.New(cors.Options{
+        AllowedOrigins: []string{"http://localhost:3000"},
+        AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+        AllowedHeaders: []string{"Content-Type", "Authorization", "X-Household-ID", "X-User-ID", "X-Prompt-Version", api.RequestIDHeader},
+        ExposedHeaders: []string{api.RequestIDHeader},
+    }).Handler(handler)
+
+    // Start the server
+    port := os.Getenv("PORT")
+    if port == "" {
+        port = "8080"
+    }
+    log.Printf("Server running on port %s\n", port)
+    log.Fatal(http.ListenAndServe(":"+port, corsHandler))
+}
+
+// newAIService returns the AI service of the models at endpoint, or of the
+// Hugging Face API when it is empty.
+func newAIService(endpoint string) *service.AIService {
+    return &service.AIService{
+        Client:   &http.Client{},
+        Guard:    promptGuard,
+        Prompts:  promptService,
+        Endpoint: endpoint,
+        Router:   service.NewQueryRouter(),
+        Usage:    usageService,
+    }
+}
+
+// newTranslationService returns the translation service of the models at
+// endpoint, or of the Hugging Face API when it is empty.
+func newTranslationService(token, endpoint string) *service.TranslationService {
     translationService := service.NewTranslationService(token)
+    if endpoint != "" {
+        translationService = service.NewTranslationServiceAt(token, endpoint)
+    }
+    translationService.Usage = usageService
+    return translationService
+}
+
+// newHandler serves every endpoint under /api/v1, with their errors returned
+// as JSON error envelopes, and gives each request an ID.
+func newHandler(token string, translationService *service.TranslationService) http.Handler {
+    return api.RequestID(api.Errors(newRouter(token, translationService)))
+}
+
+// newRouter registers the endpoints under /api/v1. /upload, /chat and
+// /openapi.json are also served at their unversioned paths.
+func newRouter(token string, translationService *service.TranslationService) *mux.Router {
+    router := mux.NewRouter()
+    v1 := router.PathPrefix(api.Prefix).Subrouter()
+    upload := uploadHandler(token, translationService)
+    chat := chatHandler(token, translationService)
+
+    v1.HandleFunc("/upload", upload).Methods("POST")
+    v1.HandleFunc("/chat", chat).Methods("POST")
+    // The unversioned paths the frontend calls stay as aliases
+    router.HandleFunc("/upload", upload).Methods("POST")
+    router.HandleFunc("/chat", chat).Methods("POST")
+
+    // Structured query endpoint: the chat model turns the question into a
+    // query, or the client sends one as "structured", and the query engine
+    // answers it from the household's dataset.
+    v1.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+        var input model.QueryRequest
+        if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+            http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid request:", err)
+            return
+        }
+        if invalid := api.ValidateQueryRequest(input); invalid != nil {
+            api.WriteValidationError(w, r, invalid)
+            log.Println("Invalid request:", invalid)
+            return
+        }
 
-    // File upload endpoint
-    router.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-        // Ensure the content type is multipart/form-data
-        if r.Header.Get("Content-Type") == "" || !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
-            http.Error(w, "Content-Type header is not multipart/form-data", http.StatusBadRequest)
-            log.Println("Content-Type header is not multipart/form-data")
+        household := householdID(r)
+        loc, err := requestZone(r, household)
+        if err != nil {
+            http.Error(w, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid time zone:", err)
+            return
+        }
+        table, ok := datasetRepo.Get(household)
+        if !ok {
+            http.Error(w, "No data uploaded for this household", http.StatusNotFound)
+            log.Println("No data uploaded for this household")
+            return
+        }
+        readings, err := localReadings(household, table, loc)
+        if err != nil {
+            http.Error(w, "Failed to read dataset: "+err.Error(), http.StatusUnprocessableEntity)
+            log.Println("Failed to read dataset:", err)
             return
         }
 
-        file, header, err := r.FormFile("file")
+        version, err := promptVersion(r)
         if err != nil {
-            http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
-            log.Println("Failed to read file:", err)
+            http.Error(w, "Invalid prompt version: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid prompt version:", err)
             return
         }
-        defer file.Close()
 
-        fmt.Println("File name:", header.Filename)
+        query := input.Structured
+        if query == nil {
+            ai, translation, err := meteredServices(r, "/query", translationService)
+            if err != nil {
+                http.Error(w, err.Error(), aiErrorStatus(err, http.StatusInternalServerError))
+                log.Println("Rejected query:", err)
+                return
+            }
+            generated, err := ai.WithPromptVersion(version).GenerateQuery(input.Query, token, translation)
+            if err != nil {
+                http.Error(w, "Failed to build query: "+err.Error(), aiErrorStatus(err, http.StatusUnprocessableEntity))
+                log.Println("Failed to build query:", err)
+                return
+            }
+            query = &generated
+        }
 
-        content, err := ioutil.ReadAll(file)
+        result, err := queryService.Execute(readings, *query)
         if err != nil {
-            http.Error(w, "Failed to read file content: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to read file content:", err)
+            http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid query:", err)
             return
         }
 
-        log.Println("File content:", string(content))
+        jsonResponse(w, model.QueryReply{
+            Status:        "success",
+            Answer:        queryService.Summary(result),
+            Query:         result.Query,
+            Result:        result,
+            PromptVersion: version,
+        })
+    }).Methods("POST")
 
-        table, err := fileService.ProcessFile(string(content))
+    // Device ingestion endpoint: a JSON reading, a JSON array or NDJSON
+    v1.HandleFunc("/ingest", func(w http.ResponseWriter, r *http.Request) {
+        r.Body = http.MaxBytesReader(w, r.Body, maxIngestBytes)
+        readings, err := service.DecodeReadings(r.Body, r.Header.Get("Content-Type"))
+        if bodyTooLarge(err) {
+            http.Error(w, fmt.Sprintf("Readings exceed the ingest limit of %d bytes", maxIngestBytes), http.StatusRequestEntityTooLarge)
+            log.Println("Ingest exceeds the size limit")
+            return
+        }
         if err != nil {
-            http.Error(w, "Failed to process file: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to process file:", err)
+            http.Error(w, "Invalid readings: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid readings:", err)
             return
         }
 
-        query := r.FormValue("query")
-        if query == "" {
-            http.Error(w, "Query is empty", http.StatusBadRequest)
-            log.Println("Query is empty")
+        report, alerts := ingestReadings(householdID(r), readings)
+        if report.Accepted == 0 && len(report.Rejected) > 0 {
+            api.WriteError(w, r, http.StatusUnprocessableEntity, api.Code(http.StatusUnprocessableEntity), "No readings were accepted", report)
+            log.Println("No readings were accepted")
             return
         }
 
-        session := getSession(r)
-        session.Values["query"] = query
-        session.Save(r, w)
+        result := map[string]interface{}{"status": "success", "answer": report}
+        if len(alerts) > 0 {
+            result["alerts"] = alerts
+        }
+        jsonResponse(w, result)
+    }).Methods("POST")
 
-        response, err := aiService.AnalyzeData(table, query, token, translationService)
+    // Dataset endpoints: the household's stored readings, which can be
+    // replaced or deleted, and an admin list of every household's dataset
+    v1.HandleFunc("/dataset", func(w http.ResponseWriter, r *http.Request) {
+        household := householdID(r)
+        table, ok := datasetRepo.Get(household)
+        if !ok {
+            http.Error(w, "No data uploaded for this household", http.StatusNotFound)
+            log.Println("No data uploaded for household", household)
+            return
+        }
+        loc, err := requestZone(r, household)
+        if err != nil {
+            http.Error(w, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid time zone:", err)
+            return
+        }
+        readings, err := localReadings(household, table, loc)
         if err != nil {
-            http.Error(w, "Failed to analyze data: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to analyze data:", err)
+            http.Error(w, "Invalid dataset: "+err.Error(), http.StatusUnprocessableEntity)
+            log.Println("Invalid dataset:", err)
             return
         }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": readings})
+    }).Methods("GET")
 
-        jsonResponse(w, map[string]string{"status": "success", "answer": response})
-    }).Methods("POST")
+    v1.HandleFunc("/dataset", func(w http.ResponseWriter, r *http.Request) {
+        r.Body = http.MaxBytesReader(w, r.Body, maxIngestBytes)
+        readings, err := service.DecodeReadings(r.Body, r.Header.Get("Content-Type"))
+        if bodyTooLarge(err) {
+            http.Error(w, fmt.Sprintf("Readings exceed the ingest limit of %d bytes", maxIngestBytes), http.StatusRequestEntityTooLarge)
+            log.Println("Dataset exceeds the size limit")
+            return
+        }
+        if err != nil {
+            http.Error(w, "Invalid readings: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid readings:", err)
+            return
+        }
 
-    // Chat endpoint
-    router.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
-        var input struct {
-            Query string `json:"query"`
+        household := householdID(r)
+        report := ingestService.Replace(household, readings)
+        if len(report.Rejected) > 0 {
+            api.WriteError(w, r, http.StatusUnprocessableEntity, api.Code(http.StatusUnprocessableEntity), "Dataset not replaced", report)
+            log.Println("Dataset not replaced:", len(report.Rejected), "readings rejected")
+            return
         }
-        if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+
+        alerts := evaluateGoals(household)
+        for _, alert := range alerts {
+            notificationService.PublishAsync(service.NewEvent(service.EventBudgetAlert, household, alert))
+        }
+        result := map[string]interface{}{"status": "success", "answer": report}
+        if len(alerts) > 0 {
+            result["alerts"] = alerts
+        }
+        jsonResponse(w, result)
+    }).Methods("PUT")
+
+    v1.HandleFunc("/dataset", func(w http.ResponseWriter, r *http.Request) {
+        datasetRepo.Delete(householdID(r))
+        jsonResponse(w, map[string]string{"status": "success", "answer": "dataset deleted"})
+    }).Methods("DELETE")
+
+    v1.HandleFunc("/datasets", func(w http.ResponseWriter, r *http.Request) {
+        if !isAdmin(r) {
+            http.Error(w, "Admin token required", http.StatusUnauthorized)
+            log.Println("Unauthorized dataset list request")
+            return
+        }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": datasetRepo.List()})
+    }).Methods("GET")
+
+    // Carbon emissions endpoint
+    v1.HandleFunc("/analytics/carbon", func(w http.ResponseWriter, r *http.Request) {
+        household := householdID(r)
+        loc, err := requestZone(r, household)
+        if err != nil {
+            http.Error(w, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid time zone:", err)
+            return
+        }
+
+        table, ok := datasetRepo.Get(household)
+        if !ok {
+            http.Error(w, "No data uploaded for this household", http.StatusNotFound)
+            log.Println("No data uploaded for this household")
+            return
+        }
+
+        readings, err := localReadings(household, table, loc)
+        if err != nil {
+            http.Error(w, "Failed to read dataset: "+err.Error(), http.StatusUnprocessableEntity)
+            log.Println("Failed to read dataset:", err)
+            return
+        }
+
+        report := carbonService.Compute(readings, r.URL.Query().Get("bucket"))
+        report.TimeZone = loc.String()
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": report})
+    }).Methods("GET")
+
+    // Period-over-period comparison endpoint
+    v1.HandleFunc("/datasets/compare", func(w http.ResponseWriter, r *http.Request) {
+        household := householdID(r)
+        loc, err := requestZone(r, household)
+        if err != nil {
+            http.Error(w, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid time zone:", err)
+            return
+        }
+
+        table, ok := datasetRepo.Get(household)
+        if !ok {
+            http.Error(w, "No data uploaded for this household", http.StatusNotFound)
+            log.Println("No data uploaded for this household")
+            return
+        }
+
+        readings, err := localReadings(household, table, loc)
+        if err != nil {
+            http.Error(w, "Failed to read dataset: "+err.Error(), http.StatusUnprocessableEntity)
+            log.Println("Failed to read dataset:", err)
+            return
+        }
+
+        params := r.URL.Query()
+        report, err := comparisonService.Compare(readings, params.Get("mode"), params.Get("base"), params.Get("target"))
+        if err != nil {
+            http.Error(w, "Failed to compare periods: "+err.Error(), http.StatusBadRequest)
+            log.Println("Failed to compare periods:", err)
+            return
+        }
+        report.TimeZone = loc.String()
+
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": report})
+    }).Methods("GET")
+
+    // Budget and goal endpoints
+    v1.HandleFunc("/goals", func(w http.ResponseWriter, r *http.Request) {
+        budget, ok := goalService.Repo.GetBudget(householdID(r))
+        if !ok {
+            http.Error(w, "No budget set for this household", http.StatusNotFound)
+            log.Println("No budget set for this household")
+            return
+        }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": budget})
+    }).Methods("GET")
+
+    v1.HandleFunc("/goals", func(w http.ResponseWriter, r *http.Request) {
+        var budget model.Budget
+        if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
             http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
             log.Println("Invalid request:", err)
             return
         }
 
-        log.Println("Chat query:", input.Query)
+        household := householdID(r)
+        if err := goalService.SetBudget(household, budget); err != nil {
+            http.Error(w, "Invalid budget: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid budget:", err)
+            return
+        }
+
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": budget, "alerts": evaluateGoals(household)})
+    }).Methods("PUT")
+
+    v1.HandleFunc("/goals", func(w http.ResponseWriter, r *http.Request) {
+        goalService.Repo.DeleteBudget(householdID(r))
+        jsonResponse(w, map[string]string{"status": "success", "answer": "budget deleted"})
+    }).Methods("DELETE")
 
-        session := getSession(r)
-        context := session.Values["context"]
+    v1.HandleFunc("/goals/alerts", func(w http.ResponseWriter, r *http.Request) {
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": goalService.Repo.GetAlerts(householdID(r))})
+    }).Methods("GET")
 
-        if context == nil {
-            context = ""
+    // Prompt template versions, for comparing answers across versions
+    v1.HandleFunc("/prompts", func(w http.ResponseWriter, r *http.Request) {
+        version, _ := promptService.Resolve("")
+        jsonResponse(w, model.PromptVersions{Versions: promptService.Versions(), Default: version})
+    }).Methods("GET")
+
+    // Model usage per user, household, day, model and endpoint on the days
+    // from "from" to "to", for requests bearing ADMIN_TOKEN
+    v1.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+        if !isAdmin(r) {
+            http.Error(w, "Admin token required", http.StatusUnauthorized)
+            log.Println("Unauthorized usage report request")
+            return
+        }
+        from, to := r.FormValue("from"), r.FormValue("to")
+        for _, day := range []string{from, to} {
+            if _, err := time.Parse("2006-01-02", day); day != "" && err != nil {
+                http.Error(w, "Invalid date: "+day, http.StatusBadRequest)
+                log.Println("Invalid date:", day)
+                return
+            }
         }
+        jsonResponse(w, usageService.Report(from, to))
+    }).Methods("GET")
 
-        response, err := aiService.ChatWithAI(context.(string), input.Query, token, translationService)
+    // Household settings endpoints
+    v1.HandleFunc("/household", func(w http.ResponseWriter, r *http.Request) {
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": householdService.Settings(householdID(r))})
+    }).Methods("GET")
+
+    v1.HandleFunc("/household", func(w http.ResponseWriter, r *http.Request) {
+        var settings model.HouseholdSettings
+        if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+            http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid request:", err)
+            return
+        }
+
+        settings, err := householdService.SetTimeZone(householdID(r), settings.TimeZone)
         if err != nil {
-            http.Error(w, "Failed to get chat response: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to get chat response:", err)
+            http.Error(w, "Invalid settings: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid settings:", err)
             return
         }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": settings})
+    }).Methods("PUT")
 
-        log.Println("Chat response:", response.GeneratedText)
+    // Source unit endpoints
+    v1.HandleFunc("/sources", func(w http.ResponseWriter, r *http.Request) {
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": unitService.Repo.ListUnits(householdID(r))})
+    }).Methods("GET")
 
-        session.Values["context"] = context.(string) + "\n" 
-        if err := session.Save(r, w); err != nil {
-            http.Error(w, "Failed to save session: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to save session:", err)
+    v1.HandleFunc("/sources/{appliance}", func(w http.ResponseWriter, r *http.Request) {
+        var unit model.SourceUnit
+        if err := json.NewDecoder(r.Body).Decode(&unit); err != nil {
+            http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid request:", err)
             return
         }
 
-        w.Header().Set("Content-Type", "application/json")
-        if err := json.NewEncoder(w).Encode(map[string]string{"status": "success", "answer": response.GeneratedText}); err != nil {
-            http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
-            log.Println("Failed to encode response:", err)
+        unit.Appliance = mux.Vars(r)["appliance"]
+        unit, err := unitService.SetUnit(householdID(r), unit)
+        if err != nil {
+            http.Error(w, "Invalid unit: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid unit:", err)
+            return
+        }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": unit})
+    }).Methods("PUT")
+
+    v1.HandleFunc("/sources/{appliance}", func(w http.ResponseWriter, r *http.Request) {
+        if !unitService.Repo.DeleteUnit(householdID(r), mux.Vars(r)["appliance"]) {
+            http.Error(w, "Source not found", http.StatusNotFound)
+            log.Println("Source not found")
+            return
+        }
+        jsonResponse(w, map[string]string{"status": "success", "answer": "source deleted"})
+    }).Methods("DELETE")
+
+    // Notification endpoints. Webhooks belong to the caller's household;
+    // with the admin token they may cover every household.
+    v1.HandleFunc("/notifications/webhooks", func(w http.ResponseWriter, r *http.Request) {
+        var subscription model.WebhookSubscription
+        if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+            http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid request:", err)
+            return
+        }
+        if !isAdmin(r) {
+            household := householdID(r)
+            if subscription.Household != "" && subscription.Household != household {
+                http.Error(w, "Admin token required to subscribe to another household", http.StatusForbidden)
+                log.Println("Rejected subscription to another household")
+                return
+            }
+            subscription.Household = household
+        }
+
+        subscription, err := notificationService.Subscribe(subscription)
+        if err != nil {
+            http.Error(w, "Invalid subscription: "+err.Error(), http.StatusBadRequest)
+            log.Println("Invalid subscription:", err)
             return
         }
+
+        w.Header().Set("Content-Type", "application/json")
+        w.WriteHeader(http.StatusCreated)
+        json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "answer": subscription})
     }).Methods("POST")
 
-    // Enable CORS
-    corsHandler := cors.New(cors.Options{
-        AllowedOrigins: []string{"http://localhost:3000"},
-        AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-        AllowedHeaders: []string{"Content-Type", "Authorization"},
-    }).Handler(router)
+    v1.HandleFunc("/notifications/webhooks", func(w http.ResponseWriter, r *http.Request) {
+        household := householdID(r)
+        if isAdmin(r) {
+            household = ""
+        }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": notificationService.Subscriptions(household)})
+    }).Methods("GET")
 
-    // Start the server
-    port := os.Getenv("PORT")
-    if port == "" {
-        port = "8080"
+    v1.HandleFunc("/notifications/webhooks/{id}", func(w http.ResponseWriter, r *http.Request) {
+        id := mux.Vars(r)["id"]
+        subscription, ok := notificationService.Repo.Subscription(id)
+        if !ok || (!isAdmin(r) && subscription.Household != householdID(r)) || !notificationService.Repo.DeleteSubscription(id) {
+            http.Error(w, "Subscription not found", http.StatusNotFound)
+            log.Println("Subscription not found")
+            return
+        }
+        jsonResponse(w, map[string]string{"status": "success", "answer": "subscription deleted"})
+    }).Methods("DELETE")
+
+    v1.HandleFunc("/notifications/dead-letters", func(w http.ResponseWriter, r *http.Request) {
+        if !isAdmin(r) {
+            http.Error(w, "Admin token required", http.StatusUnauthorized)
+            log.Println("Unauthorized dead-letter request")
+            return
+        }
+        jsonResponse(w, map[string]interface{}{"status": "success", "answer": notificationService.Repo.DeadLetters()})
+    }).Methods("GET")
+
+    // The OpenAPI document of the endpoints above
+    v1.HandleFunc("/openapi.json", api.OpenAPIHandler()).Methods("GET")
+    router.HandleFunc("/openapi.json", api.OpenAPIHandler()).Methods("GET")
+
+    return router
+}
+
+// uploadHandler imports an uploaded file into the household's dataset and
+// asks the table model the query about it.
+func uploadHandler(token string, translationService *service.TranslationService) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+            // Ensure the content type is multipart/form-data
+            if r.Header.Get("Content-Type") == "" || !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+                http.Error(w, "Content-Type header is not multipart/form-data", http.StatusBadRequest)
+                log.Println("Content-Type header is not multipart/form-data")
+                return
+            }
+
+            r.Body = http.MaxBytesReader(w, r.Body, maxUploadBytes)
+            file, header, err := uploadForm(r)
+            if r.MultipartForm != nil {
+                defer r.MultipartForm.RemoveAll()
+            }
+            if err != nil {
+                if bodyTooLarge(err) {
+                    http.Error(w, fmt.Sprintf("File exceeds the upload limit of %d bytes", maxUploadBytes), http.StatusRequestEntityTooLarge)
+                    log.Println("Upload exceeds the size limit")
+                    return
+                }
+                http.Error(w, "Failed to read file: "+err.Error(), http.StatusBadRequest)
+                log.Println("Failed to read file:", err)
+                return
+            }
+            defer file.Close()
+
+            fmt.Println("File name:", header.Filename)
+
+            if !supportedUpload(header.Filename, header.Header.Get("Content-Type")) {
+                http.Error(w, "Unsupported file type: "+header.Filename, http.StatusUnsupportedMediaType)
+                log.Println("Unsupported file type:", header.Filename)
+                return
+            }
+
+            query := r.FormValue("query")
+            if invalid := api.ValidateQuery("query", query); invalid != nil {
+                api.WriteValidationError(w, r, invalid)
+                log.Println("Invalid request:", invalid)
+                return
+            }
+
+            options := model.ImportOptions{
+                Format:    r.FormValue("format"),
+                Sheet:     r.FormValue("sheet"),
+                Delimiter: r.FormValue("delimiter"),
+                Quote:     r.FormValue("quote"),
+                Decimal:   r.FormValue("decimal"),
+                Header:    r.FormValue("header"),
+                Encoding:  r.FormValue("encoding"),
+            }
+
+            household := householdID(r)
+            loc, err := requestZone(r, household)
+            if err != nil {
+                http.Error(w, "Invalid time zone: "+err.Error(), http.StatusBadRequest)
+                log.Println("Invalid time zone:", err)
+                return
+            }
+            options.TimeZone = loc.String()
+
+            version, err := promptVersion(r)
+            if err != nil {
+                http.Error(w, "Invalid prompt version: "+err.Error(), http.StatusBadRequest)
+                log.Println("Invalid prompt version:", err)
+                return
+            }
+
+            ai, translation, err := meteredServices(r, "/upload", translationService)
+            if err != nil {
+                http.Error(w, err.Error(), aiErrorStatus(err, http.StatusInternalServerError))
+                log.Println("Rejected upload:", err)
+                return
+            }
+
+            // The cleaning stage runs when asked for with clean=true or with a
+            // resample interval or fill method.
+            if clean, _ := strconv.ParseBool(r.FormValue("clean")); clean || r.FormValue("interval") != "" || r.FormValue("fill") != "" {
+                options.Cleaning = &model.CleaningOptions{Interval: r.FormValue("interval"), Fill: r.FormValue("fill")}
+                if _, err := service.ParseCleaningOptions(*options.Cleaning); err != nil {
+                    http.Error(w, "Invalid cleaning options: "+err.Error(), http.StatusBadRequest)
+                    log.Println("Invalid cleaning options:", err)
+                    return
+                }
+            }
+
+            // Files larger than streamThreshold are parsed row by row; smaller
+            // ones are read whole so every format and importer is available
+            // and keep their rows; streamed readings are folded into hourly
+            // totals.
+            // Meter samples are only stored with the dataset, so a failed
+            // upload does not move the household's meters on.
+            var table map[string][]string
+            var conversion *model.ConversionReport
+            var normalizer *service.Normalizer
+            content, err := ioutil.ReadAll(io.LimitReader(file, streamThreshold+1))
+            if err == nil && int64(len(content)) > streamThreshold {
+                log.Printf("Streaming file larger than %d bytes\n", streamThreshold)
+                normalizer = unitService.Normalizer(household)
+                table, conversion, err = fileService.StreamFile(io.MultiReader(bytes.NewReader(content), file), options, normalizer)
+            } else if err == nil {
+                log.Printf("File size: %d bytes\n", len(content))
+                table, conversion, err = fileService.ImportFile(string(content), options)
+                if err == nil {
+                    table, normalizer, err = unitService.NormalizeTable(household, table)
+                    if normalizer != nil {
+                        conversion.Normalization = &normalizer.Report
+                    }
+                }
+                if err == nil && options.Cleaning != nil {
+                    clamped := conversion.Cleaning.NegativesClamped
+                    table, conversion.Cleaning, err = service.CleanTable(table, *options.Cleaning, loc)
+                    if conversion.Cleaning != nil {
+                        conversion.Cleaning.NegativesClamped += clamped
+                    }
+                }
+            }
+            if bodyTooLarge(err) {
+                http.Error(w, fmt.Sprintf("File exceeds the upload limit of %d bytes", maxUploadBytes), http.StatusRequestEntityTooLarge)
+                log.Println("Upload exceeds the size limit")
+                return
+            }
+            if err != nil {
+                http.Error(w, "Failed to process file: "+err.Error(), http.StatusInternalServerError)
+                log.Println("Failed to process file:", err)
+                return
+            }
+
+            session := getSession(r)
+            session.Values["query"] = query
+            session.Save(r, w)
+
+            // runAnalysis stores the table and commits the meter samples once
+            // the analysis succeeds.
+            response, alerts, guardReport, err := runAnalysis(ai, household, table, normalizer, query, token, translation)
+            if err != nil {
+                http.Error(w, "Failed to analyze data: "+err.Error(), aiErrorStatus(err, http.StatusInternalServerError))
+                log.Println("Failed to analyze data:", err)
+                return
+            }
+
+            // The table model's answer is checked against the uploaded rows.
+            readings, _ := service.ParseReadings(table)
+            verification := service.VerifyAnswer(query, response, readings)
+
+            summary, recommendations, err := usageSummary(table, version, requestLanguage(r))
+            if err != nil {
+                http.Error(w, "Failed to render summary: "+err.Error(), http.StatusInternalServerError)
+                log.Println("Failed to render summary:", err)
+                return
+            }
+
+            result := model.UploadReply{
+                Status:        "success",
+                Answer:        verification.Answer,
+                Verified:      verification.Verified,
+                Verification:  verification,
+                PromptVersion: version,
+                Alerts:        alerts,
+                Conversion:    conversion,
+            }
+            if summary != "" {
+                result.Summary = summary
+                result.Recommendations = recommendations
+            }
+            if len(guardReport.Quarantined) > 0 || guardReport.Truncated > 0 {
+                result.Guard = &guardReport
+            }
+            jsonResponse(w, result)
     }
-    log.Printf("Server running on port %s\n", port)
-    log.Fatal(http.ListenAndServe(":"+port, corsHandler))
+}
+
+// chatHandler answers a question about the household's dataset or about
+// saving energy.
+func chatHandler(token string, translationService *service.TranslationService) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+            var input model.ChatRequest
+            if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+                http.Error(w, "Invalid request: "+err.Error(), http.StatusBadRequest)
+                log.Println("Invalid request:", err)
+                return
+            }
+            if invalid := api.ValidateChatRequest(input); invalid != nil {
+                api.WriteValidationError(w, r, invalid)
+                log.Println("Invalid request:", invalid)
+                return
+            }
+
+            log.Println("Chat query:", input.Query)
+
+            version, err := promptVersion(r)
+            if err != nil {
+                http.Error(w, "Invalid prompt version: "+err.Error(), http.StatusBadRequest)
+                log.Println("Invalid prompt version:", err)
+                return
+            }
+            metered, translation, err := meteredServices(r, "/chat", translationService)
+            if err != nil {
+                http.Error(w, err.Error(), aiErrorStatus(err, http.StatusInternalServerError))
+                log.Println("Rejected chat:", err)
+                return
+            }
+            ai := metered.WithPromptVersion(version)
+
+            session := getSession(r)
+            context := session.Values["context"]
+
+            if context == nil {
+                context = ""
+            }
+            household := householdID(r)
+            grounding := context.(string) + "\n" + datasetContext(household)
+
+            // With a dataset the rows and summaries most relevant to the query
+            // are added to the prompt and chat models may call analytics tools.
+            // The router sends the query to the backends suited to its class,
+            // falling back along the configured list.
+            request := service.RouteRequest{Query: input.Query, Token: token, Translation: translation}
+            sources := []model.RetrievedDocument{}
+            readings, err := datasetReadings(household)
+            if err == nil {
+                sources = retrievalService.Index(household, readings).Search(input.Query, service.DefaultRetrievalLimit)
+                grounding += "\n" + service.RetrievalContext(sources)
+                request.Readings = readings
+                request.Tools = analyticsTools(household, readings)
+            }
+            request.Context = grounding
+            routed, err := ai.Answer(request)
+            if err != nil {
+                http.Error(w, "Failed to get chat response: "+err.Error(), aiErrorStatus(err, http.StatusInternalServerError))
+                log.Println("Failed to get chat response:", err)
+                return
+            }
+            response := model.ChatResponse{GeneratedText: routed.Answer}
+            log.Println("Chat answered by", routed.Backend, "as", routed.Class)
+
+            log.Println("Chat response:", response.GeneratedText)
+
+            session.Values["context"] = context.(string) + "\n" 
+            if err := session.Save(r, w); err != nil {
+                http.Error(w, "Failed to save session: "+err.Error(), http.StatusInternalServerError)
+                log.Println("Failed to save session:", err)
+                return
+            }
+
+            // Numbers and names in the answer are checked against the dataset.
+            verification := service.VerifyAnswer(input.Query, response.GeneratedText, readings)
+            var citations []string
+            response.GeneratedText, citations = service.Cite(verification.Answer, sources)
+
+            result := model.ChatReply{
+                Status:        "success",
+                Answer:        response.GeneratedText,
+                Verified:      verification.Verified,
+                Verification:  verification,
+                PromptVersion: version,
+                Backend:       routed.Backend,
+                Class:         routed.Class,
+                Attempts:      routed.Attempts,
+                Trace:         routed.Trace,
+            }
+            if len(sources) > 0 {
+                result.Sources = sources
+                result.Citations = citations
+            }
+            w.Header().Set("Content-Type", "application/json")
+            if err := json.NewEncoder(w).Encode(result); err != nil {
+                http.Error(w, "Failed to encode response: "+err.Error(), http.StatusInternalServerError)
+                log.Println("Failed to encode response:", err)
+                return
+            }
+    }
+}
+
+// isAdmin reports whether a request carries ADMIN_TOKEN as a bearer token.
+func isAdmin(r *http.Request) bool {
+    given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return adminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(adminToken)) == 1
 }
 
 func jsonResponse(w http.ResponseWriter, data interface{}) {
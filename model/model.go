@@ -1,5 +1,7 @@
 package model
 
+import "time"
+
 type Inputs struct {
 	Table map[string][]string `json:"table"`
 	Query string              `json:"query"`
@@ -19,3 +21,662 @@ type TapasResponse struct {
 type ChatResponse struct {
 	GeneratedText string `json:"generated_text"`
 }
+
+// Reading is one typed row of the energy CSV
+// (Date, Time, Appliance, Energy_Consumption, Room, Status). Date and Time are
+// wall clock time in the household's time zone; Timestamp is the instant they
+// denote, zero until it is known.
+type Reading struct {
+	Date              string    `json:"date"`
+	Time              string    `json:"time"`
+	Appliance         string    `json:"appliance"`
+	EnergyConsumption float64   `json:"energy_consumption"`
+	Room              string    `json:"room"`
+	Status            string    `json:"status"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+type EmissionEntry struct {
+	Key         string  `json:"key"`
+	EnergyKWh   float64 `json:"energy_kwh"`
+	EmissionsKg float64 `json:"emissions_kg"`
+}
+
+type CarbonReport struct {
+	Method           string          `json:"method"`
+	TimeZone         string          `json:"time_zone,omitempty"`
+	Bucket           string          `json:"bucket"`
+	TotalEnergyKWh   float64         `json:"total_energy_kwh"`
+	TotalEmissionsKg float64         `json:"total_emissions_kg"`
+	ByAppliance      []EmissionEntry `json:"by_appliance"`
+	ByRoom           []EmissionEntry `json:"by_room"`
+	ByBucket         []EmissionEntry `json:"by_bucket"`
+}
+
+type ChangeEntry struct {
+	Key           string   `json:"key"`
+	Base          float64  `json:"base_kwh"`
+	Target        float64  `json:"target_kwh"`
+	Change        float64  `json:"change_kwh"`
+	ChangePercent *float64 `json:"change_percent"`
+}
+
+type ComparisonReport struct {
+	Mode          string        `json:"mode"`
+	TimeZone      string        `json:"time_zone,omitempty"`
+	BasePeriod    string        `json:"base_period"`
+	TargetPeriod  string        `json:"target_period"`
+	Total         ChangeEntry   `json:"total"`
+	ByAppliance   []ChangeEntry `json:"by_appliance"`
+	ByRoom        []ChangeEntry `json:"by_room"`
+	BiggestMovers []ChangeEntry `json:"biggest_movers"`
+}
+
+// Budget holds a household's monthly goals. Cost budgets need PricePerKWh.
+type Budget struct {
+	MonthlyKWh    float64            `json:"monthly_kwh,omitempty"`
+	MonthlyCost   float64            `json:"monthly_cost,omitempty"`
+	PricePerKWh   float64            `json:"price_per_kwh,omitempty"`
+	ApplianceCaps map[string]float64 `json:"appliance_caps_kwh,omitempty"`
+}
+
+type BudgetAlert struct {
+	Household        string  `json:"household"`
+	Kind             string  `json:"kind"`
+	Appliance        string  `json:"appliance,omitempty"`
+	Month            string  `json:"month"`
+	Severity         string  `json:"severity"`
+	Limit            float64 `json:"limit"`
+	Used             float64 `json:"used"`
+	Projected        float64 `json:"projected"`
+	ProjectedOverrun float64 `json:"projected_overrun"`
+}
+
+type NotificationEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Household string      `json:"household"`
+	Time      time.Time   `json:"time"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookSubscription receives events of the listed types, or of every type
+// when Events is empty. An empty Household subscribes to all households.
+// Secret signs deliveries; it is only returned when the subscription is
+// created.
+type WebhookSubscription struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Secret    string   `json:"secret,omitempty"`
+	Events    []string `json:"events,omitempty"`
+	Household string   `json:"household,omitempty"`
+}
+
+type DeadLetter struct {
+	Event    NotificationEvent `json:"event"`
+	Target   string            `json:"target"`
+	Attempts int               `json:"attempts"`
+	Error    string            `json:"error"`
+	Time     time.Time         `json:"time"`
+}
+
+type IngestError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type IngestReport struct {
+	Received   int           `json:"received"`
+	Accepted   int           `json:"accepted"`
+	Duplicates int           `json:"duplicates"`
+	Rejected   []IngestError `json:"rejected,omitempty"`
+	// Normalization is set when readings were converted from a source unit
+	// other than kWh per interval.
+	Normalization *NormalizationReport `json:"normalization,omitempty"`
+}
+
+// DatasetSummary is the size of a household's stored dataset.
+type DatasetSummary struct {
+	Household string `json:"household"`
+	Rows      int    `json:"rows"`
+}
+
+// MQTTMapping maps an MQTT payload to a reading. Each field is a dotted JSON
+// path ("ENERGY.Power", "readings.0.kwh"), "$topic.N" for the Nth topic
+// segment or "=value" for a constant. Timestamp, when found, takes precedence
+// over Date and Time; readings without either are stamped on arrival.
+type MQTTMapping struct {
+	Household string `json:"household"`
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+	Timestamp string `json:"timestamp"`
+	Appliance string `json:"appliance"`
+	Energy    string `json:"energy_consumption"`
+	Room      string `json:"room"`
+	Status    string `json:"status"`
+}
+
+// ConversionReport describes how an upload was read and converted.
+type ConversionReport struct {
+	Format        string      `json:"format"`
+	RowsRead      int         `json:"rows_read"`
+	RowsConverted int         `json:"rows_converted"`
+	RowsSkipped   int         `json:"rows_skipped"`
+	Warnings      []string    `json:"warnings,omitempty"`
+	Dialect       *CSVDialect `json:"dialect,omitempty"`
+	// AggregatedRows is set when a streamed energy file was folded into
+	// hourly readings, or shorter resample intervals, and holds the number of
+	// readings kept.
+	AggregatedRows int                  `json:"aggregated_rows,omitempty"`
+	Normalization  *NormalizationReport `json:"normalization,omitempty"`
+	Cleaning       *CleaningReport      `json:"cleaning,omitempty"`
+}
+
+// EntityMapping names the appliance and room of a Home Assistant entity.
+// Unit is the unit of its states: kWh or Wh for cumulative energy sensors, W
+// or kW for power sensors. When empty it is W for entity IDs that contain
+// "power" and kWh otherwise.
+type EntityMapping struct {
+	Appliance string `json:"appliance"`
+	Room      string `json:"room"`
+	Unit      string `json:"unit,omitempty"`
+}
+
+// HomeAssistantMapping maps Home Assistant entity IDs to appliances and rooms.
+// Entities that are not listed get an appliance name derived from the ID.
+type HomeAssistantMapping struct {
+	Entities    map[string]EntityMapping `json:"entities"`
+	DefaultRoom string                   `json:"default_room"`
+}
+
+// GreenButtonMapping names the appliance and room that utility meter
+// intervals are attributed to.
+type GreenButtonMapping struct {
+	Appliance string `json:"appliance"`
+	Room      string `json:"room"`
+}
+
+type ImportMapping struct {
+	HomeAssistant HomeAssistantMapping `json:"home_assistant"`
+	GreenButton   GreenButtonMapping   `json:"green_button"`
+}
+
+// ImportOptions are the optional overrides accepted with an upload. Empty
+// fields are detected from the content. Header is "true", "false" or empty.
+// TimeZone is the IANA zone of the file's wall clock times, UTC when empty.
+// Cleaning, when set, enables the cleaning stage.
+type ImportOptions struct {
+	Format    string           `json:"format,omitempty"`
+	Sheet     string           `json:"sheet,omitempty"`
+	Delimiter string           `json:"delimiter,omitempty"`
+	Quote     string           `json:"quote,omitempty"`
+	Decimal   string           `json:"decimal,omitempty"`
+	Header    string           `json:"header,omitempty"`
+	Encoding  string           `json:"encoding,omitempty"`
+	TimeZone  string           `json:"time_zone,omitempty"`
+	Cleaning  *CleaningOptions `json:"cleaning,omitempty"`
+}
+
+// CSVDialect describes how a delimited text file was read.
+type CSVDialect struct {
+	Delimiter string `json:"delimiter"`
+	Quote     string `json:"quote"`
+	Decimal   string `json:"decimal"`
+	Header    bool   `json:"header"`
+	Encoding  string `json:"encoding"`
+}
+
+// SourceUnit describes what a source's Energy_Consumption values measure.
+// Unit is kWh, Wh, W or kW; W and kW are instantaneous power samples.
+// Cumulative marks kWh or Wh meter readings that grow until the counter
+// resets.
+type SourceUnit struct {
+	Appliance  string `json:"appliance"`
+	Unit       string `json:"unit"`
+	Cumulative bool   `json:"cumulative"`
+}
+
+// MeterSample is the last raw value seen from a cumulative or power source.
+type MeterSample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// NormalizationReport describes how readings were converted to kWh per
+// interval. Readings that only start a series get zero energy; Dropped counts
+// samples older than the last one seen from their source.
+type NormalizationReport struct {
+	Scaled        int      `json:"scaled"`
+	Differenced   int      `json:"differenced"`
+	Integrated    int      `json:"integrated"`
+	CounterResets int      `json:"counter_resets"`
+	Gaps          int      `json:"gaps"`
+	Dropped       int      `json:"dropped"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// HouseholdSettings holds a household's preferences. TimeZone is an IANA
+// name such as "Europe/Berlin".
+type HouseholdSettings struct {
+	TimeZone string `json:"time_zone"`
+}
+
+// CleaningOptions configure the cleaning stage. Interval is a duration such
+// as "15m" or "1h" that divides a day; readings are resampled to it when set.
+// Fill is how missing intervals are filled: "none", "zero", "forward" or
+// "interpolate", and needs an Interval.
+type CleaningOptions struct {
+	Interval string `json:"interval,omitempty"`
+	Fill     string `json:"fill,omitempty"`
+}
+
+// CleaningReport says what the cleaning stage changed.
+type CleaningReport struct {
+	RowsIn            int    `json:"rows_in"`
+	RowsOut           int    `json:"rows_out"`
+	Reordered         bool   `json:"reordered"`
+	DuplicatesRemoved int    `json:"duplicates_removed"`
+	NegativesClamped  int    `json:"negatives_clamped"`
+	Resampled         int    `json:"resampled"`
+	GapsFilled        int    `json:"gaps_filled"`
+	Interval          string `json:"interval,omitempty"`
+	Fill              string `json:"fill,omitempty"`
+}
+
+// QueryFilter restricts a Query to readings whose Column compares to Value.
+// Op is eq, ne, in, contains, gt, gte, lt or lte; "in" takes a list.
+type QueryFilter struct {
+	Column string      `json:"column"`
+	Op     string      `json:"op"`
+	Value  interface{} `json:"value"`
+}
+
+// QueryWindow restricts a Query in time. Start and End are inclusive dates
+// (YYYY-MM-DD); From and To are times of day (HH:MM), From inclusive and To
+// exclusive, wrapping past midnight when To is earlier. Days is "weekdays" or
+// "weekends".
+type QueryWindow struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+	Days  string `json:"days,omitempty"`
+}
+
+// Query is the structured form of a question about a dataset. Aggregate is
+// applied to Energy_Consumption per group: sum, avg, min, max, count or
+// daily_avg (the sum divided by the number of days with readings).
+type Query struct {
+	Filters   []QueryFilter `json:"filters,omitempty"`
+	Window    *QueryWindow  `json:"window,omitempty"`
+	GroupBy   []string      `json:"group_by,omitempty"`
+	Aggregate string        `json:"aggregate"`
+	OrderBy   string        `json:"order_by,omitempty"`
+	Limit     int           `json:"limit,omitempty"`
+}
+
+type QueryRow struct {
+	Group map[string]string `json:"group,omitempty"`
+	Value float64           `json:"value"`
+	Count int               `json:"count"`
+}
+
+// QueryResult is the outcome of running a Query, which it repeats.
+type QueryResult struct {
+	Query   Query      `json:"query"`
+	Rows    []QueryRow `json:"rows"`
+	Matched int        `json:"matched"`
+	Unit    string     `json:"unit"`
+}
+
+// ChatMessage is a message in the OpenAI-compatible chat-completions format.
+// Assistant messages may request ToolCalls; tool messages answer one by
+// ToolCallID.
+type ChatMessage struct {
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+	Name       string     `json:"name,omitempty"`
+}
+
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolFunctionCall `json:"function"`
+}
+
+// ToolFunctionCall names the function to run. Arguments is a JSON object
+// encoded as a string.
+type ToolFunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Tool advertises a function the model may call. Parameters is a JSON
+// Schema object.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+// ToolTrace records one tool call made while answering a chat message.
+type ToolTrace struct {
+	Iteration int         `json:"iteration"`
+	ID        string      `json:"id"`
+	Name      string      `json:"name"`
+	Arguments string      `json:"arguments"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Anomaly is a reading far above its appliance's usual consumption.
+type Anomaly struct {
+	Date      string  `json:"date"`
+	Time      string  `json:"time"`
+	Appliance string  `json:"appliance"`
+	Room      string  `json:"room"`
+	EnergyKWh float64 `json:"energy_kwh"`
+	MeanKWh   float64 `json:"mean_kwh"`
+	Score     float64 `json:"score"`
+}
+
+type HourTotal struct {
+	Hour      int     `json:"hour"`
+	EnergyKWh float64 `json:"energy_kwh"`
+}
+
+type CostEntry struct {
+	Key       string  `json:"key"`
+	EnergyKWh float64 `json:"energy_kwh"`
+	Cost      float64 `json:"cost"`
+}
+
+type CostReport struct {
+	PricePerKWh float64     `json:"price_per_kwh"`
+	TotalKWh    float64     `json:"total_kwh"`
+	TotalCost   float64     `json:"total_cost"`
+	ByAppliance []CostEntry `json:"by_appliance"`
+}
+
+// Forecast projects consumption over the coming days from the average of the
+// most recent days. TrendKWhPerDay is the least-squares slope of those days.
+type Forecast struct {
+	Days            int     `json:"days"`
+	BasedOnDays     int     `json:"based_on_days"`
+	AverageDailyKWh float64 `json:"average_daily_kwh"`
+	TrendKWhPerDay  float64 `json:"trend_kwh_per_day"`
+	TotalKWh        float64 `json:"total_kwh"`
+}
+
+// RetrievedDocument is a dataset row or computed summary retrieved for a chat
+// turn. Row IDs are "row-N", N counting the household's dataset rows from 1.
+type RetrievedDocument struct {
+	ID    string  `json:"id"`
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// Claim is a statement pulled out of a model answer and checked against the
+// analytics computed from the dataset. Status is confirmed or contradicted;
+// Actual is the computed value the claim matched, or the one it should have.
+type Claim struct {
+	Text      string `json:"text"`
+	Kind      string `json:"kind"`
+	Subject   string `json:"subject,omitempty"`
+	Stated    string `json:"stated"`
+	Actual    string `json:"actual"`
+	Status    string `json:"status"`
+	Corrected bool   `json:"corrected,omitempty"`
+}
+
+// Verification is the outcome of checking an answer. Verified is true when at
+// least one claim was confirmed and none contradicted; Answer is the answer
+// with the contradictions that could be corrected corrected.
+type Verification struct {
+	Verified bool    `json:"verified"`
+	Answer   string  `json:"answer"`
+	Claims   []Claim `json:"claims"`
+}
+
+// QuarantinedCell is a table cell withheld from model payloads because it
+// looked like instructions to the model. Row counts from 1; row 0 is the
+// header.
+type QuarantinedCell struct {
+	Column string `json:"column"`
+	Row    int    `json:"row"`
+	Reason string `json:"reason"`
+}
+
+// GuardReport lists what the prompt guard changed in a table.
+type GuardReport struct {
+	Quarantined []QuarantinedCell `json:"quarantined,omitempty"`
+	Truncated   int               `json:"truncated,omitempty"`
+}
+
+// UsageSummary is the data of the upload summary prompt template.
+type UsageSummary struct {
+	Least    string  `json:"least"`
+	Most     string  `json:"most"`
+	LeastKWh float64 `json:"least_kwh"`
+	MostKWh  float64 `json:"most_kwh"`
+	TotalKWh float64 `json:"total_kwh"`
+}
+
+// Recommendation is the data of the recommendation prompt template. Share is
+// the appliance's percentage of the total; PeakHour is -1 when unknown.
+type Recommendation struct {
+	Appliance string  `json:"appliance"`
+	EnergyKWh float64 `json:"energy_kwh"`
+	Share     float64 `json:"share"`
+	PeakHour  int     `json:"peak_hour"`
+}
+
+// EvalCase is one question of an evaluation suite. Kind picks the score that
+// decides whether the case passes: exact, numeric or appliance. Mode is table
+// for the table QA model and chat for the chat model. Query is the
+// structured form of the question, answered by the analytics provider.
+type EvalCase struct {
+	ID        string  `json:"id"`
+	Dataset   string  `json:"dataset"`
+	Question  string  `json:"question"`
+	Expected  string  `json:"expected"`
+	Kind      string  `json:"kind"`
+	Mode      string  `json:"mode,omitempty"`
+	Tolerance float64 `json:"tolerance,omitempty"`
+	Query     *Query  `json:"query,omitempty"`
+}
+
+type EvalSuite struct {
+	Name  string     `json:"name"`
+	Cases []EvalCase `json:"cases"`
+}
+
+// EvalResult is the outcome of one case. Numeric and Appliance are nil when
+// the expected answer is not a number or an appliance of the dataset.
+type EvalResult struct {
+	ID         string `json:"id"`
+	Question   string `json:"question"`
+	Expected   string `json:"expected"`
+	Answer     string `json:"answer"`
+	Error      string `json:"error,omitempty"`
+	ExactMatch bool   `json:"exact_match"`
+	Numeric    *bool  `json:"numeric,omitempty"`
+	Appliance  *bool  `json:"appliance,omitempty"`
+	Passed     bool   `json:"passed"`
+}
+
+// EvalReport summarizes a run. Each accuracy is over the cases the score
+// applies to.
+type EvalReport struct {
+	Suite             string       `json:"suite"`
+	Provider          string       `json:"provider"`
+	Cases             int          `json:"cases"`
+	Passed            int          `json:"passed"`
+	Errors            int          `json:"errors"`
+	ExactMatchRate    float64      `json:"exact_match_rate"`
+	NumericAccuracy   float64      `json:"numeric_accuracy"`
+	ApplianceAccuracy float64      `json:"appliance_accuracy"`
+	Results           []EvalResult `json:"results"`
+}
+
+// RouteAttempt is one backend tried for a query, with the error that made
+// the router move on.
+type RouteAttempt struct {
+	Backend   string `json:"backend"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+}
+
+// RoutedAnswer is the answer of the first backend that succeeded for a query
+// of Class, after the Attempts before it.
+type RoutedAnswer struct {
+	Answer   string         `json:"answer"`
+	Class    string         `json:"class"`
+	Backend  string         `json:"backend"`
+	Attempts []RouteAttempt `json:"attempts"`
+	Trace    []ToolTrace    `json:"trace,omitempty"`
+}
+
+// UsageScope attributes model calls to the user, household and endpoint of
+// the request that made them.
+type UsageScope struct {
+	User      string `json:"user"`
+	Household string `json:"household"`
+	Endpoint  string `json:"endpoint"`
+}
+
+// UsageRecord is one model call. Token counts come from the response's usage
+// field; Estimated is set when they were estimated from the text instead.
+type UsageRecord struct {
+	UsageScope
+	Time         time.Time `json:"time"`
+	Day          string    `json:"day"`
+	Model        string    `json:"model"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	Estimated    bool      `json:"estimated"`
+	LatencyMS    int64     `json:"latency_ms"`
+	Cost         float64   `json:"cost"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// UsageTotal sums the model calls of one user, household, day, model or
+// endpoint.
+type UsageTotal struct {
+	Key          string  `json:"key"`
+	Requests     int     `json:"requests"`
+	Errors       int     `json:"errors"`
+	InputTokens  int     `json:"input_tokens"`
+	OutputTokens int     `json:"output_tokens"`
+	Cost         float64 `json:"cost"`
+	AvgLatencyMS int64   `json:"avg_latency_ms"`
+}
+
+// UsageReport aggregates the model calls made on the days from From to To.
+type UsageReport struct {
+	From        string       `json:"from,omitempty"`
+	To          string       `json:"to,omitempty"`
+	Total       UsageTotal   `json:"total"`
+	ByUser      []UsageTotal `json:"by_user"`
+	ByHousehold []UsageTotal `json:"by_household"`
+	ByDay       []UsageTotal `json:"by_day"`
+	ByModel     []UsageTotal `json:"by_model"`
+	ByEndpoint  []UsageTotal `json:"by_endpoint"`
+}
+
+// ModelPrice is what a model costs per thousand input and output tokens.
+type ModelPrice struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// UsageQuota caps the tokens and cost of a user or household per day. Zero
+// means no cap.
+type UsageQuota struct {
+	Tokens int     `json:"tokens,omitempty"`
+	Cost   float64 `json:"cost,omitempty"`
+}
+
+// APIError is the body of every /api/v1 error response, wrapped as
+// {"error": ...}. Details holds field errors for invalid requests and the
+// underlying cause for other errors.
+type APIError struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+type ErrorEnvelope struct {
+	Error APIError `json:"error"`
+}
+
+// FieldError is a request field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+type ChatRequest struct {
+	Query string `json:"query"`
+}
+
+// ChatReply is the /chat response. Sources and Citations are set when the
+// household has a dataset, Trace when a chat model called tools.
+type ChatReply struct {
+	Status        string              `json:"status"`
+	Answer        string              `json:"answer"`
+	Verified      bool                `json:"verified"`
+	Verification  Verification        `json:"verification"`
+	PromptVersion string              `json:"prompt_version"`
+	Backend       string              `json:"backend"`
+	Class         string              `json:"class"`
+	Attempts      []RouteAttempt      `json:"attempts"`
+	Sources       []RetrievedDocument `json:"sources,omitempty"`
+	Citations     []string            `json:"citations,omitempty"`
+	Trace         []ToolTrace         `json:"trace,omitempty"`
+}
+
+// UploadReply is the /upload response. Guard is set when cells were withheld
+// from the table model.
+type UploadReply struct {
+	Status          string            `json:"status"`
+	Answer          string            `json:"answer"`
+	Verified        bool              `json:"verified"`
+	Verification    Verification      `json:"verification"`
+	PromptVersion   string            `json:"prompt_version"`
+	Summary         string            `json:"summary,omitempty"`
+	Recommendations []string          `json:"recommendations,omitempty"`
+	Alerts          []BudgetAlert     `json:"alerts,omitempty"`
+	Guard           *GuardReport      `json:"guard,omitempty"`
+	Conversion      *ConversionReport `json:"conversion"`
+}
+
+// QueryRequest asks a question in Query or sends the structured query
+// itself.
+type QueryRequest struct {
+	Query      string `json:"query"`
+	Structured *Query `json:"structured"`
+}
+
+type QueryReply struct {
+	Status        string      `json:"status"`
+	Answer        string      `json:"answer"`
+	Query         Query       `json:"query"`
+	Result        QueryResult `json:"result"`
+	PromptVersion string      `json:"prompt_version"`
+}
+
+// PromptVersions lists the prompt template versions and the one used when a
+// request names none.
+type PromptVersions struct {
+	Versions []string `json:"versions"`
+	Default  string   `json:"default"`
+}
@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// DatasetRepository keeps the uploaded tables of every household in memory so
+// analytics and chat can work on data uploaded in earlier requests.
+type DatasetRepository struct {
+	mu       sync.RWMutex
+	datasets map[string]map[string][]string
+}
+
+func NewDatasetRepository() *DatasetRepository {
+	return &DatasetRepository{datasets: make(map[string]map[string][]string)}
+}
+
+// Append adds the rows of table to the household's dataset. Columns missing
+// on either side are padded with empty values so all columns stay aligned.
+func (r *DatasetRepository) Append(household string, table map[string][]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.appendLocked(household, table)
+}
+
+func (r *DatasetRepository) appendLocked(household string, table map[string][]string) {
+	existing, ok := r.datasets[household]
+	if !ok {
+		existing = make(map[string][]string)
+		r.datasets[household] = existing
+	}
+
+	oldRows := rowCount(existing)
+	newRows := rowCount(table)
+	for column := range table {
+		if _, ok := existing[column]; !ok {
+			existing[column] = make([]string, oldRows)
+		}
+	}
+	for column, values := range existing {
+		added, ok := table[column]
+		if !ok {
+			added = make([]string, newRows)
+		}
+		existing[column] = append(values, added...)
+	}
+}
+
+// AppendUnique appends only the rows of table whose values in keyColumns do
+// not already occur in the household's dataset or earlier in table. It
+// returns the number of rows added.
+func (r *DatasetRepository) AppendUnique(household string, table map[string][]string, keyColumns []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.appendUniqueLocked(household, table, keyColumns)
+}
+
+// Replace replaces the household's dataset with the rows of table, keeping
+// the first of the rows with the same values in keyColumns. It returns the
+// number of rows stored.
+func (r *DatasetRepository) Replace(household string, table map[string][]string, keyColumns []string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.datasets, household)
+	return r.appendUniqueLocked(household, table, keyColumns)
+}
+
+func (r *DatasetRepository) appendUniqueLocked(household string, table map[string][]string, keyColumns []string) int {
+	existing := r.datasets[household]
+	seen := make(map[string]bool)
+	for i := 0; i < rowCount(existing); i++ {
+		seen[rowKey(existing, keyColumns, i)] = true
+	}
+
+	unique := make(map[string][]string, len(table))
+	for column := range table {
+		unique[column] = []string{}
+	}
+	for i := 0; i < rowCount(table); i++ {
+		key := rowKey(table, keyColumns, i)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		for column, values := range table {
+			unique[column] = append(unique[column], values[i])
+		}
+	}
+
+	added := rowCount(unique)
+	if added > 0 {
+		r.appendLocked(household, unique)
+	}
+	return added
+}
+
+// Get returns a copy of the household's dataset.
+func (r *DatasetRepository) Get(household string) (map[string][]string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	dataset, ok := r.datasets[household]
+	if !ok {
+		return nil, false
+	}
+	copied := make(map[string][]string, len(dataset))
+	for column, values := range dataset {
+		copied[column] = append([]string(nil), values...)
+	}
+	return copied, true
+}
+
+// List returns the number of rows in every household's dataset, ordered by
+// household.
+func (r *DatasetRepository) List() []model.DatasetSummary {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	summaries := make([]model.DatasetSummary, 0, len(r.datasets))
+	for household, dataset := range r.datasets {
+		summaries = append(summaries, model.DatasetSummary{Household: household, Rows: rowCount(dataset)})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Household < summaries[j].Household
+	})
+	return summaries
+}
+
+// Delete removes the household's dataset.
+func (r *DatasetRepository) Delete(household string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.datasets, household)
+}
+
+func rowKey(table map[string][]string, keyColumns []string, row int) string {
+	parts := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		if values, ok := table[column]; ok && row < len(values) {
+			parts[i] = values[row]
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func rowCount(table map[string][]string) int {
+	for _, values := range table {
+		return len(values)
+	}
+	return 0
+}
@@ -0,0 +1,58 @@
+package repository
+
+import (
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// GoalRepository keeps household budgets and their latest alerts in memory.
+type GoalRepository struct {
+	mu      sync.RWMutex
+	budgets map[string]model.Budget
+	alerts  map[string][]model.BudgetAlert
+}
+
+func NewGoalRepository() *GoalRepository {
+	return &GoalRepository{
+		budgets: make(map[string]model.Budget),
+		alerts:  make(map[string][]model.BudgetAlert),
+	}
+}
+
+// SaveBudget replaces the household's budget.
+func (r *GoalRepository) SaveBudget(household string, budget model.Budget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.budgets[household] = budget
+}
+
+// GetBudget returns the household's budget, if one was set.
+func (r *GoalRepository) GetBudget(household string) (model.Budget, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	budget, ok := r.budgets[household]
+	return budget, ok
+}
+
+// DeleteBudget removes the household's budget and its alerts.
+func (r *GoalRepository) DeleteBudget(household string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.budgets, household)
+	delete(r.alerts, household)
+}
+
+// SaveAlerts replaces the alerts from the household's latest evaluation.
+func (r *GoalRepository) SaveAlerts(household string, alerts []model.BudgetAlert) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.alerts[household] = alerts
+}
+
+// GetAlerts returns the alerts from the household's latest evaluation.
+func (r *GoalRepository) GetAlerts(household string) []model.BudgetAlert {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]model.BudgetAlert(nil), r.alerts[household]...)
+}
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// HouseholdRepository keeps household settings in memory.
+type HouseholdRepository struct {
+	mu       sync.RWMutex
+	settings map[string]model.HouseholdSettings
+}
+
+func NewHouseholdRepository() *HouseholdRepository {
+	return &HouseholdRepository{settings: make(map[string]model.HouseholdSettings)}
+}
+
+// SaveSettings replaces the household's settings.
+func (r *HouseholdRepository) SaveSettings(household string, settings model.HouseholdSettings) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.settings[household] = settings
+}
+
+// GetSettings returns the household's settings, if any were saved.
+func (r *HouseholdRepository) GetSettings(household string) (model.HouseholdSettings, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	settings, ok := r.settings[household]
+	return settings, ok
+}
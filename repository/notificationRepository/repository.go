@@ -0,0 +1,78 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// MaxDeadLetters caps the dead-letter log; the oldest letters are dropped
+// first.
+const MaxDeadLetters = 1000
+
+// NotificationRepository keeps webhook subscriptions and the dead-letter log
+// of deliveries that failed after all retries.
+type NotificationRepository struct {
+	mu            sync.RWMutex
+	subscriptions map[string]model.WebhookSubscription
+	deadLetters   []model.DeadLetter
+}
+
+func NewNotificationRepository() *NotificationRepository {
+	return &NotificationRepository{subscriptions: make(map[string]model.WebhookSubscription)}
+}
+
+// SaveSubscription adds or replaces a subscription by ID.
+func (r *NotificationRepository) SaveSubscription(subscription model.WebhookSubscription) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions[subscription.ID] = subscription
+}
+
+// Subscription returns the subscription with the given ID.
+func (r *NotificationRepository) Subscription(id string) (model.WebhookSubscription, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	subscription, ok := r.subscriptions[id]
+	return subscription, ok
+}
+
+// DeleteSubscription removes a subscription and reports whether it existed.
+func (r *NotificationRepository) DeleteSubscription(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.subscriptions[id]
+	delete(r.subscriptions, id)
+	return ok
+}
+
+// ListSubscriptions returns all subscriptions ordered by ID.
+func (r *NotificationRepository) ListSubscriptions() []model.WebhookSubscription {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make([]model.WebhookSubscription, 0, len(r.subscriptions))
+	for _, subscription := range r.subscriptions {
+		result = append(result, subscription)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// AddDeadLetter records a delivery that could not be completed, dropping the
+// oldest letter when the log holds MaxDeadLetters.
+func (r *NotificationRepository) AddDeadLetter(letter model.DeadLetter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.deadLetters) >= MaxDeadLetters {
+		r.deadLetters = append(r.deadLetters[:0], r.deadLetters[len(r.deadLetters)-MaxDeadLetters+1:]...)
+	}
+	r.deadLetters = append(r.deadLetters, letter)
+}
+
+// DeadLetters returns the dead-letter log, oldest first.
+func (r *NotificationRepository) DeadLetters() []model.DeadLetter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]model.DeadLetter(nil), r.deadLetters...)
+}
@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// SourceRepository keeps per-household unit metadata for each source and the
+// last raw sample seen from cumulative and power sources.
+type SourceRepository struct {
+	mu      sync.RWMutex
+	units   map[string]map[string]model.SourceUnit
+	samples map[string]map[string]model.MeterSample
+}
+
+func NewSourceRepository() *SourceRepository {
+	return &SourceRepository{
+		units:   make(map[string]map[string]model.SourceUnit),
+		samples: make(map[string]map[string]model.MeterSample),
+	}
+}
+
+// SaveUnit adds or replaces a source's unit and forgets its samples, which
+// were recorded in the old unit.
+func (r *SourceRepository) SaveUnit(household string, unit model.SourceUnit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.units[household] == nil {
+		r.units[household] = make(map[string]model.SourceUnit)
+	}
+	r.units[household][unit.Appliance] = unit
+	r.deleteSamplesLocked(household, unit.Appliance)
+}
+
+// DeleteUnit removes a source's unit and samples and reports whether the
+// unit existed.
+func (r *SourceRepository) DeleteUnit(household, appliance string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.units[household][appliance]
+	delete(r.units[household], appliance)
+	r.deleteSamplesLocked(household, appliance)
+	return ok
+}
+
+// Units returns a copy of the household's units keyed by appliance.
+func (r *SourceRepository) Units(household string) map[string]model.SourceUnit {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	units := make(map[string]model.SourceUnit, len(r.units[household]))
+	for appliance, unit := range r.units[household] {
+		units[appliance] = unit
+	}
+	return units
+}
+
+// ListUnits returns the household's units ordered by appliance.
+func (r *SourceRepository) ListUnits(household string) []model.SourceUnit {
+	units := make([]model.SourceUnit, 0)
+	for _, unit := range r.Units(household) {
+		units = append(units, unit)
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].Appliance < units[j].Appliance })
+	return units
+}
+
+// Samples returns a copy of the household's last samples keyed by
+// SampleKey.
+func (r *SourceRepository) Samples(household string) map[string]model.MeterSample {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	samples := make(map[string]model.MeterSample, len(r.samples[household]))
+	for key, sample := range r.samples[household] {
+		samples[key] = sample
+	}
+	return samples
+}
+
+// SaveSamples records newer last samples for the household's sources.
+// Samples older than the stored ones are ignored.
+func (r *SourceRepository) SaveSamples(household string, samples map[string]model.MeterSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.samples[household] == nil {
+		r.samples[household] = make(map[string]model.MeterSample)
+	}
+	for key, sample := range samples {
+		if stored, ok := r.samples[household][key]; ok && !sample.Time.After(stored.Time) {
+			continue
+		}
+		r.samples[household][key] = sample
+	}
+}
+
+// SampleKey identifies one meter: an appliance in a room.
+func SampleKey(appliance, room string) string {
+	return appliance + "\x00" + room
+}
+
+func (r *SourceRepository) deleteSamplesLocked(household, appliance string) {
+	for key := range r.samples[household] {
+		if strings.HasPrefix(key, appliance+"\x00") {
+			delete(r.samples[household], key)
+		}
+	}
+}
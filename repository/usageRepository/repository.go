@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// UsageRepository keeps the log of model calls, oldest first.
+type UsageRepository struct {
+	mu      sync.RWMutex
+	records []model.UsageRecord
+}
+
+func NewUsageRepository() *UsageRepository {
+	return &UsageRepository{}
+}
+
+// Add appends a record to the log.
+func (r *UsageRepository) Add(record model.UsageRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+}
+
+// List returns the records of the days from from to to, inclusive, oldest
+// first. Empty bounds are open.
+func (r *UsageRepository) List(from, to string) []model.UsageRecord {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var result []model.UsageRecord
+	for _, record := range r.records {
+		if (from == "" || record.Day >= from) && (to == "" || record.Day <= to) {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// Prune drops the records of the days before before and returns how many
+// were dropped.
+func (r *UsageRepository) Prune(before string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(r.records) && r.records[n].Day < before {
+		n++
+	}
+	if n > 0 {
+		r.records = append([]model.UsageRecord(nil), r.records[n:]...)
+	}
+	return n
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 ) 
 
 type HTTPClient interface { 
@@ -15,60 +17,178 @@ type HTTPClient interface {
 } 
 type AIService struct { 
     Client HTTPClient 
+    // MaxToolIterations caps the rounds of tool calls in RunTools; zero
+    // means DefaultMaxToolIterations.
+    MaxToolIterations int
+    // Guard screens queries, grounding data and answers; nil means a
+    // PromptGuard with the default settings.
+    Guard *PromptGuard
+    // Prompts supplies the system prompts, rendered at PromptVersion; nil
+    // means the built-in templates and an empty version their default.
+    Prompts       *PromptService
+    PromptVersion string
+    // Endpoint is the base URL of the inference API; empty means
+    // DefaultInferenceEndpoint.
+    Endpoint string
+    // ChatModel is the chat-completions model; empty means DefaultChatModel.
+    ChatModel string
+    // Router picks the backends Answer tries; nil means NewQueryRouter().
+    Router *QueryRouter
+    // Usage, when set, records each model call under Scope.
+    Usage *UsageService
+    Scope model.UsageScope
 } 
+
+func (s *AIService) guard() *PromptGuard {
+    if s.Guard != nil {
+        return s.Guard
+    }
+    return NewPromptGuard()
+}
+
+// WithPromptVersion returns a copy of the service that renders prompts at
+// version, for requests that pick a version to compare.
+func (s *AIService) WithPromptVersion(version string) *AIService {
+    copied := *s
+    copied.PromptVersion = version
+    return &copied
+}
+
+// WithScope returns a copy of the service that records model calls under
+// scope.
+func (s *AIService) WithScope(scope model.UsageScope) *AIService {
+    copied := *s
+    copied.Scope = scope
+    return &copied
+}
+
+// recordUsage logs a model call, reading token counts from the response's
+// usage field or estimating them from the request and answer text.
+func (s *AIService) recordUsage(modelName string, request []byte, response []byte, answer string, start time.Time, err error) {
+    if s.Usage == nil {
+        return
+    }
+    input, output, ok := ParseTokenUsage(response)
+    if !ok {
+        input, output = EstimateTokens(string(request)), EstimateTokens(answer)
+    }
+    s.Usage.Record(s.Scope, modelName, input, output, !ok, time.Since(start), err)
+}
+
+// replyContent returns the text of a chat-completions reply, or the body
+// when it has none.
+func replyContent(body []byte) string {
+    var reply struct {
+        Choices []struct {
+            Message model.ChatMessage `json:"message"`
+        } `json:"choices"`
+    }
+    if err := json.Unmarshal(body, &reply); err != nil || len(reply.Choices) == 0 {
+        return string(body)
+    }
+    return reply.Choices[0].Message.Content
+}
+
+// prompt renders a system prompt template.
+func (s *AIService) prompt(name string) (string, error) {
+    prompts := s.Prompts
+    if prompts == nil {
+        prompts = DefaultPrompts()
+    }
+    text, _, err := prompts.Render(s.PromptVersion, name, DefaultPromptLanguage, nil)
+    return text, err
+}
+
+// DefaultMaxToolIterations is how many rounds of tool calls RunTools allows
+// before asking the model for an answer without tools.
+const DefaultMaxToolIterations = 5
+
+// DefaultInferenceEndpoint is the Hugging Face inference API.
+const DefaultInferenceEndpoint = "https://api-inference.huggingface.co"
+
+const (
+    DefaultChatModel = "microsoft/Phi-3.5-mini-instruct"
+    tapasModel       = "google/tapas-base-finetuned-wtq"
+)
+
+func (s *AIService) chatModel() string {
+    if s.ChatModel != "" {
+        return s.ChatModel
+    }
+    return DefaultChatModel
+}
+
+// modelURL returns the inference URL of a model.
+func (s *AIService) modelURL(name string) string {
+    endpoint := s.Endpoint
+    if endpoint == "" {
+        endpoint = DefaultInferenceEndpoint
+    }
+    return strings.TrimSuffix(endpoint, "/") + "/models/" + name
+}
 func (s *AIService) ChatWithAI(context, query, token string, translationService *TranslationService) (model.ChatResponse, error) {
+    guard := s.guard()
+    if err := guard.CheckQuery(query); err != nil {
+        return model.ChatResponse{}, err
+    }
     translated, err := translationService.Translate(query, "id", "en")
     if err != nil {
         return model.ChatResponse{}, err
     }
 
-    input := map[string]interface{}{
-        "model": "microsoft/Phi-3.5-mini-instruct",
-        "messages": []map[string]string{
-            {
-                "role":    "user",
-                "content": translated,
-            },
-        },
-        "max_tokens": 600,
-        "stream":     false,
+    messages := []map[string]string{}
+    if strings.TrimSpace(context) != "" {
+        instructions, err := s.prompt(PromptChatSystem)
+        if err != nil {
+            return model.ChatResponse{}, err
+        }
+        messages = append(messages, map[string]string{
+            "role":    "system",
+            "content": guard.SystemPrompt(instructions, context),
+        })
     }
-    body, err := json.Marshal(input)
+    messages = append(messages, map[string]string{
+        "role":    "user",
+        "content": translated,
+    })
+
+    generatedText, err := s.CompleteChat(messages, token)
     if err != nil {
         return model.ChatResponse{}, err
     }
 
-    fmt.Println("ChatWithAI request body:", string(body))
-
-    req, err := http.NewRequest("POST", "https://api-inference.huggingface.co/models/microsoft/Phi-3.5-mini-instruct/v1/chat/completions", bytes.NewBuffer(body))
+    translatedAnswer, err := translationService.Translate(generatedText, "en", "id")
     if err != nil {
         return model.ChatResponse{}, err
     }
-    req.Header.Set("Authorization", "Bearer "+token)
-    req.Header.Set("Content-Type", "application/json")
 
-    resp, err := s.Client.Do(req)
-    if err != nil {
+    if err := guard.CheckOutput(translatedAnswer); err != nil {
         return model.ChatResponse{}, err
     }
-    defer resp.Body.Close()
 
-    if resp.StatusCode != http.StatusOK {
-        respBody, _ := ioutil.ReadAll(resp.Body)
-        fmt.Println("Error response body:", string(respBody))
-        return model.ChatResponse{}, errors.New("failed to get chat response")
-    }
+    var translatedResponse model.ChatResponse
+    translatedResponse.GeneratedText = translatedAnswer
 
-    respBody, err := ioutil.ReadAll(resp.Body)
+    return translatedResponse, nil
+}
+
+ 
+// CompleteChat sends messages to the chat-completions model and returns the
+// text of its reply.
+func (s *AIService) CompleteChat(messages []map[string]string, token string) (string, error) {
+    respBody, err := s.postChat(map[string]interface{}{
+        "model":      s.chatModel(),
+        "messages":   messages,
+        "max_tokens": 600,
+        "stream":     false,
+    }, token)
     if err != nil {
-        return model.ChatResponse{}, err
+        return "", err
     }
 
-    fmt.Println("ChatWithAI response body:", string(respBody))
-
     var result map[string]interface{}
     if err := json.Unmarshal(respBody, &result); err != nil {
-        return model.ChatResponse{}, err
+        return "", err
     }
 
     fmt.Printf("Parsed JSON result: %+v\n", result)
@@ -92,28 +212,228 @@ func (s *AIService) ChatWithAI(context, query, token string, translationService
     }
 
     if generatedText == "" {
-        return model.ChatResponse{}, errors.New("failed to extract generated text from response")
+        return "", errors.New("failed to extract generated text from response")
     }
+    return generatedText, nil
+}
 
-    translatedAnswer, err := translationService.Translate(generatedText, "en", "id")
+// postChat sends a request body to the chat-completions endpoint and returns
+// the response body.
+func (s *AIService) postChat(input map[string]interface{}, token string) ([]byte, error) {
+    body, err := json.Marshal(input)
     if err != nil {
-        return model.ChatResponse{}, err
+        return nil, err
     }
 
-    var translatedResponse model.ChatResponse
-    translatedResponse.GeneratedText = translatedAnswer
+    fmt.Println("ChatWithAI request body:", string(body))
 
-    return translatedResponse, nil
+    req, err := http.NewRequest("POST", s.modelURL(s.chatModel())+"/v1/chat/completions", bytes.NewBuffer(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Content-Type", "application/json")
+
+    start := time.Now()
+    resp, err := s.Client.Do(req)
+    if err != nil {
+        s.recordUsage(s.chatModel(), body, nil, "", start, err)
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        respBody, _ := ioutil.ReadAll(resp.Body)
+        fmt.Println("Error response body:", string(respBody))
+        err := errors.New("failed to get chat response")
+        s.recordUsage(s.chatModel(), body, nil, "", start, err)
+        return nil, err
+    }
+
+    respBody, err := ioutil.ReadAll(resp.Body)
+    if err != nil {
+        return nil, err
+    }
+    s.recordUsage(s.chatModel(), body, respBody, replyContent(respBody), start, nil)
+
+    fmt.Println("ChatWithAI response body:", string(respBody))
+    return respBody, nil
 }
 
- 
-func (s *AIService) AnalyzeData(table map[string][]string, query, token string, translationService *TranslationService) (string, error) { 
+// ChatCompletion sends messages and the tools the model may call, and returns
+// the model's reply, which either has content or requests tool calls.
+func (s *AIService) ChatCompletion(messages []model.ChatMessage, tools []model.Tool, token string) (model.ChatMessage, error) {
+    input := map[string]interface{}{
+        "model":      s.chatModel(),
+        "messages":   messages,
+        "max_tokens": 600,
+        "stream":     false,
+    }
+    if len(tools) > 0 {
+        input["tools"] = tools
+        input["tool_choice"] = "auto"
+    }
+    respBody, err := s.postChat(input, token)
+    if err != nil {
+        return model.ChatMessage{}, err
+    }
+
+    var result struct {
+        Choices []struct {
+            Message model.ChatMessage `json:"message"`
+        } `json:"choices"`
+    }
+    if err := json.Unmarshal(respBody, &result); err != nil {
+        return model.ChatMessage{}, err
+    }
+    if len(result.Choices) == 0 {
+        return model.ChatMessage{}, errors.New("chat response has no choices")
+    }
+    message := result.Choices[0].Message
+    if message.Content == "" && len(message.ToolCalls) == 0 {
+        return model.ChatMessage{}, errors.New("failed to extract generated text from response")
+    }
+    return message, nil
+}
+
+// RunTools sends messages with the executor's tools and runs every tool call
+// the model requests, feeding the results back, until the model answers.
+// After maxToolIterations rounds of tool calls the model is asked once more
+// without tools. The trace lists every call in order.
+func (s *AIService) RunTools(messages []model.ChatMessage, token string, executor ToolExecutor) (string, []model.ToolTrace, error) {
+    limit := s.MaxToolIterations
+    if limit <= 0 {
+        limit = DefaultMaxToolIterations
+    }
+    trace := []model.ToolTrace{}
+    tools := executor.Tools()
+    for iteration := 1; ; iteration++ {
+        if iteration > limit {
+            tools = nil
+        }
+        reply, err := s.ChatCompletion(messages, tools, token)
+        if err != nil {
+            return "", trace, err
+        }
+        if len(reply.ToolCalls) == 0 || tools == nil {
+            if strings.TrimSpace(reply.Content) == "" {
+                return "", trace, errors.New("model gave no final answer")
+            }
+            return reply.Content, trace, nil
+        }
+
+        reply.Role = "assistant"
+        messages = append(messages, reply)
+        for _, call := range reply.ToolCalls {
+            step := model.ToolTrace{Iteration: iteration, ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments}
+            var content []byte
+            result, err := executor.Call(call.Function.Name, call.Function.Arguments)
+            if err == nil {
+                content, err = json.Marshal(result)
+            }
+            if err == nil {
+                if _, quarantined := s.guard().SanitizeText(string(content)); quarantined > 0 {
+                    err = errors.New("result withheld because it contains text that reads like instructions")
+                }
+            }
+            if err != nil {
+                step.Error = err.Error()
+                content, _ = json.Marshal(map[string]string{"error": err.Error()})
+            } else {
+                step.Result = result
+            }
+            trace = append(trace, step)
+            messages = append(messages, model.ChatMessage{
+                Role:       "tool",
+                Content:    string(content),
+                ToolCallID: call.ID,
+                Name:       call.Function.Name,
+            })
+        }
+    }
+}
+
+// ChatWithTools answers a query like ChatWithAI, letting the model call the
+// executor's tools for figures from the dataset.
+func (s *AIService) ChatWithTools(context, query, token string, translationService *TranslationService, executor ToolExecutor) (model.ChatResponse, []model.ToolTrace, error) {
+    guard := s.guard()
+    if err := guard.CheckQuery(query); err != nil {
+        return model.ChatResponse{}, nil, err
+    }
+    translated, err := translationService.Translate(query, "id", "en")
+    if err != nil {
+        return model.ChatResponse{}, nil, err
+    }
+
+    instructions, err := s.prompt(PromptToolSystem)
+    if err != nil {
+        return model.ChatResponse{}, nil, err
+    }
+    answer, trace, err := s.RunTools([]model.ChatMessage{
+        {Role: "system", Content: guard.SystemPrompt(instructions, context)},
+        {Role: "user", Content: translated},
+    }, token, executor)
+    if err != nil {
+        return model.ChatResponse{}, trace, err
+    }
+
+    translatedAnswer, err := translationService.Translate(answer, "en", "id")
+    if err != nil {
+        return model.ChatResponse{}, trace, err
+    }
+    if err := guard.CheckOutput(translatedAnswer); err != nil {
+        return model.ChatResponse{}, trace, err
+    }
+    return model.ChatResponse{GeneratedText: translatedAnswer}, trace, nil
+}
+
+// GenerateQuery asks the chat model to turn a question into a structured
+// query and validates its reply.
+func (s *AIService) GenerateQuery(question, token string, translationService *TranslationService) (model.Query, error) {
+    if err := s.guard().CheckQuery(question); err != nil {
+        return model.Query{}, err
+    }
+    translated, err := translationService.Translate(question, "id", "en")
+    if err != nil {
+        return model.Query{}, err
+    }
+
+    instructions, err := s.prompt(PromptQuerySystem)
+    if err != nil {
+        return model.Query{}, err
+    }
+    reply, err := s.CompleteChat([]map[string]string{
+        {"role": "system", "content": instructions},
+        {"role": "user", "content": translated},
+    }, token)
+    if err != nil {
+        return model.Query{}, err
+    }
+    return (&QueryService{}).ParseQuery(reply)
+}
+
+
+// AnalyzeData asks the table model a question about table. Cells that look
+// like instructions are withheld from the model.
+func (s *AIService) AnalyzeData(table map[string][]string, query, token string, translationService *TranslationService) (string, error) {
+    answer, _, err := s.AnalyzeTable(table, query, token, translationService)
+    return answer, err
+}
+
+// AnalyzeTable is AnalyzeData, also returning the guard report of the cells
+// withheld from the model.
+func (s *AIService) AnalyzeTable(table map[string][]string, query, token string, translationService *TranslationService) (string, model.GuardReport, error) {
     if len(table) == 0 { 
-        return "", errors.New("table is empty") 
+        return "", model.GuardReport{}, errors.New("table is empty")
     } 
+    guard := s.guard()
+    if err := guard.CheckQuery(query); err != nil {
+        return "", model.GuardReport{}, err
+    }
+    table, report := guard.SanitizeTable(table)
     translated, err := translationService.Translate(query, "id", "en") 
     if err != nil { 
-        return "", err 
+        return "", report, err
     } 
     input := model.AIRequest{ 
         Inputs: model.Inputs{ 
@@ -122,37 +442,45 @@ func (s *AIService) AnalyzeData(table map[string][]string, query, token string,
     }
     body, err := json.Marshal(input) 
     if err != nil { 
-        return "", err 
+        return "", report, err
     } 
-    fmt.Println("AnalyzeData request body:", string(body)) 
-    req, err := http.NewRequest("POST", "https://api-inference.huggingface.co/models/google/tapas-base-finetuned-wtq", bytes.NewBuffer(body)) 
+    fmt.Printf("AnalyzeData request body: %d bytes\n", len(body))
+    req, err := http.NewRequest("POST", s.modelURL(tapasModel), bytes.NewBuffer(body)) 
     if err != nil { 
-        return "", err 
+        return "", report, err
     } 
     req.Header.Set("Authorization", "Bearer "+token) 
     req.Header.Set("Content-Type", "application/json") 
+    start := time.Now()
     resp, err := s.Client.Do(req) 
     if err != nil { 
-        return "", err 
+        s.recordUsage(tapasModel, body, nil, "", start, err)
+        return "", report, err
     } 
     defer resp.Body.Close() 
     if resp.StatusCode != http.StatusOK { 
         respBody, _ := ioutil.ReadAll(resp.Body) 
         fmt.Println("Error response body:", string(respBody)) 
-        return "", errors.New("failed to analyze data") 
+        err := errors.New("failed to analyze data")
+        s.recordUsage(tapasModel, body, nil, "", start, err)
+        return "", report, err
     } 
     var result model.TapasResponse 
     if err := json.NewDecoder(resp.Body).Decode(&result); err != nil { 
-        return "", err 
+        return "", report, err
     } 
     fmt.Println("AnalyzeData response:", result) // Extract the answer from the cells field 
     answer := "" 
     if len(result.Cells) > 0 { 
         answer = result.Cells[0] 
     }
+    s.recordUsage(tapasModel, body, nil, answer, start, nil)
     translatedAnswer, err := translationService.Translate(answer, "en", "id") 
     if err != nil { 
-        return "", err 
+        return "", report, err
     } 
-    return translatedAnswer, nil 
+    if err := guard.CheckOutput(translatedAnswer); err != nil {
+        return "", report, err
+    }
+    return translatedAnswer, report, nil
 }
\ No newline at end of file
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// DefaultEmissionFactor is the grid emission factor in kg CO2e per kWh used
+// when neither a static factor nor an hourly profile is configured.
+const DefaultEmissionFactor = 0.4
+
+// CarbonService converts energy readings into CO2e emissions. When Profile is
+// set, each reading uses the intensity of its hour of day and falls back to
+// Factor for hours missing from the profile.
+type CarbonService struct {
+	Factor  float64
+	Profile map[int]float64
+}
+
+func NewCarbonService(factor float64) *CarbonService {
+	if factor <= 0 {
+		factor = DefaultEmissionFactor
+	}
+	return &CarbonService{Factor: factor}
+}
+
+// LoadProfile parses an hourly intensity CSV with the header "Hour,Intensity",
+// where Hour is 0-23 and Intensity is kg CO2e per kWh.
+func (s *CarbonService) LoadProfile(fileContent string) error {
+	fileService := &FileService{}
+	table, err := fileService.ProcessFile(fileContent)
+	if err != nil {
+		return err
+	}
+	hours, okHour := table["Hour"]
+	intensities, okIntensity := table["Intensity"]
+	if !okHour || !okIntensity {
+		return errors.New("intensity profile must have Hour and Intensity columns")
+	}
+
+	profile := make(map[int]float64, len(hours))
+	for i := range hours {
+		hour, err := strconv.Atoi(hours[i])
+		if err != nil || hour < 0 || hour > 23 {
+			return fmt.Errorf("invalid hour %q in intensity profile", hours[i])
+		}
+		intensity, err := strconv.ParseFloat(intensities[i], 64)
+		if err != nil || intensity < 0 {
+			return fmt.Errorf("invalid intensity %q in intensity profile", intensities[i])
+		}
+		profile[hour] = intensity
+	}
+	s.Profile = profile
+	return nil
+}
+
+// IntensityAt returns the emission factor that applies to the reading.
+func (s *CarbonService) IntensityAt(r model.Reading) float64 {
+	if s.Profile != nil {
+		if intensity, ok := s.Profile[readingHour(r)]; ok {
+			return intensity
+		}
+	}
+	return s.Factor
+}
+
+// Compute aggregates emissions per appliance, room and time bucket. bucket is
+// "hour" or "day"; anything else is treated as "day". Day buckets follow the
+// readings' Date; hour buckets of readings with a Timestamp carry its offset,
+// so the hour repeated when clocks fall back is counted twice.
+func (s *CarbonService) Compute(readings []model.Reading, bucket string) model.CarbonReport {
+	if bucket != "hour" {
+		bucket = "day"
+	}
+	report := model.CarbonReport{Method: "static", Bucket: bucket}
+	if s.Profile != nil {
+		report.Method = "hourly_profile"
+	}
+
+	byAppliance := map[string]*model.EmissionEntry{}
+	byRoom := map[string]*model.EmissionEntry{}
+	byBucket := map[string]*model.EmissionEntry{}
+	add := func(entries map[string]*model.EmissionEntry, key string, energy, emissions float64) {
+		entry, ok := entries[key]
+		if !ok {
+			entry = &model.EmissionEntry{Key: key}
+			entries[key] = entry
+		}
+		entry.EnergyKWh += energy
+		entry.EmissionsKg += emissions
+	}
+
+	for _, r := range readings {
+		emissions := r.EnergyConsumption * s.IntensityAt(r)
+		key := r.Date
+		if bucket == "hour" {
+			key = hourLabel(r)
+		}
+		add(byAppliance, r.Appliance, r.EnergyConsumption, emissions)
+		add(byRoom, r.Room, r.EnergyConsumption, emissions)
+		add(byBucket, key, r.EnergyConsumption, emissions)
+		report.TotalEnergyKWh += r.EnergyConsumption
+		report.TotalEmissionsKg += emissions
+	}
+
+	report.ByAppliance = sortedByEmissions(byAppliance)
+	report.ByRoom = sortedByEmissions(byRoom)
+	report.ByBucket = sortedByKey(byBucket)
+	return report
+}
+
+// Summary renders the report as a short English paragraph for chat grounding.
+func (s *CarbonService) Summary(report model.CarbonReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Total emissions: %.2f kg CO2e from %.2f kWh.", report.TotalEmissionsKg, report.TotalEnergyKWh)
+	if len(report.ByRoom) > 0 {
+		sb.WriteString(" Emissions by room:")
+		for _, e := range report.ByRoom {
+			fmt.Fprintf(&sb, " %s %.2f kg;", e.Key, e.EmissionsKg)
+		}
+		fmt.Fprintf(&sb, " the room with the largest footprint is %s.", report.ByRoom[0].Key)
+	}
+	if len(report.ByAppliance) > 0 {
+		sb.WriteString(" Emissions by appliance:")
+		for _, e := range report.ByAppliance {
+			fmt.Fprintf(&sb, " %s %.2f kg;", e.Key, e.EmissionsKg)
+		}
+		fmt.Fprintf(&sb, " the appliance with the largest footprint is %s.", report.ByAppliance[0].Key)
+	}
+	return sb.String()
+}
+
+func sortedByEmissions(entries map[string]*model.EmissionEntry) []model.EmissionEntry {
+	result := make([]model.EmissionEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].EmissionsKg != result[j].EmissionsKg {
+			return result[i].EmissionsKg > result[j].EmissionsKg
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+func sortedByKey(entries map[string]*model.EmissionEntry) []model.EmissionEntry {
+	result := make([]model.EmissionEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, *e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
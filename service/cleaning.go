@@ -0,0 +1,239 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Gap filling methods accepted in model.CleaningOptions.
+const (
+	FillNone        = "none"
+	FillZero        = "zero"
+	FillForward     = "forward"
+	FillInterpolate = "interpolate"
+)
+
+// ParseCleaningOptions validates cleaning options and returns the resample
+// interval, zero when readings are not resampled.
+func ParseCleaningOptions(options model.CleaningOptions) (time.Duration, error) {
+	var interval time.Duration
+	if options.Interval != "" {
+		var err error
+		interval, err = time.ParseDuration(options.Interval)
+		if err != nil || interval < time.Minute || interval > 24*time.Hour || (24*time.Hour)%interval != 0 {
+			return 0, fmt.Errorf("interval must be a duration of at least a minute that divides a day, got %q", options.Interval)
+		}
+	}
+	switch options.Fill {
+	case "", FillNone:
+	case FillZero, FillForward, FillInterpolate:
+		if interval == 0 {
+			return 0, fmt.Errorf("fill %q needs an interval", options.Fill)
+		}
+	default:
+		return 0, fmt.Errorf("fill must be none, zero, forward or interpolate, got %q", options.Fill)
+	}
+	return interval, nil
+}
+
+// ClampNegativeEnergy sets negative Energy_Consumption values of a table to
+// zero, so the cleaning stage can run before ValidateTable. It returns the
+// number of values changed.
+func ClampNegativeEnergy(table map[string][]string) int {
+	clamped := 0
+	for i, value := range table[ColumnEnergy] {
+		if energy, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && energy < 0 {
+			table[ColumnEnergy][i] = "0"
+			clamped++
+		}
+	}
+	return clamped
+}
+
+// CleanReadings sorts validated readings by time, drops repeated readings of
+// an appliance and room at the same time (keeping the first), clamps negative
+// energy and, when options has an interval, resamples each appliance and room
+// to it and fills missing intervals. Readings must have a Timestamp (see
+// ResolveTimes); interval boundaries are counted from local midnight in loc.
+func CleanReadings(readings []model.Reading, options model.CleaningOptions, loc *time.Location) ([]model.Reading, *model.CleaningReport, error) {
+	interval, err := ParseCleaningOptions(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	report := &model.CleaningReport{RowsIn: len(readings), Interval: options.Interval, Fill: options.Fill}
+	for _, r := range readings {
+		if r.Timestamp.IsZero() {
+			return nil, nil, errors.New("readings must have timestamps to be cleaned")
+		}
+	}
+
+	cleaned := append([]model.Reading(nil), readings...)
+	sort.SliceStable(cleaned, func(i, j int) bool { return cleaned[i].Timestamp.Before(cleaned[j].Timestamp) })
+	for i := 1; i < len(readings); i++ {
+		if readings[i].Timestamp.Before(readings[i-1].Timestamp) {
+			report.Reordered = true
+			break
+		}
+	}
+
+	seen := map[string]bool{}
+	unique := cleaned[:0]
+	for _, r := range cleaned {
+		key := meterKey(r) + "\x00" + r.Timestamp.UTC().Format(time.RFC3339)
+		if seen[key] {
+			report.DuplicatesRemoved++
+			continue
+		}
+		seen[key] = true
+		if r.EnergyConsumption < 0 {
+			r.EnergyConsumption = 0
+			report.NegativesClamped++
+		}
+		unique = append(unique, r)
+	}
+	cleaned = unique
+
+	if interval > 0 {
+		cleaned = resample(cleaned, interval, loc, report)
+		cleaned = fillGaps(cleaned, interval, loc, options.Fill, report)
+	}
+	report.RowsOut = len(cleaned)
+	return cleaned, report, nil
+}
+
+// CleanTable applies CleanReadings to a validated table that follows the
+// energy schema. Other tables are returned unchanged with a nil report. It
+// runs after unit normalization, so resampling sums kWh per interval.
+func CleanTable(table map[string][]string, options model.CleaningOptions, loc *time.Location) (map[string][]string, *model.CleaningReport, error) {
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return table, nil, nil
+		}
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := ResolveTimes(readings, loc); err != nil {
+		return nil, nil, err
+	}
+	readings, report, err := CleanReadings(readings, options, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ReadingsToTable(readings), report, nil
+}
+
+func meterKey(r model.Reading) string {
+	return r.Appliance + "\x00" + r.Room
+}
+
+// intervalStart returns the start of the interval containing at. Intervals
+// are counted in elapsed time from local midnight, so each lasts the same
+// real duration on days when clocks change.
+func intervalStart(at time.Time, interval time.Duration, loc *time.Location) time.Time {
+	local := at.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	return midnight.Add(local.Sub(midnight) / interval * interval)
+}
+
+// nextInterval returns the start of the interval after the one starting at
+// start. The last interval of a day ends at the next local midnight.
+func nextInterval(start time.Time, interval time.Duration, loc *time.Location) time.Time {
+	local := start.In(loc)
+	next := start.Add(interval)
+	if midnight := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc); !next.Before(midnight) {
+		return midnight
+	}
+	return next
+}
+
+// resample sums the sorted readings of each meter per interval. An interval
+// is "On" when any of its readings is.
+func resample(readings []model.Reading, interval time.Duration, loc *time.Location, report *model.CleaningReport) []model.Reading {
+	buckets := map[string]int{}
+	resampled := make([]model.Reading, 0, len(readings))
+	for _, r := range readings {
+		start := intervalStart(r.Timestamp, interval, loc)
+		key := meterKey(r) + "\x00" + start.UTC().Format(time.RFC3339)
+		if i, ok := buckets[key]; ok {
+			resampled[i].EnergyConsumption += r.EnergyConsumption
+			if r.Status == "On" {
+				resampled[i].Status = "On"
+			}
+			report.Resampled++
+			continue
+		}
+		buckets[key] = len(resampled)
+		resampled = append(resampled, atInstant(r, start))
+	}
+	return resampled
+}
+
+// fillGaps adds a reading for every missing interval between the first and
+// last reading of each meter.
+func fillGaps(readings []model.Reading, interval time.Duration, loc *time.Location, fill string, report *model.CleaningReport) []model.Reading {
+	if fill == "" || fill == FillNone {
+		return readings
+	}
+
+	var meters []string
+	series := map[string][]model.Reading{}
+	for _, r := range readings {
+		key := meterKey(r)
+		if _, ok := series[key]; !ok {
+			meters = append(meters, key)
+		}
+		series[key] = append(series[key], r)
+	}
+
+	filled := make([]model.Reading, 0, len(readings))
+	for _, key := range meters {
+		points := series[key]
+		for i, r := range points {
+			filled = append(filled, r)
+			if i+1 == len(points) {
+				break
+			}
+			next := points[i+1]
+			var missing []time.Time
+			for at := nextInterval(r.Timestamp, interval, loc); at.Before(next.Timestamp); at = nextInterval(at, interval, loc) {
+				missing = append(missing, at)
+			}
+			for j, at := range missing {
+				gap := atInstant(r, at)
+				switch fill {
+				case FillZero:
+					gap.EnergyConsumption = 0
+				case FillInterpolate:
+					step := float64(j+1) / float64(len(missing)+1)
+					gap.EnergyConsumption = r.EnergyConsumption + (next.EnergyConsumption-r.EnergyConsumption)*step
+				}
+				gap.Status = "Off"
+				if gap.EnergyConsumption > 0 {
+					gap.Status = "On"
+				}
+				filled = append(filled, gap)
+				report.GapsFilled++
+			}
+		}
+	}
+	sort.SliceStable(filled, func(i, j int) bool { return filled[i].Timestamp.Before(filled[j].Timestamp) })
+	return filled
+}
+
+func atInstant(r model.Reading, at time.Time) model.Reading {
+	r.Timestamp = at
+	r.Date = at.Format(dateLayout)
+	r.Time = at.Format("15:04")
+	return r
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Comparison modes supported by ComparisonService.Compare.
+const (
+	CompareDay            = "day"
+	CompareWeek           = "week"
+	CompareWeekdayWeekend = "weekday_weekend"
+)
+
+const dateLayout = "2006-01-02"
+
+// biggestMoversLimit is how many appliances are highlighted as biggest movers.
+const biggestMoversLimit = 3
+
+type ComparisonService struct{}
+
+// Compare reports the change in consumption between a base and a target
+// period. Periods are dates for "day", ISO weeks ("2022-W01") for "week" and
+// are fixed to weekday vs weekend for "weekday_weekend", where average daily
+// consumption is compared because the two periods span a different number of
+// days. Empty base/target default to the two most recent periods; an empty
+// target alone to the most recent period and an empty base alone to the
+// period just before the target.
+func (s *ComparisonService) Compare(readings []model.Reading, mode, base, target string) (model.ComparisonReport, error) {
+	if mode == "" {
+		mode = CompareDay
+	}
+	if mode != CompareDay && mode != CompareWeek && mode != CompareWeekdayWeekend {
+		return model.ComparisonReport{}, fmt.Errorf("unknown comparison mode %q", mode)
+	}
+
+	type periodTotals struct {
+		days        map[string]bool
+		total       float64
+		byAppliance map[string]float64
+		byRoom      map[string]float64
+	}
+	periods := map[string]*periodTotals{}
+	for _, r := range readings {
+		key, err := periodOf(r.Date, mode)
+		if err != nil {
+			return model.ComparisonReport{}, err
+		}
+		p, ok := periods[key]
+		if !ok {
+			p = &periodTotals{days: map[string]bool{}, byAppliance: map[string]float64{}, byRoom: map[string]float64{}}
+			periods[key] = p
+		}
+		p.days[r.Date] = true
+		p.total += r.EnergyConsumption
+		p.byAppliance[r.Appliance] += r.EnergyConsumption
+		p.byRoom[r.Room] += r.EnergyConsumption
+	}
+
+	if mode == CompareWeekdayWeekend {
+		base, target = "weekday", "weekend"
+	} else if base == "" || target == "" {
+		keys := make([]string, 0, len(periods))
+		for key := range periods {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) < 2 {
+			return model.ComparisonReport{}, errors.New("at least two periods of data are needed for a comparison")
+		}
+		if base == "" && target == "" {
+			base, target = keys[len(keys)-2], keys[len(keys)-1]
+		} else if target == "" {
+			target = keys[len(keys)-1]
+		} else {
+			i := sort.SearchStrings(keys, target)
+			if i == 0 {
+				return model.ComparisonReport{}, fmt.Errorf("no data before period %q", target)
+			}
+			base = keys[i-1]
+		}
+	}
+	if base == target {
+		return model.ComparisonReport{}, fmt.Errorf("base and target are both period %q", base)
+	}
+
+	basePeriod, ok := periods[base]
+	if !ok {
+		return model.ComparisonReport{}, fmt.Errorf("no data for period %q", base)
+	}
+	targetPeriod, ok := periods[target]
+	if !ok {
+		return model.ComparisonReport{}, fmt.Errorf("no data for period %q", target)
+	}
+
+	baseScale, targetScale := 1.0, 1.0
+	if mode == CompareWeekdayWeekend {
+		baseScale = 1 / float64(len(basePeriod.days))
+		targetScale = 1 / float64(len(targetPeriod.days))
+	}
+
+	report := model.ComparisonReport{
+		Mode:         mode,
+		BasePeriod:   base,
+		TargetPeriod: target,
+		Total:        changeEntry("total", basePeriod.total*baseScale, targetPeriod.total*targetScale),
+		ByAppliance:  changeEntries(basePeriod.byAppliance, targetPeriod.byAppliance, baseScale, targetScale),
+		ByRoom:       changeEntries(basePeriod.byRoom, targetPeriod.byRoom, baseScale, targetScale),
+	}
+
+	movers := append([]model.ChangeEntry(nil), report.ByAppliance...)
+	sort.SliceStable(movers, func(i, j int) bool {
+		return math.Abs(movers[i].Change) > math.Abs(movers[j].Change)
+	})
+	if len(movers) > biggestMoversLimit {
+		movers = movers[:biggestMoversLimit]
+	}
+	report.BiggestMovers = movers
+	return report, nil
+}
+
+// Summary renders the comparison as a short English paragraph for chat grounding.
+func (s *ComparisonService) Summary(report model.ComparisonReport) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Compared with %s, energy use in %s was %.2f kWh versus %.2f kWh (%s).",
+		report.BasePeriod, report.TargetPeriod, report.Total.Target, report.Total.Base, describeChange(report.Total))
+	if len(report.BiggestMovers) > 0 {
+		sb.WriteString(" Biggest movers:")
+		for _, e := range report.BiggestMovers {
+			fmt.Fprintf(&sb, " %s %s;", e.Key, describeChange(e))
+		}
+	}
+	return sb.String()
+}
+
+func periodOf(date, mode string) (string, error) {
+	if mode == CompareDay {
+		return date, nil
+	}
+	day, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q", date)
+	}
+	if mode == CompareWeek {
+		year, week := day.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week), nil
+	}
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return "weekend", nil
+	}
+	return "weekday", nil
+}
+
+func changeEntry(key string, base, target float64) model.ChangeEntry {
+	entry := model.ChangeEntry{Key: key, Base: base, Target: target, Change: target - base}
+	if base != 0 {
+		percent := (target - base) / base * 100
+		entry.ChangePercent = &percent
+	}
+	return entry
+}
+
+func changeEntries(base, target map[string]float64, baseScale, targetScale float64) []model.ChangeEntry {
+	keys := map[string]bool{}
+	for key := range base {
+		keys[key] = true
+	}
+	for key := range target {
+		keys[key] = true
+	}
+	entries := make([]model.ChangeEntry, 0, len(keys))
+	for key := range keys {
+		entries = append(entries, changeEntry(key, base[key]*baseScale, target[key]*targetScale))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+func describeChange(e model.ChangeEntry) string {
+	direction := "up"
+	if e.Change < 0 {
+		direction = "down"
+	}
+	if e.ChangePercent == nil {
+		return fmt.Sprintf("%s %.2f kWh", direction, math.Abs(e.Change))
+	}
+	return fmt.Sprintf("%s %.2f kWh, %.1f%%", direction, math.Abs(e.Change), math.Abs(*e.ChangePercent))
+}
@@ -0,0 +1,333 @@
+package service
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"a21hc3NpZ25tZW50/model"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// DefaultDialect is the dialect of the README's CSV format.
+var DefaultDialect = model.CSVDialect{Delimiter: ",", Quote: "\"", Decimal: ".", Header: true, Encoding: "utf-8"}
+
+// dialectSampleLines is how many lines dialect detection looks at.
+const dialectSampleLines = 50
+
+var (
+	decimalCommaPattern = regexp.MustCompile(`^-?\d{1,3}(\.\d{3})*,\d+$|^-?\d+,\d+$`)
+	decimalPointPattern = regexp.MustCompile(`^-?\d+\.\d+$`)
+)
+
+// DecodeText converts file content to UTF-8. encoding is a WHATWG label such
+// as "windows-1252" or "utf-16le"; when empty it is detected from a byte
+// order mark, falling back to Windows-1252 for content that is not UTF-8.
+// It returns the decoded text and the name of the encoding used.
+func DecodeText(fileContent, encoding string) (string, string, error) {
+	content := []byte(fileContent)
+	if encoding == "" {
+		switch {
+		case bytes.HasPrefix(content, []byte{0xEF, 0xBB, 0xBF}):
+			return string(content[3:]), "utf-8", nil
+		case bytes.HasPrefix(content, []byte{0xFF, 0xFE}):
+			encoding = "utf-16le"
+		case bytes.HasPrefix(content, []byte{0xFE, 0xFF}):
+			encoding = "utf-16be"
+		case utf8.Valid(content):
+			return fileContent, "utf-8", nil
+		default:
+			encoding = "windows-1252"
+		}
+	}
+
+	enc, err := htmlindex.Get(encoding)
+	if err != nil {
+		return "", "", fmt.Errorf("unknown encoding %q", encoding)
+	}
+	name, _ := htmlindex.Name(enc)
+	if name == "utf-8" {
+		return strings.TrimPrefix(fileContent, "\ufeff"), name, nil
+	}
+	if name == "utf-16le" || name == "utf-16be" {
+		endianness := unicode.LittleEndian
+		if name == "utf-16be" {
+			endianness = unicode.BigEndian
+		}
+		enc = unicode.UTF16(endianness, unicode.ExpectBOM)
+		if !bytes.HasPrefix(content, []byte{0xFF, 0xFE}) && !bytes.HasPrefix(content, []byte{0xFE, 0xFF}) {
+			enc = unicode.UTF16(endianness, unicode.IgnoreBOM)
+		}
+	}
+	decoded, err := enc.NewDecoder().Bytes(content)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to decode %s content: %v", name, err)
+	}
+	return string(decoded), name, nil
+}
+
+// DetectDialect guesses the delimiter, quote character, decimal separator and
+// header presence of UTF-8 text. Non-empty options override detection.
+func DetectDialect(text string, options model.ImportOptions) (model.CSVDialect, error) {
+	dialect := DefaultDialect
+	lines := sampleLines(text)
+
+	if options.Quote != "" {
+		dialect.Quote = options.Quote
+	} else {
+		dialect.Quote = detectQuote(lines)
+	}
+	if len(dialect.Quote) != 1 {
+		return dialect, fmt.Errorf("quote must be a single character, got %q", dialect.Quote)
+	}
+	if options.Delimiter != "" {
+		delimiter, err := parseDelimiter(options.Delimiter)
+		if err != nil {
+			return dialect, err
+		}
+		dialect.Delimiter = delimiter
+	} else {
+		dialect.Delimiter = detectDelimiter(lines, dialect.Quote)
+	}
+
+	rows := make([][]string, 0, len(lines))
+	for _, line := range lines {
+		rows = append(rows, splitLine(line, dialect.Delimiter[0], dialect.Quote[0]))
+	}
+
+	switch options.Decimal {
+	case "":
+		dialect.Decimal = detectDecimal(rows)
+	case ".", ",":
+		dialect.Decimal = options.Decimal
+	default:
+		return dialect, fmt.Errorf("decimal separator must be \".\" or \",\", got %q", options.Decimal)
+	}
+	if dialect.Decimal == dialect.Delimiter {
+		return dialect, errors.New("decimal separator and delimiter must differ")
+	}
+
+	if options.Header != "" {
+		header, err := strconv.ParseBool(options.Header)
+		if err != nil {
+			return dialect, fmt.Errorf("header must be true or false, got %q", options.Header)
+		}
+		dialect.Header = header
+	} else {
+		dialect.Header = detectHeader(rows, dialect.Decimal)
+	}
+	return dialect, nil
+}
+
+// ProcessCSV parses delimited text in the given dialect into a table like
+// ProcessFile does. Decimal commas are rewritten with a decimal point, and a
+// file without a header row gets the energy column names when it has six
+// columns.
+func (s *FileService) ProcessCSV(text string, dialect model.CSVDialect) (map[string][]string, error) {
+	if dialect == DefaultDialect {
+		return s.ProcessFile(text)
+	}
+
+	var rows [][]string
+	if dialect.Quote == "\"" {
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.Comma, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+		records, err := reader.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		rows = records
+	} else {
+		for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			rows = append(rows, splitLine(line, dialect.Delimiter[0], dialect.Quote[0]))
+		}
+	}
+	if len(rows) < 1 {
+		return nil, errors.New("csv file is empty or missing header")
+	}
+
+	headers := rows[0]
+	data := rows[1:]
+	if !dialect.Header {
+		if len(rows[0]) != len(EnergyColumns) {
+			return nil, errors.New("csv file has no header row")
+		}
+		headers = EnergyColumns
+		data = rows
+	}
+
+	table := make(map[string][]string)
+	for _, header := range headers {
+		table[strings.TrimSpace(header)] = []string{}
+	}
+	for _, row := range data {
+		if len(row) != len(headers) {
+			return nil, errors.New("csv row has incorrect number of fields")
+		}
+		for i, value := range row {
+			value = strings.TrimSpace(value)
+			if dialect.Decimal == "," && decimalCommaPattern.MatchString(value) {
+				value = strings.Replace(strings.ReplaceAll(value, ".", ""), ",", ".", 1)
+			}
+			column := strings.TrimSpace(headers[i])
+			table[column] = append(table[column], value)
+		}
+	}
+	return table, nil
+}
+
+func sampleLines(text string) []string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == dialectSampleLines {
+			break
+		}
+	}
+	return lines
+}
+
+func parseDelimiter(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "tab", "\\t", "\t":
+		return "\t", nil
+	case "comma":
+		return ",", nil
+	case "semicolon":
+		return ";", nil
+	case "pipe":
+		return "|", nil
+	}
+	if len(value) != 1 {
+		return "", fmt.Errorf("delimiter must be a single character, got %q", value)
+	}
+	return value, nil
+}
+
+// detectQuote picks the character that most often opens a field.
+func detectQuote(lines []string) string {
+	counts := map[byte]int{}
+	for _, line := range lines {
+		for i := 0; i < len(line); i++ {
+			if (line[i] == '"' || line[i] == '\'') && (i == 0 || strings.ContainsRune(",;\t|", rune(line[i-1]))) {
+				counts[line[i]]++
+			}
+		}
+	}
+	if counts['\''] > counts['"'] {
+		return "'"
+	}
+	return "\""
+}
+
+// detectDelimiter picks the candidate that splits every sampled line into the
+// same number of fields, preferring more fields and then the comma.
+func detectDelimiter(lines []string, quote string) string {
+	best, bestFields := ",", 1
+	for _, candidate := range []string{",", ";", "\t", "|"} {
+		fields := -1
+		consistent := true
+		for _, line := range lines {
+			n := len(splitLine(line, candidate[0], quote[0]))
+			if fields == -1 {
+				fields = n
+			} else if n != fields {
+				consistent = false
+				break
+			}
+		}
+		if consistent && fields > bestFields {
+			best, bestFields = candidate, fields
+		}
+	}
+	return best
+}
+
+// detectDecimal returns "," when numbers written with a decimal comma
+// outnumber those written with a decimal point.
+func detectDecimal(rows [][]string) string {
+	commas, points := 0, 0
+	for _, row := range rows {
+		for _, value := range row {
+			value = strings.TrimSpace(value)
+			if decimalPointPattern.MatchString(value) {
+				points++
+			} else if decimalCommaPattern.MatchString(value) {
+				commas++
+			}
+		}
+	}
+	if commas > points {
+		return ","
+	}
+	return "."
+}
+
+// detectHeader treats the first row as data when it has a numeric field in a
+// column that is numeric in the second row, or when it already looks like a
+// reading (a date in its first field).
+func detectHeader(rows [][]string, decimal string) bool {
+	if len(rows) < 2 {
+		return true
+	}
+	isNumber := func(value string) bool {
+		value = strings.TrimSpace(value)
+		if decimal == "," && decimalCommaPattern.MatchString(value) {
+			return true
+		}
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	}
+	first, second := rows[0], rows[1]
+	if len(first) > 0 && dateLikePattern.MatchString(strings.TrimSpace(first[0])) {
+		return false
+	}
+	for i := range first {
+		if i < len(second) && isNumber(first[i]) && isNumber(second[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+var dateLikePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$|^\d{1,2}[./]\d{1,2}[./]\d{2,4}$`)
+
+// splitLine splits one line on delimiter, honoring quote with doubled quotes
+// as escapes. It does not handle quoted line breaks.
+func splitLine(line string, delimiter, quote byte) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuotes && c == quote && i+1 < len(line) && line[i+1] == quote:
+			field.WriteByte(quote)
+			i++
+		case c == quote && (inQuotes || strings.TrimSpace(field.String()) == ""):
+			inQuotes = !inQuotes
+			if inQuotes {
+				field.Reset()
+			}
+		case c == delimiter && !inQuotes:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(fields, field.String())
+}
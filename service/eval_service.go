@@ -0,0 +1,367 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Evaluation case kinds and modes.
+const (
+	EvalExact     = "exact"
+	EvalNumeric   = "numeric"
+	EvalAppliance = "appliance"
+
+	EvalModeTable = "table"
+	EvalModeChat  = "chat"
+)
+
+// DefaultEvalTolerance is the relative difference a numeric answer may have
+// from the expected value.
+const DefaultEvalTolerance = 0.01
+
+var evalNumber = regexp.MustCompile(`\d+(?:[.,]\d+)*`)
+
+// AnswerProvider answers evaluation cases over a dataset table.
+type AnswerProvider interface {
+	Name() string
+	Answer(c model.EvalCase, table map[string][]string) (string, error)
+}
+
+// ModelProvider asks the models the application uses: the table QA model for
+// table cases and, for chat cases, the query router as /chat does, with the
+// most relevant readings as grounding, the analytics tools and the answer
+// verified against the dataset.
+type ModelProvider struct {
+	AI          *AIService
+	Token       string
+	Translation *TranslationService
+}
+
+func (p *ModelProvider) Name() string { return "model" }
+
+func (p *ModelProvider) Answer(c model.EvalCase, table map[string][]string) (string, error) {
+	if c.Mode != EvalModeChat {
+		return p.AI.AnalyzeData(AnalysisTable(table), c.Question, p.Token, p.Translation)
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return "", err
+	}
+	sources := NewRetrievalIndex(readings).Search(c.Question, DefaultRetrievalLimit)
+	routed, err := p.AI.Answer(RouteRequest{
+		Query:       c.Question,
+		Context:     RetrievalContext(sources),
+		Readings:    readings,
+		Tools:       &AnalyticsTools{Readings: readings},
+		Token:       p.Token,
+		Translation: p.Translation,
+	})
+	if err != nil {
+		return "", err
+	}
+	return VerifyAnswer(c.Question, routed.Answer, readings).Answer, nil
+}
+
+// ReplayProvider answers from recorded responses keyed by case ID, so a suite
+// can be scored again without calling the models.
+type ReplayProvider struct {
+	Responses map[string]string
+}
+
+func (p *ReplayProvider) Name() string { return "replay" }
+
+func (p *ReplayProvider) Answer(c model.EvalCase, table map[string][]string) (string, error) {
+	answer, ok := p.Responses[c.ID]
+	if !ok {
+		return "", fmt.Errorf("no recorded response for case %q", c.ID)
+	}
+	return answer, nil
+}
+
+// RecordingProvider passes cases to Provider and keeps its answers in
+// Responses for a ReplayProvider.
+type RecordingProvider struct {
+	Provider  AnswerProvider
+	Responses map[string]string
+}
+
+func (p *RecordingProvider) Name() string { return p.Provider.Name() }
+
+func (p *RecordingProvider) Answer(c model.EvalCase, table map[string][]string) (string, error) {
+	answer, err := p.Provider.Answer(c, table)
+	if err == nil {
+		if p.Responses == nil {
+			p.Responses = map[string]string{}
+		}
+		p.Responses[c.ID] = answer
+	}
+	return answer, err
+}
+
+// AnalyticsProvider answers cases from their structured query with the query
+// engine. It gives the reference answers a suite is checked against.
+type AnalyticsProvider struct{}
+
+func (p *AnalyticsProvider) Name() string { return "analytics" }
+
+func (p *AnalyticsProvider) Answer(c model.EvalCase, table map[string][]string) (string, error) {
+	if c.Query == nil {
+		return "", fmt.Errorf("case %q has no query", c.ID)
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return "", err
+	}
+	result, err := (&QueryService{}).Execute(readings, *c.Query)
+	if err != nil {
+		return "", err
+	}
+	if len(result.Rows) == 0 {
+		return "", errors.New("query matched no readings")
+	}
+	row := result.Rows[0]
+	if len(result.Query.GroupBy) > 0 {
+		return row.Group[result.Query.GroupBy[0]], nil
+	}
+	return strconv.FormatFloat(math.Round(row.Value*100)/100, 'f', -1, 64), nil
+}
+
+// ParseEvalSuite decodes and checks a suite.
+func ParseEvalSuite(content []byte) (model.EvalSuite, error) {
+	var suite model.EvalSuite
+	if err := json.Unmarshal(content, &suite); err != nil {
+		return suite, fmt.Errorf("invalid suite: %v", err)
+	}
+	seen := map[string]bool{}
+	for i, c := range suite.Cases {
+		if c.ID == "" || seen[c.ID] {
+			return suite, fmt.Errorf("case %d needs a unique id", i+1)
+		}
+		seen[c.ID] = true
+		if c.Dataset == "" || c.Question == "" || c.Expected == "" {
+			return suite, fmt.Errorf("case %q needs a dataset, question and expected answer", c.ID)
+		}
+		switch c.Kind {
+		case EvalExact, EvalNumeric, EvalAppliance:
+		default:
+			return suite, fmt.Errorf("case %q: kind must be exact, numeric or appliance", c.ID)
+		}
+		switch c.Mode {
+		case "", EvalModeTable, EvalModeChat:
+		default:
+			return suite, fmt.Errorf("case %q: mode must be table or chat", c.ID)
+		}
+		if c.Kind == EvalNumeric {
+			if _, err := strconv.ParseFloat(c.Expected, 64); err != nil {
+				return suite, fmt.Errorf("case %q: expected answer must be a number", c.ID)
+			}
+		}
+	}
+	return suite, nil
+}
+
+// Evaluator runs a suite through a provider. LoadTable returns the table of
+// a case's dataset; tables are loaded once per run.
+type Evaluator struct {
+	Provider  AnswerProvider
+	LoadTable func(dataset string) (map[string][]string, error)
+}
+
+func (e *Evaluator) Run(suite model.EvalSuite) model.EvalReport {
+	report := model.EvalReport{Suite: suite.Name, Provider: e.Provider.Name(), Results: []model.EvalResult{}}
+	tables := map[string]map[string][]string{}
+	var numeric, numericPassed, appliance, appliancePassed, exact int
+
+	for _, c := range suite.Cases {
+		table, ok := tables[c.Dataset]
+		var err error
+		if !ok {
+			if table, err = e.LoadTable(c.Dataset); err == nil {
+				tables[c.Dataset] = table
+			}
+		}
+		var answer string
+		if err == nil {
+			answer, err = e.Provider.Answer(c, table)
+		}
+
+		result := ScoreAnswer(c, answer, distinctValues(table[ColumnAppliance]))
+		if err != nil {
+			result.Error = err.Error()
+			result.Passed = false
+			report.Errors++
+		}
+		report.Results = append(report.Results, result)
+		report.Cases++
+		if result.Passed {
+			report.Passed++
+		}
+		if result.ExactMatch {
+			exact++
+		}
+		if result.Numeric != nil {
+			numeric++
+			if *result.Numeric {
+				numericPassed++
+			}
+		}
+		if result.Appliance != nil {
+			appliance++
+			if *result.Appliance {
+				appliancePassed++
+			}
+		}
+	}
+	report.ExactMatchRate = rate(exact, report.Cases)
+	report.NumericAccuracy = rate(numericPassed, numeric)
+	report.ApplianceAccuracy = rate(appliancePassed, appliance)
+	return report
+}
+
+// ScoreAnswer scores an answer by exact match, by whether it states the
+// expected number within the case's tolerance and by whether the first
+// appliance it names is the expected one. The case's kind decides whether
+// it passes.
+func ScoreAnswer(c model.EvalCase, answer string, appliances []string) model.EvalResult {
+	result := model.EvalResult{ID: c.ID, Question: c.Question, Expected: c.Expected, Answer: answer}
+	result.ExactMatch = normalizeAnswer(answer) == normalizeAnswer(c.Expected)
+
+	if expected, err := strconv.ParseFloat(c.Expected, 64); err == nil {
+		tolerance := c.Tolerance
+		if tolerance <= 0 {
+			tolerance = DefaultEvalTolerance
+		}
+		matched := statesNumber(answer, expected, math.Max(tolerance*math.Abs(expected), 0.005))
+		result.Numeric = &matched
+	}
+
+	if containsFold(appliances, c.Expected) {
+		matched := false
+		if mentioned := mentionedAppliances(answer, appliances); len(mentioned) > 0 {
+			matched = strings.EqualFold(mentioned[0], c.Expected)
+		}
+		result.Appliance = &matched
+	}
+
+	switch c.Kind {
+	case EvalExact:
+		result.Passed = result.ExactMatch
+	case EvalNumeric:
+		result.Passed = result.Numeric != nil && *result.Numeric
+	case EvalAppliance:
+		result.Passed = result.Appliance != nil && *result.Appliance
+	}
+	return result
+}
+
+// EvalMarkdown renders a report as a markdown summary and table of cases.
+func EvalMarkdown(report model.EvalReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Evaluation: %s\n\n", report.Suite)
+	fmt.Fprintf(&b, "Provider: %s\n\n", report.Provider)
+	b.WriteString("| Cases | Passed | Errors | Exact match | Numeric | Appliance |\n")
+	b.WriteString("|---|---|---|---|---|---|\n")
+	fmt.Fprintf(&b, "| %d | %d | %d | %.1f%% | %.1f%% | %.1f%% |\n\n",
+		report.Cases, report.Passed, report.Errors,
+		report.ExactMatchRate*100, report.NumericAccuracy*100, report.ApplianceAccuracy*100)
+	b.WriteString("| Case | Expected | Answer | Passed |\n")
+	b.WriteString("|---|---|---|---|\n")
+	for _, result := range report.Results {
+		answer := result.Answer
+		if result.Error != "" {
+			answer = "error: " + result.Error
+		}
+		passed := "no"
+		if result.Passed {
+			passed = "yes"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s | %s |\n", markdownCell(result.ID), markdownCell(result.Expected), markdownCell(answer), passed)
+	}
+	return b.String()
+}
+
+func markdownCell(text string) string {
+	text = strings.ReplaceAll(text, "|", `\|`)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+func normalizeAnswer(text string) string {
+	text = strings.ToLower(strings.Join(strings.Fields(text), " "))
+	return strings.TrimRight(text, ".!")
+}
+
+// statesNumber reports whether any number in text is within tolerance of
+// expected. Numbers are read both as 1,234.5 and, as Indonesian answers
+// write them, as 1.234,5.
+func statesNumber(text string, expected, tolerance float64) bool {
+	for _, token := range evalNumber.FindAllString(text, -1) {
+		readings := []string{
+			strings.ReplaceAll(token, ",", ""),
+			strings.Replace(strings.ReplaceAll(token, ".", ""), ",", ".", 1),
+		}
+		for _, reading := range readings {
+			if value, err := strconv.ParseFloat(reading, 64); err == nil && math.Abs(value-expected) <= tolerance {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mentionedAppliances returns the appliances named in text in order of
+// appearance.
+func mentionedAppliances(text string, appliances []string) []string {
+	type found struct {
+		name string
+		at   int
+	}
+	var mentions []found
+	for _, name := range appliances {
+		pattern := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(name) + `\b`)
+		if loc := pattern.FindStringIndex(text); loc != nil {
+			mentions = append(mentions, found{name, loc[0]})
+		}
+	}
+	sort.SliceStable(mentions, func(i, j int) bool { return mentions[i].at < mentions[j].at })
+	names := make([]string, len(mentions))
+	for i, m := range mentions {
+		names[i] = m.name
+	}
+	return names
+}
+
+func distinctValues(values []string) []string {
+	seen := map[string]bool{}
+	var distinct []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" && !seen[value] {
+			seen[value] = true
+			distinct = append(distinct, value)
+		}
+	}
+	return distinct
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func rate(count, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
@@ -3,13 +3,15 @@ package service
 import (
     "encoding/csv"
     "errors"
+    "fmt"
     "strings"
 	
 	repository "a21hc3NpZ25tZW50/repository/fileRepository"
 )   
 
 type FileService struct {
-    Repo *repository.FileRepository
+    Repo      *repository.FileRepository
+    Importers *ImporterRegistry
 }
 
 func (s *FileService) ProcessFile(fileContent string) (map[string][]string, error) {
@@ -26,6 +28,9 @@ func (s *FileService) ProcessFile(fileContent string) (map[string][]string, erro
     headers := rows[0]
     table := make(map[string][]string)
     for _, header := range headers {
+        if _, ok := table[strings.TrimSpace(header)]; ok {
+            return nil, fmt.Errorf("csv file has duplicate column %q", strings.TrimSpace(header))
+        }
         table[strings.TrimSpace(header)] = []string{}
     }
 
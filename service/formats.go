@@ -0,0 +1,374 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upload formats recognized by SniffFormat besides the registered importers.
+const (
+	FormatCSV    = "csv"
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+	FormatXLSX   = "xlsx"
+)
+
+// SniffFormat guesses the format of an upload from its content: a ZIP
+// signature means an .xlsx workbook, a leading "[" a JSON array, a leading
+// "{" NDJSON (or a single JSON object) and anything else text for the CSV
+// parser or an importer.
+func SniffFormat(fileContent string) string {
+	if strings.HasPrefix(fileContent, "PK\x03\x04") {
+		return FormatXLSX
+	}
+	trimmed := strings.TrimLeft(strings.TrimPrefix(fileContent, "\ufeff"), " \t\r\n")
+	switch {
+	case strings.HasPrefix(trimmed, "["):
+		return FormatJSON
+	case strings.HasPrefix(trimmed, "{"):
+		return FormatNDJSON
+	}
+	return FormatCSV
+}
+
+// ParseJSONTable reads a JSON array of flat objects into a table. Keys that
+// match an energy column case-insensitively are renamed to the column name.
+func ParseJSONTable(fileContent string) (map[string][]string, error) {
+	var records []map[string]interface{}
+	if err := json.Unmarshal([]byte(fileContent), &records); err != nil {
+		return nil, fmt.Errorf("invalid json array: %v", err)
+	}
+	return recordsToTable(records)
+}
+
+// ParseNDJSONTable reads one flat JSON object per line into a table.
+func ParseNDJSONTable(fileContent string) (map[string][]string, error) {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(strings.NewReader(fileContent))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &record); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recordsToTable(records)
+}
+
+func recordsToTable(records []map[string]interface{}) (map[string][]string, error) {
+	if len(records) == 0 {
+		return nil, errors.New("file contains no records")
+	}
+
+	var headers []string
+	seen := map[string]bool{}
+	for _, record := range records {
+		for key := range record {
+			column := canonicalColumn(key)
+			if !seen[column] {
+				seen[column] = true
+				headers = append(headers, column)
+			}
+		}
+	}
+
+	table := make(map[string][]string, len(headers))
+	for i, record := range records {
+		values := make(map[string]string, len(record))
+		for key, value := range record {
+			text, err := cellString(value)
+			if err != nil {
+				return nil, fmt.Errorf("record %d, field %q: %v", i+1, key, err)
+			}
+			if _, ok := values[canonicalColumn(key)]; ok {
+				return nil, fmt.Errorf("record %d has duplicate field %q", i+1, canonicalColumn(key))
+			}
+			values[canonicalColumn(key)] = text
+		}
+		for _, column := range headers {
+			value, ok := values[column]
+			if !ok {
+				return nil, fmt.Errorf("record %d is missing %q", i+1, column)
+			}
+			table[column] = append(table[column], value)
+		}
+	}
+	return table, nil
+}
+
+func canonicalColumn(name string) string {
+	name = strings.TrimSpace(name)
+	for _, column := range EnergyColumns {
+		if strings.EqualFold(name, column) {
+			return column
+		}
+	}
+	return name
+}
+
+func cellString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return strings.TrimSpace(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", errors.New("nested values are not supported")
+	}
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	Text string `xml:"t"`
+	Runs []struct {
+		Text string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.Text
+	}
+	var sb strings.Builder
+	for _, run := range t.Runs {
+		sb.WriteString(run.Text)
+	}
+	return sb.String()
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string   `xml:"r,attr"`
+			Type   string   `xml:"t,attr"`
+			Value  string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// MaxXLSXPartBytes caps the uncompressed size of each part of an .xlsx
+// workbook read by ParseXLSXTable.
+var MaxXLSXPartBytes int64 = 256 << 20
+
+// ParseXLSXTable reads the named sheet, or the first sheet when sheet is
+// empty, of an .xlsx workbook into a table using its first row as header.
+// Numeric Date and Time cells are converted from Excel serial values; a Time
+// cell holding a date and time keeps only the time, and a time that rounds
+// up to midnight moves the row's date to the next day.
+func ParseXLSXTable(fileContent, sheet string) (map[string][]string, error) {
+	archive, err := zip.NewReader(strings.NewReader(fileContent), int64(len(fileContent)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid xlsx file: %v", err)
+	}
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, file := range archive.File {
+		files[file.Name] = file
+	}
+
+	var workbook xlsxWorkbook
+	if err := decodeZipXML(files, "xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := decodeZipXML(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	if len(workbook.Sheets) == 0 {
+		return nil, errors.New("xlsx workbook has no sheets")
+	}
+
+	relID := ""
+	for _, s := range workbook.Sheets {
+		if sheet == "" || s.Name == sheet {
+			relID = s.ID
+			break
+		}
+	}
+	if relID == "" {
+		return nil, fmt.Errorf("xlsx workbook has no sheet named %q", sheet)
+	}
+	sheetPath := ""
+	for _, rel := range rels.Relationships {
+		if rel.ID == relID {
+			sheetPath = rel.Target
+		}
+	}
+	if strings.HasPrefix(sheetPath, "/") {
+		sheetPath = strings.TrimPrefix(sheetPath, "/")
+	} else {
+		sheetPath = path.Join("xl", sheetPath)
+	}
+
+	var shared []string
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		var sst struct {
+			Items []xlsxText `xml:"si"`
+		}
+		if err := decodeZipXML(files, "xl/sharedStrings.xml", &sst); err != nil {
+			return nil, err
+		}
+		for _, item := range sst.Items {
+			shared = append(shared, item.String())
+		}
+	}
+
+	var data xlsxSheet
+	if err := decodeZipXML(files, sheetPath, &data); err != nil {
+		return nil, err
+	}
+
+	var rows [][]string
+	for _, row := range data.Rows {
+		var values []string
+		for position, cell := range row.Cells {
+			column := position
+			if index := xlsxColumnIndex(cell.Ref); index >= 0 {
+				column = index
+			}
+			for len(values) <= column {
+				values = append(values, "")
+			}
+			switch cell.Type {
+			case "s":
+				index, err := strconv.Atoi(cell.Value)
+				if err != nil || index < 0 || index >= len(shared) {
+					return nil, fmt.Errorf("xlsx cell %s has an invalid shared string", cell.Ref)
+				}
+				values[column] = shared[index]
+			case "inlineStr":
+				values[column] = cell.Inline.String()
+			default:
+				values[column] = cell.Value
+			}
+		}
+		if strings.TrimSpace(strings.Join(values, "")) != "" {
+			rows = append(rows, values)
+		}
+	}
+	if len(rows) < 1 {
+		return nil, errors.New("xlsx sheet is empty or missing header")
+	}
+
+	headers := rows[0]
+	seen := make(map[string]bool, len(headers))
+	for _, header := range headers {
+		if seen[canonicalColumn(header)] {
+			return nil, fmt.Errorf("xlsx sheet has duplicate column %q", canonicalColumn(header))
+		}
+		seen[canonicalColumn(header)] = true
+	}
+	table := make(map[string][]string, len(headers))
+	for i, row := range rows[1:] {
+		for len(row) < len(headers) {
+			row = append(row, "")
+		}
+		if len(row) > len(headers) && strings.TrimSpace(strings.Join(row[len(headers):], "")) != "" {
+			return nil, fmt.Errorf("xlsx row %d has more cells than the header", i+2)
+		}
+		nextDay := false
+		for j, header := range headers {
+			column := canonicalColumn(header)
+			value := strings.TrimSpace(row[j])
+			if serial, err := strconv.ParseFloat(value, 64); err == nil {
+				if column == ColumnDate {
+					value = excelEpoch.Add(time.Duration(math.Floor(serial)) * 24 * time.Hour).Format(dateLayout)
+				} else if column == ColumnTime && serial >= 0 {
+					// A date and time serial keeps the time in its fraction.
+					minutes := int(math.Round((serial - math.Floor(serial)) * 24 * 60))
+					nextDay = minutes == 24*60
+					value = fmt.Sprintf("%02d:%02d", minutes/60%24, minutes%60)
+				}
+			}
+			table[column] = append(table[column], value)
+		}
+		if dates := table[ColumnDate]; nextDay && len(dates) == i+1 {
+			if day, err := time.Parse(dateLayout, dates[i]); err == nil {
+				dates[i] = day.AddDate(0, 0, 1).Format(dateLayout)
+			}
+		}
+	}
+	for _, header := range headers {
+		if _, ok := table[canonicalColumn(header)]; !ok {
+			table[canonicalColumn(header)] = []string{}
+		}
+	}
+	return table, nil
+}
+
+// excelEpoch is day zero of Excel's 1900 date system (serial 1 is 1900-01-01,
+// shifted by the fictitious 1900-02-29).
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+func xlsxColumnIndex(ref string) int {
+	index := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A'+1)
+	}
+	return index - 1
+}
+
+func decodeZipXML(files map[string]*zip.File, name string, v interface{}) error {
+	file, ok := files[name]
+	if !ok {
+		return fmt.Errorf("xlsx file is missing %s", name)
+	}
+	tooLarge := fmt.Errorf("xlsx part %s is larger than %d bytes uncompressed", name, MaxXLSXPartBytes)
+	if file.UncompressedSize64 > uint64(MaxXLSXPartBytes) {
+		return tooLarge
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	limited := &io.LimitedReader{R: reader, N: MaxXLSXPartBytes + 1}
+	err = xml.NewDecoder(limited).Decode(v)
+	if limited.N <= 0 {
+		return tooLarge
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/goalRepository"
+)
+
+// Alert severities, from least to most urgent.
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert kinds produced by GoalService.Evaluate.
+const (
+	AlertMonthlyKWh   = "monthly_kwh"
+	AlertMonthlyCost  = "monthly_cost"
+	AlertApplianceCap = "appliance_cap"
+)
+
+// infoThreshold is the share of a limit that the projection must reach before
+// an informational alert is raised.
+const infoThreshold = 0.9
+
+type GoalService struct {
+	Repo *repository.GoalRepository
+}
+
+// SetBudget validates and stores the household's budget.
+func (s *GoalService) SetBudget(household string, budget model.Budget) error {
+	if budget.MonthlyKWh < 0 || budget.MonthlyCost < 0 || budget.PricePerKWh < 0 {
+		return errors.New("budget values must not be negative")
+	}
+	if budget.MonthlyCost > 0 && budget.PricePerKWh == 0 {
+		return errors.New("price_per_kwh is required for a cost budget")
+	}
+	for appliance, limit := range budget.ApplianceCaps {
+		if limit <= 0 {
+			return fmt.Errorf("cap for %q must be positive", appliance)
+		}
+	}
+	if budget.MonthlyKWh == 0 && budget.MonthlyCost == 0 && len(budget.ApplianceCaps) == 0 {
+		return errors.New("budget has no goals")
+	}
+	s.Repo.SaveBudget(household, budget)
+	return nil
+}
+
+// Evaluate checks the household's budget against the month of its most recent
+// reading. Usage so far is extrapolated to the whole month from the days
+// observed, from the month's first reading to its latest, so data that starts
+// mid-month is not underestimated, and the resulting alerts are stored as the
+// latest alerts.
+func (s *GoalService) Evaluate(household string, readings []model.Reading) ([]model.BudgetAlert, error) {
+	budget, ok := s.Repo.GetBudget(household)
+	if !ok || len(readings) == 0 {
+		return nil, nil
+	}
+
+	var latest time.Time
+	days := make([]time.Time, len(readings))
+	for i, r := range readings {
+		day, err := time.Parse(dateLayout, r.Date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", r.Date)
+		}
+		if day.After(latest) {
+			latest = day
+		}
+		days[i] = day
+	}
+	month := latest.Format("2006-01")
+	daysInMonth := time.Date(latest.Year(), latest.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	total := 0.0
+	byAppliance := map[string]float64{}
+	first := latest
+	for i, r := range readings {
+		if r.Date[:7] != month {
+			continue
+		}
+		total += r.EnergyConsumption
+		byAppliance[r.Appliance] += r.EnergyConsumption
+		if days[i].Before(first) {
+			first = days[i]
+		}
+	}
+	observed := latest.Day() - first.Day() + 1
+	scale := float64(daysInMonth) / float64(observed)
+
+	var alerts []model.BudgetAlert
+	check := func(kind, appliance string, limit, used float64) {
+		if limit <= 0 {
+			return
+		}
+		alert := model.BudgetAlert{
+			Household: household,
+			Kind:      kind,
+			Appliance: appliance,
+			Month:     month,
+			Limit:     limit,
+			Used:      used,
+			Projected: used * scale,
+		}
+		switch {
+		case used >= limit:
+			alert.Severity = SeverityCritical
+		case alert.Projected > limit:
+			alert.Severity = SeverityWarning
+		case alert.Projected >= limit*infoThreshold:
+			alert.Severity = SeverityInfo
+		default:
+			return
+		}
+		if alert.Projected > limit {
+			alert.ProjectedOverrun = alert.Projected - limit
+		}
+		alerts = append(alerts, alert)
+	}
+
+	check(AlertMonthlyKWh, "", budget.MonthlyKWh, total)
+	check(AlertMonthlyCost, "", budget.MonthlyCost, total*budget.PricePerKWh)
+
+	appliances := make([]string, 0, len(budget.ApplianceCaps))
+	for appliance := range budget.ApplianceCaps {
+		appliances = append(appliances, appliance)
+	}
+	sort.Strings(appliances)
+	for _, appliance := range appliances {
+		check(AlertApplianceCap, appliance, budget.ApplianceCaps[appliance], byAppliance[appliance])
+	}
+
+	s.Repo.SaveAlerts(household, alerts)
+	return alerts, nil
+}
@@ -0,0 +1,275 @@
+// Package hftest provides a fake Hugging Face inference API for tests. It
+// imitates the Tapas table question answering, chat completions and
+// translation endpoints the service package calls, answering from recorded
+// fixtures first and from deterministic built-in responses otherwise.
+//
+// Setting HF_RECORD_TOKEN puts the server in record mode: requests without
+// a fixture are forwarded to the real API with that token and the responses
+// are saved to the fixtures file when the server is closed.
+package hftest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// RecordTokenEnv names the environment variable that enables record mode.
+const RecordTokenEnv = "HF_RECORD_TOKEN"
+
+// DefaultUpstream is the API record mode forwards to.
+const DefaultUpstream = "https://api-inference.huggingface.co"
+
+// Exchange is a recorded request and the response to it. Bodies are compared
+// as JSON, so key order and spacing do not matter.
+type Exchange struct {
+	Method   string          `json:"method"`
+	Path     string          `json:"path"`
+	Body     json.RawMessage `json:"body,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+// Server is a running fake inference API. Point AIService.Endpoint and
+// NewTranslationServiceAt at URL.
+type Server struct {
+	*httptest.Server
+
+	// ChatReply, when set, produces the assistant message for chat requests
+	// without a fixture. The default repeats the last user message.
+	ChatReply func(messages []model.ChatMessage) model.ChatMessage
+	// Upstream is the API record mode forwards to.
+	Upstream string
+
+	fixtures    string
+	recordToken string
+
+	mu        sync.Mutex
+	exchanges []Exchange
+	recorded  int
+	requests  int
+}
+
+// NewServer starts a fake server that answers from the fixtures file, which
+// may be empty or not exist yet.
+func NewServer(fixtures string) (*Server, error) {
+	s := &Server{Upstream: DefaultUpstream, fixtures: fixtures, recordToken: os.Getenv(RecordTokenEnv)}
+	if fixtures != "" {
+		content, err := ioutil.ReadFile(fixtures)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if len(content) > 0 {
+			if err := json.Unmarshal(content, &s.exchanges); err != nil {
+				return nil, fmt.Errorf("invalid fixtures %s: %v", fixtures, err)
+			}
+		}
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s, nil
+}
+
+// Close stops the server and, in record mode, saves new exchanges to the
+// fixtures file.
+func (s *Server) Close() error {
+	s.Server.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recorded == 0 || s.fixtures == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(s.exchanges, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.fixtures, append(content, '\n'), 0644)
+}
+
+// Requests returns how many requests the server has answered.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	canonical := canonicalJSON(body)
+
+	s.mu.Lock()
+	s.requests++
+	for _, exchange := range s.exchanges {
+		if exchange.Method == r.Method && exchange.Path == r.URL.Path && canonicalJSON(exchange.Body) == canonical {
+			s.mu.Unlock()
+			writeJSON(w, exchange.Status, exchange.Response)
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	if s.recordToken != "" {
+		s.record(w, r, body)
+		return
+	}
+
+	status, response := s.fake(r.URL.Path, body)
+	writeJSON(w, status, response)
+}
+
+// record forwards a request to the real API and keeps the exchange.
+func (s *Server) record(w http.ResponseWriter, r *http.Request, body []byte) {
+	req, err := http.NewRequest(r.Method, s.Upstream+r.URL.Path, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+s.recordToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	exchange := Exchange{Method: r.Method, Path: r.URL.Path, Status: resp.StatusCode, Response: response}
+	if len(body) > 0 {
+		exchange.Body = json.RawMessage(canonicalJSON(body))
+	}
+	if !json.Valid(response) {
+		exchange.Response, _ = json.Marshal(string(response))
+	}
+	s.mu.Lock()
+	s.exchanges = append(s.exchanges, exchange)
+	s.recorded++
+	s.mu.Unlock()
+	writeJSON(w, resp.StatusCode, exchange.Response)
+}
+
+// fake answers a request without a fixture: translations echo their input,
+// Tapas answers with the first cell of the first column and chat with
+// ChatReply.
+func (s *Server) fake(path string, body []byte) (int, json.RawMessage) {
+	switch {
+	case strings.HasSuffix(path, "/v1/chat/completions"):
+		var request struct {
+			Messages []model.ChatMessage `json:"messages"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			return errorResponse(http.StatusBadRequest, err.Error())
+		}
+		reply := s.chatReply(request.Messages)
+		prompt := 0
+		for _, message := range request.Messages {
+			prompt += len(strings.Fields(message.Content))
+		}
+		return marshal(map[string]interface{}{
+			"model":   strings.TrimSuffix(strings.TrimPrefix(path, "/models/"), "/v1/chat/completions"),
+			"choices": []interface{}{map[string]interface{}{"index": 0, "message": reply, "finish_reason": "stop"}},
+			"usage": map[string]int{
+				"prompt_tokens":     prompt,
+				"completion_tokens": len(strings.Fields(reply.Content)),
+				"total_tokens":      prompt + len(strings.Fields(reply.Content)),
+			},
+		})
+
+	case strings.HasPrefix(path, "/models/Helsinki-NLP/opus-mt-"):
+		var request struct {
+			Inputs []string `json:"inputs"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil || len(request.Inputs) == 0 {
+			return errorResponse(http.StatusBadRequest, "inputs are required")
+		}
+		var translations []map[string]string
+		for _, input := range request.Inputs {
+			translations = append(translations, map[string]string{"translation_text": input})
+		}
+		return marshal(translations)
+
+	case strings.HasPrefix(path, "/models/google/tapas"):
+		var request model.AIRequest
+		if err := json.Unmarshal(body, &request); err != nil || len(request.Inputs.Table) == 0 {
+			return errorResponse(http.StatusBadRequest, "a table is required")
+		}
+		columns := make([]string, 0, len(request.Inputs.Table))
+		for column := range request.Inputs.Table {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		cell := ""
+		if values := request.Inputs.Table[columns[0]]; len(values) > 0 {
+			cell = values[0]
+		}
+		return marshal(map[string]interface{}{
+			"answer":      cell,
+			"coordinates": [][]int{{0, 0}},
+			"cells":       []string{cell},
+			"aggregator":  "NONE",
+		})
+	}
+	return errorResponse(http.StatusNotFound, "Model "+strings.TrimPrefix(path, "/models/")+" does not exist")
+}
+
+func (s *Server) chatReply(messages []model.ChatMessage) model.ChatMessage {
+	if s.ChatReply != nil {
+		return s.ChatReply(messages)
+	}
+	last := ""
+	for _, message := range messages {
+		if message.Role == "user" {
+			last = message.Content
+		}
+	}
+	return model.ChatMessage{Role: "assistant", Content: "Fake reply to: " + last}
+}
+
+func errorResponse(status int, message string) (int, json.RawMessage) {
+	_, body := marshal(map[string]string{"error": message})
+	return status, body
+}
+
+func marshal(v interface{}) (int, json.RawMessage) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return errorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return http.StatusOK, body
+}
+
+func writeJSON(w http.ResponseWriter, status int, body json.RawMessage) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// canonicalJSON re-encodes JSON with sorted keys and no spacing. Bodies that
+// are not JSON are returned as they are.
+func canonicalJSON(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return string(body)
+	}
+	canonical, _ := json.Marshal(v)
+	return string(canonical)
+}
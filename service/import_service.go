@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Importer converts a foreign export format into energy readings.
+type Importer interface {
+	Name() string
+	Detect(fileContent string) bool
+	Convert(fileContent string) ([]model.Reading, model.ConversionReport, error)
+}
+
+// ImporterRegistry holds the importers FileService.ImportFile chooses from.
+// Importers are tried in registration order.
+type ImporterRegistry struct {
+	importers []Importer
+}
+
+func NewImporterRegistry(importers ...Importer) *ImporterRegistry {
+	return &ImporterRegistry{importers: importers}
+}
+
+// NewDefaultImporterRegistry registers every built-in importer.
+func NewDefaultImporterRegistry(mapping model.ImportMapping) *ImporterRegistry {
+	return NewImporterRegistry(
+		&HomeAssistantImporter{Mapping: mapping.HomeAssistant},
+		&GreenButtonImporter{Mapping: mapping.GreenButton},
+	)
+}
+
+func (r *ImporterRegistry) Register(importer Importer) {
+	r.importers = append(r.importers, importer)
+}
+
+// Get returns the importer with the given name.
+func (r *ImporterRegistry) Get(name string) (Importer, bool) {
+	for _, importer := range r.importers {
+		if importer.Name() == name {
+			return importer, true
+		}
+	}
+	return nil, false
+}
+
+// Detect returns the first importer that recognizes the content.
+func (r *ImporterRegistry) Detect(fileContent string) (Importer, bool) {
+	for _, importer := range r.importers {
+		if importer.Detect(fileContent) {
+			return importer, true
+		}
+	}
+	return nil, false
+}
+
+// ImportFile turns an uploaded file into a table. Text is first decoded to
+// UTF-8 (see DecodeText). The format comes from options.Format or is sniffed
+// from the content: .xlsx workbooks, JSON arrays and NDJSON are read as
+// tables, text recognized by a registered importer is converted, and any
+// other text is parsed by ProcessCSV in the detected or overridden dialect.
+// Tables that follow the energy schema are checked with ValidateTable
+// whatever their format and their times are resolved in options.TimeZone.
+// When options.Cleaning is set, negative energy values are clamped before
+// validation and counted in the report's Cleaning; the rest of the cleaning
+// stage runs after unit normalization (see CleanTable). The report says how
+// the file was read.
+func (s *FileService) ImportFile(fileContent string, options model.ImportOptions) (map[string][]string, *model.ConversionReport, error) {
+	format := options.Format
+	if format == "" {
+		format = SniffFormat(fileContent)
+	}
+
+	encoding := ""
+	if format != FormatXLSX {
+		text, name, err := DecodeText(fileContent, options.Encoding)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileContent, encoding = text, name
+		if options.Format == "" && format == FormatCSV && s.Importers != nil {
+			if importer, ok := s.Importers.Detect(fileContent); ok {
+				format = importer.Name()
+			}
+		}
+	}
+
+	var (
+		table  map[string][]string
+		report *model.ConversionReport
+		err    error
+	)
+	switch format {
+	case FormatCSV:
+		var dialect model.CSVDialect
+		dialect, err = DetectDialect(fileContent, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialect.Encoding = encoding
+		table, err = s.ProcessCSV(fileContent, dialect)
+		report = &model.ConversionReport{Dialect: &dialect}
+	case FormatJSON:
+		table, err = ParseJSONTable(fileContent)
+	case FormatNDJSON:
+		table, err = ParseNDJSONTable(fileContent)
+	case FormatXLSX:
+		table, err = ParseXLSXTable(fileContent, options.Sheet)
+	default:
+		table, report, err = s.importWith(format, fileContent)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	loc, err := ImportZone(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clamped := 0
+	if options.Cleaning != nil {
+		clamped = ClampNegativeEnergy(table)
+	}
+	table, err = ValidateTable(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	table, err = LocalizeTable(table, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if report == nil {
+		report = &model.ConversionReport{}
+	}
+	if report.Format == "" {
+		report.Format = format
+		report.RowsRead = rowCount(table)
+		report.RowsConverted = report.RowsRead
+	}
+
+	if options.Cleaning != nil {
+		report.Cleaning = &model.CleaningReport{NegativesClamped: clamped}
+	}
+	return table, report, nil
+}
+
+// ImportZone returns the time zone named by options.TimeZone, UTC when it is
+// empty.
+func ImportZone(options model.ImportOptions) (*time.Location, error) {
+	if options.TimeZone == "" {
+		return time.UTC, nil
+	}
+	return LoadZone(options.TimeZone)
+}
+
+func rowCount(table map[string][]string) int {
+	for _, values := range table {
+		return len(values)
+	}
+	return 0
+}
+
+func (s *FileService) importWith(format, fileContent string) (map[string][]string, *model.ConversionReport, error) {
+	var importer Importer
+	if s.Importers != nil {
+		importer, _ = s.Importers.Get(format)
+	}
+	if importer == nil {
+		return nil, nil, fmt.Errorf("unknown import format %q", format)
+	}
+
+	readings, report, err := importer.Convert(fileContent)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(readings) == 0 {
+		return nil, nil, fmt.Errorf("%s export contains no usable readings", importer.Name())
+	}
+	return ReadingsToTable(readings), &report, nil
+}
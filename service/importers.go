@@ -0,0 +1,280 @@
+package service
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// HomeAssistantImporter reads Home Assistant history exports with the
+// columns entity_id, state and last_changed. Home Assistant energy sensors
+// report a cumulative meter reading and power sensors an instantaneous
+// power, so the states of each entity are normalized in time order: energy
+// states are differenced and power states integrated over the time to the
+// previous sample. Home Assistant records a state only when it changes, so
+// each power state is held until the next one however long that is. The
+// first state of an entity only starts its series and becomes a zero
+// reading. Other states such as "unavailable" are skipped.
+type HomeAssistantImporter struct {
+	Mapping model.HomeAssistantMapping
+}
+
+func (i *HomeAssistantImporter) Name() string {
+	return "home_assistant"
+}
+
+func (i *HomeAssistantImporter) Detect(fileContent string) bool {
+	header := strings.ToLower(strings.SplitN(fileContent, "\n", 2)[0])
+	return strings.Contains(header, "entity_id") && strings.Contains(header, "state") && strings.Contains(header, "last_changed")
+}
+
+func (i *HomeAssistantImporter) Convert(fileContent string) ([]model.Reading, model.ConversionReport, error) {
+	report := model.ConversionReport{Format: i.Name()}
+	rows, err := csv.NewReader(strings.NewReader(fileContent)).ReadAll()
+	if err != nil {
+		return nil, report, err
+	}
+	if len(rows) < 1 {
+		return nil, report, errors.New("home assistant export is empty")
+	}
+
+	columns := map[string]int{}
+	for index, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = index
+	}
+	for _, name := range []string{"entity_id", "state", "last_changed"} {
+		if _, ok := columns[name]; !ok {
+			return nil, report, fmt.Errorf("home assistant export is missing the %s column", name)
+		}
+	}
+
+	defaultRoom := i.Mapping.DefaultRoom
+	if defaultRoom == "" {
+		defaultRoom = "Unknown"
+	}
+	unmapped := map[string]bool{}
+	entities := map[string]model.EntityMapping{}
+	units := map[string]model.SourceUnit{}
+	var readings []model.Reading
+	for _, row := range rows[1:] {
+		report.RowsRead++
+		entityID := strings.TrimSpace(row[columns["entity_id"]])
+		state := strings.TrimSpace(row[columns["state"]])
+		energy, err := strconv.ParseFloat(state, 64)
+		if err != nil || math.IsNaN(energy) {
+			report.RowsSkipped++
+			continue
+		}
+		changed, err := time.Parse(time.RFC3339, strings.TrimSpace(row[columns["last_changed"]]))
+		if err != nil {
+			report.RowsSkipped++
+			report.Warnings = append(report.Warnings, fmt.Sprintf("row %d: invalid last_changed %q", report.RowsRead, row[columns["last_changed"]]))
+			continue
+		}
+
+		entity, ok := i.Mapping.Entities[entityID]
+		if !ok && !unmapped[entityID] {
+			unmapped[entityID] = true
+			report.Warnings = append(report.Warnings, fmt.Sprintf("entity %s has no mapping; using appliance %q", entityID, applianceFromEntity(entityID)))
+		}
+		if entity.Appliance == "" {
+			entity.Appliance = applianceFromEntity(entityID)
+		}
+		if entity.Room == "" {
+			entity.Room = defaultRoom
+		}
+		if _, ok := units[entityID]; !ok {
+			unit, err := entityUnit(entityID, entity.Unit)
+			if err != nil {
+				return nil, report, err
+			}
+			units[entityID] = unit
+		}
+		entities[entityID] = entity
+
+		// Readings carry the entity ID until they are normalized so every
+		// entity is its own meter.
+		readings = append(readings, newImportedReading(changed, entityID, entity.Room, energy))
+	}
+
+	sort.SliceStable(readings, func(a, b int) bool {
+		return readings[a].Timestamp.Before(readings[b].Timestamp)
+	})
+	normalizer := &Normalizer{units: units, samples: map[string]model.MeterSample{}, stepwise: true}
+	normalized := make([]model.Reading, 0, len(readings))
+	for _, reading := range readings {
+		reading, ok := normalizer.Next(reading)
+		if !ok {
+			report.RowsSkipped++
+			continue
+		}
+		entity := entities[reading.Appliance]
+		normalized = append(normalized, newImportedReading(reading.Timestamp, entity.Appliance, entity.Room, reading.EnergyConsumption))
+		report.RowsConverted++
+	}
+	if len(normalized) > 0 {
+		report.Normalization = &normalizer.Report
+	}
+	return normalized, report, nil
+}
+
+// entityUnit returns the unit of a Home Assistant entity: the mapped unit, or
+// W for entities whose ID names power and kWh otherwise. Energy units are
+// cumulative, as Home Assistant energy sensors are.
+func entityUnit(entityID, mapped string) (model.SourceUnit, error) {
+	unit := model.SourceUnit{Appliance: entityID, Unit: mapped}
+	if unit.Unit == "" {
+		unit.Unit = UnitKWh
+		if strings.Contains(strings.ToLower(entityID), "power") {
+			unit.Unit = UnitW
+		}
+	}
+	switch strings.ToLower(unit.Unit) {
+	case "kwh":
+		unit.Unit, unit.Cumulative = UnitKWh, true
+	case "wh":
+		unit.Unit, unit.Cumulative = UnitWh, true
+	case "w":
+		unit.Unit = UnitW
+	case "kw":
+		unit.Unit = UnitKW
+	default:
+		return unit, fmt.Errorf("entity %s: unit must be kWh, Wh, W or kW, got %q", entityID, unit.Unit)
+	}
+	return unit, nil
+}
+
+// GreenButtonImporter reads Green Button (ESPI) XML downloads. Every
+// IntervalReading becomes one reading at its start time, scaled by the
+// ReadingType's powerOfTenMultiplier and converted from Wh to kWh.
+type GreenButtonImporter struct {
+	Mapping model.GreenButtonMapping
+}
+
+// espiWattHours is the ESPI unit-of-measure code for Wh.
+const espiWattHours = 72
+
+type espiReadingType struct {
+	UOM                  int `xml:"uom"`
+	PowerOfTenMultiplier int `xml:"powerOfTenMultiplier"`
+}
+
+type espiIntervalReading struct {
+	TimePeriod struct {
+		Duration int64 `xml:"duration"`
+		Start    int64 `xml:"start"`
+	} `xml:"timePeriod"`
+	Value int64 `xml:"value"`
+}
+
+func (i *GreenButtonImporter) Name() string {
+	return "green_button"
+}
+
+func (i *GreenButtonImporter) Detect(fileContent string) bool {
+	trimmed := strings.TrimSpace(fileContent)
+	return strings.HasPrefix(trimmed, "<") && (strings.Contains(trimmed, "naesb.org/espi") || strings.Contains(trimmed, "IntervalReading"))
+}
+
+func (i *GreenButtonImporter) Convert(fileContent string) ([]model.Reading, model.ConversionReport, error) {
+	report := model.ConversionReport{Format: i.Name()}
+	appliance := i.Mapping.Appliance
+	if appliance == "" {
+		appliance = "Whole Home"
+	}
+	room := i.Mapping.Room
+	if room == "" {
+		room = "Home"
+	}
+
+	readingType := espiReadingType{UOM: espiWattHours}
+	var intervals []espiIntervalReading
+	decoder := xml.NewDecoder(strings.NewReader(fileContent))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, report, fmt.Errorf("invalid green button xml: %v", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "ReadingType":
+			if err := decoder.DecodeElement(&readingType, &start); err != nil {
+				return nil, report, fmt.Errorf("invalid ReadingType: %v", err)
+			}
+		case "IntervalReading":
+			var interval espiIntervalReading
+			if err := decoder.DecodeElement(&interval, &start); err != nil {
+				return nil, report, fmt.Errorf("invalid IntervalReading: %v", err)
+			}
+			intervals = append(intervals, interval)
+		}
+	}
+
+	if readingType.UOM != espiWattHours {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("unit of measure %d is not Wh (72); values are treated as Wh", readingType.UOM))
+	}
+	scale := math.Pow10(readingType.PowerOfTenMultiplier) / 1000
+
+	readings := make([]model.Reading, 0, len(intervals))
+	for _, interval := range intervals {
+		report.RowsRead++
+		if interval.Value < 0 {
+			report.RowsSkipped++
+			report.Warnings = append(report.Warnings, fmt.Sprintf("interval at %d has negative value %d", interval.TimePeriod.Start, interval.Value))
+			continue
+		}
+		start := time.Unix(interval.TimePeriod.Start, 0)
+		readings = append(readings, newImportedReading(start, appliance, room, float64(interval.Value)*scale))
+		report.RowsConverted++
+	}
+	return readings, report, nil
+}
+
+func newImportedReading(at time.Time, appliance, room string, energy float64) model.Reading {
+	status := "Off"
+	if energy > 0 {
+		status = "On"
+	}
+	at = at.UTC()
+	return model.Reading{
+		Date:              at.Format(dateLayout),
+		Time:              at.Format("15:04"),
+		Appliance:         appliance,
+		EnergyConsumption: energy,
+		Room:              room,
+		Status:            status,
+		Timestamp:         at,
+	}
+}
+
+// applianceFromEntity derives a display name from a Home Assistant entity ID,
+// e.g. "sensor.washing_machine_energy" becomes "Washing Machine".
+func applianceFromEntity(entityID string) string {
+	name := entityID
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, suffix := range []string{"_energy", "_consumption", "_power", "_kwh"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	words := strings.Fields(strings.ReplaceAll(name, "_", " "))
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/datasetRepository"
+)
+
+// readingKeyColumns identify a reading for deduplication: one value per
+// appliance and timestamp. Timestamp keeps apart the two readings of an hour
+// repeated when clocks fall back.
+var readingKeyColumns = []string{ColumnAppliance, ColumnDate, ColumnTime, ColumnTimestamp}
+
+// IngestService appends device readings to a household's live dataset.
+// Readings are placed in the household's time zone when Households is set and
+// converted to kWh per interval when Units is set.
+type IngestService struct {
+	Repo       *repository.DatasetRepository
+	Households *HouseholdService
+	Units      *UnitService
+}
+
+// DecodeReadings reads a single JSON reading, a JSON array of readings or
+// NDJSON (one reading per line). NDJSON is chosen by an application/x-ndjson
+// or application/ndjson content type, JSON otherwise.
+func DecodeReadings(body io.Reader, contentType string) ([]model.Reading, error) {
+	if strings.Contains(contentType, "ndjson") {
+		var readings []model.Reading
+		scanner := bufio.NewScanner(body)
+		line := 0
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			var reading model.Reading
+			if err := json.Unmarshal([]byte(text), &reading); err != nil {
+				// A read error cuts the last line short; report it instead.
+				if err := scanner.Err(); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			readings = append(readings, reading)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return readings, nil
+	}
+
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, errors.New("request body is empty")
+	}
+	if content[0] == '[' {
+		var readings []model.Reading
+		if err := json.Unmarshal(content, &readings); err != nil {
+			return nil, err
+		}
+		return readings, nil
+	}
+	var reading model.Reading
+	if err := json.Unmarshal(content, &reading); err != nil {
+		return nil, err
+	}
+	return []model.Reading{reading}, nil
+}
+
+// Ingest validates the readings and appends the valid ones that are not yet
+// in the household's dataset. Invalid readings, and readings whose time cannot
+// be placed in the household's time zone, are reported, not stored.
+func (s *IngestService) Ingest(household string, readings []model.Reading) model.IngestReport {
+	valid, report := s.validate(household, readings)
+	if s.Units != nil {
+		valid, report.Normalization = s.Units.Normalize(household, valid)
+	}
+	if len(valid) > 0 {
+		report.Accepted = s.Repo.AppendUnique(household, ReadingsToTable(valid), readingKeyColumns)
+	}
+	report.Duplicates = len(valid) - report.Accepted
+	return report
+}
+
+// Replace validates the readings like Ingest and replaces the household's
+// dataset with them, dropping repeated readings. Readings are stored in kWh
+// per interval as they are sent, the form the dataset is returned in, so
+// source units do not apply. Nothing is stored when any reading is rejected.
+func (s *IngestService) Replace(household string, readings []model.Reading) model.IngestReport {
+	valid, report := s.validate(household, readings)
+	if len(report.Rejected) > 0 {
+		return report
+	}
+	report.Accepted = s.Repo.Replace(household, ReadingsToTable(valid), readingKeyColumns)
+	report.Duplicates = len(valid) - report.Accepted
+	return report
+}
+
+// Store appends the rows of an uploaded table that are not yet in the
+// household's dataset and returns how many were added. Only tables that
+// follow the energy schema and pass ValidateTable are stored, so a stored
+// dataset can always be read as readings.
+func (s *IngestService) Store(household string, table map[string][]string) (int, error) {
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return 0, fmt.Errorf("missing column %q", column)
+		}
+	}
+	table, err := ValidateTable(table)
+	if err != nil {
+		return 0, err
+	}
+	return s.Repo.AppendUnique(household, table, readingKeyColumns), nil
+}
+
+// validate returns the valid readings, placed in the household's time zone,
+// and a report listing the rejected ones.
+func (s *IngestService) validate(household string, readings []model.Reading) ([]model.Reading, model.IngestReport) {
+	report := model.IngestReport{Received: len(readings)}
+	valid := make([]model.Reading, 0, len(readings))
+	var resolver *timeResolver
+	if s.Households != nil {
+		// Devices send readings in order, so a batch is one series.
+		resolver = newTimeResolver(s.Households.Location(household))
+	}
+	for i := range readings {
+		reading := readings[i]
+		err := ValidateReading(&reading)
+		if err == nil && resolver != nil {
+			err = resolver.resolve(&reading)
+		}
+		if err != nil {
+			report.Rejected = append(report.Rejected, model.IngestError{Index: i, Error: err.Error()})
+			continue
+		}
+		valid = append(valid, reading)
+	}
+	return valid, report
+}
@@ -0,0 +1,482 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// MQTT 3.1.1 control packet types used by MQTTClient.
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// DefaultMQTTMapping reads payloads shaped like the /ingest JSON readings.
+var DefaultMQTTMapping = model.MQTTMapping{
+	Household: "household",
+	Date:      "date",
+	Time:      "time",
+	Timestamp: "timestamp",
+	Appliance: "appliance",
+	Energy:    "energy_consumption",
+	Room:      "room",
+	Status:    "status",
+}
+
+// MQTTClient is a minimal MQTT 3.1.1 client: it connects, subscribes with
+// QoS 0 or 1, publishes with QoS 0 and acknowledges incoming QoS 1 messages.
+type MQTTClient struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	packetID  uint16
+	keepAlive time.Duration
+}
+
+// DialMQTT connects to broker ("host:port", optionally prefixed with
+// "tcp://" or "mqtt://") and completes the CONNECT handshake.
+func DialMQTT(broker, clientID, username, password string, keepAlive time.Duration) (*MQTTClient, error) {
+	broker = strings.TrimPrefix(strings.TrimPrefix(broker, "tcp://"), "mqtt://")
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", broker, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	client := &MQTTClient{conn: conn, reader: bufio.NewReader(conn), keepAlive: keepAlive}
+
+	var flags byte = 0x02 // clean session
+	var payload []byte
+	payload = appendMQTTString(payload, clientID)
+	if username != "" {
+		flags |= 0x80
+		payload = appendMQTTString(payload, username)
+		if password != "" {
+			flags |= 0x40
+			payload = appendMQTTString(payload, password)
+		}
+	}
+	header := appendMQTTString(nil, "MQTT")
+	header = append(header, 4, flags)
+	header = appendUint16(header, uint16(keepAlive/time.Second))
+	if err := client.writePacket(mqttConnect<<4, append(header, payload...)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	packetType, body, err := client.readPacket()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if packetType>>4 != mqttConnack || len(body) < 2 {
+		conn.Close()
+		return nil, errors.New("mqtt: expected CONNACK")
+	}
+	if body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt: connection refused with code %d", body[1])
+	}
+	return client, nil
+}
+
+// Subscribe subscribes to the topic filters with QoS 1 and waits up to 10
+// seconds for SUBACK. It must be called before Listen starts reading.
+func (c *MQTTClient) Subscribe(topics []string) error {
+	c.packetID++
+	body := appendUint16(nil, c.packetID)
+	for _, topic := range topics {
+		body = appendMQTTString(body, topic)
+		body = append(body, 1)
+	}
+	if err := c.writePacket(mqttSubscribe<<4|0x02, body); err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	for {
+		packetType, reply, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		if packetType>>4 != mqttSuback {
+			continue
+		}
+		// A SUBACK carries the packet ID and one return code per topic.
+		if len(reply) != 2+len(topics) {
+			return errors.New("mqtt: malformed SUBACK")
+		}
+		for i, code := range reply[2:] {
+			if code == 0x80 {
+				return fmt.Errorf("mqtt: subscription to %q was refused", topics[i])
+			}
+		}
+		return nil
+	}
+}
+
+// Publish sends a QoS 0 message.
+func (c *MQTTClient) Publish(topic string, payload []byte) error {
+	return c.writePacket(mqttPublish<<4, append(appendMQTTString(nil, topic), payload...))
+}
+
+// Listen reads messages until the connection fails or ctx is done, calling
+// handle for every PUBLISH and sending PINGREQ to keep the session alive.
+func (c *MQTTClient) Listen(ctx context.Context, handle func(topic string, payload []byte)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(c.keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				c.Close()
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+				c.writePacket(mqttPingreq<<4, nil)
+			}
+		}
+	}()
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		packetType, body, err := c.readPacket()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if packetType>>4 != mqttPublish {
+			continue
+		}
+
+		qos := (packetType >> 1) & 0x03
+		if len(body) < 2 {
+			return errors.New("mqtt: malformed PUBLISH")
+		}
+		topicLength := int(binary.BigEndian.Uint16(body))
+		if len(body) < 2+topicLength {
+			return errors.New("mqtt: malformed PUBLISH")
+		}
+		topic := string(body[2 : 2+topicLength])
+		payload := body[2+topicLength:]
+		if qos > 0 {
+			if len(payload) < 2 {
+				return errors.New("mqtt: malformed PUBLISH")
+			}
+			packetID := payload[:2]
+			payload = payload[2:]
+			if err := c.writePacket(mqttPuback<<4, packetID); err != nil {
+				return err
+			}
+		}
+		handle(topic, payload)
+	}
+}
+
+// Close sends DISCONNECT and closes the connection.
+func (c *MQTTClient) Close() error {
+	c.writePacket(mqttDisconnect<<4, nil)
+	return c.conn.Close()
+}
+
+func (c *MQTTClient) writePacket(header byte, body []byte) error {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	packet = append(packet, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(packet)
+	return err
+}
+
+func (c *MQTTClient) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		digit, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendMQTTString(buf []byte, s string) []byte {
+	buf = appendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// MQTTSubscriber feeds smart-plug telemetry from an MQTT broker into the
+// ingestion path. Handler receives the readings mapped from each message.
+type MQTTSubscriber struct {
+	Broker    string
+	ClientID  string
+	Username  string
+	Password  string
+	Topics    []string
+	Mapping   model.MQTTMapping
+	KeepAlive time.Duration
+	Handler   func(household string, readings []model.Reading)
+}
+
+// Run connects, subscribes and processes messages until ctx is done,
+// reconnecting with exponential backoff when the connection drops.
+func (s *MQTTSubscriber) Run(ctx context.Context) error {
+	if len(s.Topics) == 0 {
+		return errors.New("mqtt: no topics configured")
+	}
+	backoff := time.Second
+	for {
+		err := s.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("MQTT connection to %s lost: %v; retrying in %s\n", s.Broker, err, backoff)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *MQTTSubscriber) session(ctx context.Context) error {
+	client, err := DialMQTT(s.Broker, s.ClientID, s.Username, s.Password, s.KeepAlive)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.Subscribe(s.Topics); err != nil {
+		return err
+	}
+	log.Printf("MQTT subscribed to %s on %s\n", strings.Join(s.Topics, ", "), s.Broker)
+
+	return client.Listen(ctx, func(topic string, payload []byte) {
+		household, readings, err := MapMQTTPayload(topic, payload, s.Mapping, time.Now())
+		if err != nil {
+			log.Printf("MQTT message on %s skipped: %v\n", topic, err)
+			return
+		}
+		s.Handler(household, readings)
+	})
+}
+
+// MapMQTTPayload converts a JSON object, or an array of objects, into
+// readings using mapping. received stamps readings that carry no time.
+func MapMQTTPayload(topic string, payload []byte, mapping model.MQTTMapping, received time.Time) (string, []model.Reading, error) {
+	var decoded interface{}
+	if err := json.Unmarshal(payload, &decoded); err != nil {
+		return "", nil, fmt.Errorf("payload is not JSON: %v", err)
+	}
+	items, ok := decoded.([]interface{})
+	if !ok {
+		items = []interface{}{decoded}
+	}
+
+	topicParts := strings.Split(topic, "/")
+	household := ""
+	readings := make([]model.Reading, 0, len(items))
+	for _, item := range items {
+		field := func(path string) (interface{}, bool) {
+			return lookupField(item, topicParts, path)
+		}
+
+		if value, ok := field(mapping.Household); ok && household == "" {
+			household = fieldString(value)
+		}
+
+		var reading model.Reading
+		if value, ok := field(mapping.Appliance); ok {
+			reading.Appliance = fieldString(value)
+		}
+		if value, ok := field(mapping.Room); ok {
+			reading.Room = fieldString(value)
+		}
+		value, ok := field(mapping.Energy)
+		if !ok {
+			return "", nil, fmt.Errorf("energy field %q not found", mapping.Energy)
+		}
+		energy, err := strconv.ParseFloat(fieldString(value), 64)
+		if err != nil {
+			return "", nil, fmt.Errorf("energy field %q is not a number", mapping.Energy)
+		}
+		reading.EnergyConsumption = energy
+
+		if value, ok := field(mapping.Status); ok {
+			reading.Status = fieldString(value)
+		} else if energy > 0 {
+			reading.Status = "On"
+		} else {
+			reading.Status = "Off"
+		}
+
+		stamp, zoned := received.UTC(), true
+		if value, ok := field(mapping.Timestamp); ok {
+			parsed, hasZone, err := parseTimestamp(value)
+			if err != nil {
+				return "", nil, err
+			}
+			stamp, zoned = parsed, hasZone
+		} else if date, ok := field(mapping.Date); ok {
+			zoned = false
+			reading.Date = fieldString(date)
+			if clock, ok := field(mapping.Time); ok {
+				reading.Time = fieldString(clock)
+			}
+		}
+		if reading.Date == "" {
+			reading.Date = stamp.Format(dateLayout)
+			reading.Time = stamp.Format("15:04")
+		}
+		if zoned {
+			reading.Timestamp = stamp
+		}
+		readings = append(readings, reading)
+	}
+
+	if household == "" {
+		household = "default"
+	}
+	return household, readings, nil
+}
+
+func lookupField(item interface{}, topicParts []string, path string) (interface{}, bool) {
+	if path == "" {
+		return nil, false
+	}
+	if strings.HasPrefix(path, "=") {
+		return path[1:], true
+	}
+	if strings.HasPrefix(path, "$topic.") {
+		index, err := strconv.Atoi(strings.TrimPrefix(path, "$topic."))
+		if err != nil || index < 0 || index >= len(topicParts) {
+			return nil, false
+		}
+		return topicParts[index], true
+	}
+
+	current := item
+	for _, key := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[key]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			current = node[index]
+		default:
+			return nil, false
+		}
+	}
+	if current == nil {
+		return nil, false
+	}
+	return current, true
+}
+
+func fieldString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "On"
+		}
+		return "Off"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseTimestamp accepts RFC 3339 strings, "YYYY-MM-DD HH:MM[:SS]" and Unix
+// seconds. Instants are returned in UTC and reported as zoned; times without
+// an offset are wall clock times in the household's zone.
+func parseTimestamp(value interface{}) (time.Time, bool, error) {
+	if seconds, ok := value.(float64); ok {
+		return time.Unix(int64(seconds), 0).UTC(), true, nil
+	}
+	text := fieldString(value)
+	if parsed, err := time.Parse(time.RFC3339, text); err == nil {
+		return parsed.UTC(), true, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if parsed, err := time.Parse(layout, text); err == nil {
+			return parsed, false, nil
+		}
+	}
+	if seconds, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return time.Unix(seconds, 0).UTC(), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("invalid timestamp %q", text)
+}
@@ -0,0 +1,301 @@
+package service
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/notificationRepository"
+)
+
+// Event types published by the analysis pipeline.
+const (
+	EventAnomaly          = "anomaly"
+	EventBudgetAlert      = "budget_alert"
+	EventAnalysisComplete = "analysis_complete"
+)
+
+// SignatureHeader carries the hex HMAC-SHA256 of the webhook body, keyed with
+// the subscription secret and prefixed with "sha256=".
+const SignatureHeader = "X-Signature-256"
+
+// WebhookTimeout bounds each webhook request made by NewWebhookClient.
+const WebhookTimeout = 10 * time.Second
+
+// maxPendingEvents caps the events PublishAsync delivers at once.
+const maxPendingEvents = 64
+
+// NotificationChannel delivers events outside of webhook subscriptions.
+type NotificationChannel interface {
+	Name() string
+	Send(event model.NotificationEvent) error
+}
+
+// NotificationService delivers events to webhooks and channels. Webhook
+// targets on loopback, private and link-local addresses are rejected unless
+// AllowPrivateTargets is set, as for tests and local relays.
+type NotificationService struct {
+	Client              HTTPClient
+	Repo                *repository.NotificationRepository
+	Channels            []NotificationChannel
+	MaxAttempts         int
+	Backoff             time.Duration
+	AllowPrivateTargets bool
+
+	pending chan struct{}
+}
+
+func NewNotificationService(client HTTPClient, repo *repository.NotificationRepository) *NotificationService {
+	return &NotificationService{
+		Client:      client,
+		Repo:        repo,
+		MaxAttempts: 3,
+		Backoff:     time.Second,
+		pending:     make(chan struct{}, maxPendingEvents),
+	}
+}
+
+// NewWebhookClient returns the client to post webhooks with. Each request
+// times out after timeout, and connections to addresses that are not public
+// are refused after the host name is resolved.
+func NewWebhookClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// Subscribe validates and stores a webhook subscription, assigning its ID.
+func (s *NotificationService) Subscribe(subscription model.WebhookSubscription) (model.WebhookSubscription, error) {
+	target, err := url.Parse(subscription.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return model.WebhookSubscription{}, errors.New("webhook url must be an absolute http(s) url")
+	}
+	if !s.AllowPrivateTargets && !publicHost(target.Hostname()) {
+		return model.WebhookSubscription{}, errors.New("webhook url must not point at a loopback or private address")
+	}
+	subscription.ID = newID()
+	s.Repo.SaveSubscription(subscription)
+	return subscription, nil
+}
+
+// Subscriptions lists the webhook subscriptions of household, or all of them
+// when household is empty, without their secrets, which are only returned by
+// Subscribe.
+func (s *NotificationService) Subscriptions(household string) []model.WebhookSubscription {
+	subscriptions := make([]model.WebhookSubscription, 0)
+	for _, subscription := range s.Repo.ListSubscriptions() {
+		if household != "" && subscription.Household != household {
+			continue
+		}
+		subscription.Secret = ""
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions
+}
+
+// publicHost reports whether a webhook host may be a public address. Names
+// other than localhost are resolved when the webhook is posted.
+func publicHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return publicIP(ip)
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return host != "localhost" && !strings.HasSuffix(host, ".localhost")
+}
+
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// NewEvent builds an event with a fresh ID and the current time.
+func NewEvent(eventType, household string, data interface{}) model.NotificationEvent {
+	return model.NotificationEvent{
+		ID:        newID(),
+		Type:      eventType,
+		Household: household,
+		Time:      time.Now().UTC(),
+		Data:      data,
+	}
+}
+
+// Publish delivers the event to every matching webhook and every channel.
+// Each delivery is retried with linear backoff; deliveries that still fail
+// are written to the dead-letter log. Publish blocks until all deliveries
+// finish, so callers on a request path should use PublishAsync.
+func (s *NotificationService) Publish(event model.NotificationEvent) {
+	for _, subscription := range s.Repo.ListSubscriptions() {
+		if !subscribed(subscription, event) {
+			continue
+		}
+		subscription := subscription
+		s.deliver(event, "webhook:"+subscription.ID, func() error {
+			return s.postWebhook(subscription, event)
+		})
+	}
+	for _, channel := range s.Channels {
+		channel := channel
+		s.deliver(event, channel.Name(), func() error {
+			return channel.Send(event)
+		})
+	}
+}
+
+// PublishAsync runs Publish in a goroutine. When maxPendingEvents events are
+// already being delivered, the event goes to the dead-letter log instead.
+func (s *NotificationService) PublishAsync(event model.NotificationEvent) {
+	select {
+	case s.pending <- struct{}{}:
+		go func() {
+			defer func() { <-s.pending }()
+			s.Publish(event)
+		}()
+	default:
+		log.Println("Notification dropped:", event.Type, event.ID)
+		s.Repo.AddDeadLetter(model.DeadLetter{
+			Event:  event,
+			Target: "queue",
+			Error:  "too many events are being delivered",
+			Time:   time.Now().UTC(),
+		})
+	}
+}
+
+func (s *NotificationService) deliver(event model.NotificationEvent, target string, send func() error) {
+	attempts := s.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err = send(); err == nil {
+			return
+		}
+		if attempt < attempts {
+			time.Sleep(s.Backoff * time.Duration(attempt))
+		}
+	}
+	log.Println("Notification delivery failed:", target, err)
+	s.Repo.AddDeadLetter(model.DeadLetter{
+		Event:    event,
+		Target:   target,
+		Attempts: attempts,
+		Error:    err.Error(),
+		Time:     time.Now().UTC(),
+	})
+}
+
+func (s *NotificationService) postWebhook(subscription model.WebhookSubscription, event model.NotificationEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Type", event.Type)
+	req.Header.Set("X-Event-ID", event.ID)
+	if subscription.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(subscription.Secret, body))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of body keyed with secret.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func subscribed(subscription model.WebhookSubscription, event model.NotificationEvent) bool {
+	if subscription.Household != "" && subscription.Household != event.Household {
+		return false
+	}
+	if len(subscription.Events) == 0 {
+		return true
+	}
+	for _, eventType := range subscription.Events {
+		if eventType == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func newID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// EmailChannel sends events as plain-text mail through an SMTP server.
+// Auth may be nil for local relays and sinks.
+type EmailChannel struct {
+	Addr string
+	From string
+	To   []string
+	Auth smtp.Auth
+}
+
+func (c *EmailChannel) Name() string {
+	return "email"
+}
+
+func (c *EmailChannel) Send(event model.NotificationEvent) error {
+	data, err := json.MarshalIndent(event.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [Energy] %s for %s\r\n", event.Type, event.Household)
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "Event %s (%s) at %s\r\n\r\n", event.ID, event.Type, event.Time.Format(time.RFC3339))
+	msg.WriteString(strings.ReplaceAll(string(data), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(c.Addr, c.Auth, c.From, c.To, []byte(msg.String()))
+}
@@ -0,0 +1,259 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Prompt templates. Each version directory holds <name>.<lang>.tmpl files;
+// a name without a file for the requested language falls back to
+// DefaultPromptLanguage.
+const (
+	PromptChatSystem     = "chat_system"
+	PromptToolSystem     = "tool_system"
+	PromptQuerySystem    = "query_system"
+	PromptUploadSummary  = "upload_summary"
+	PromptRecommendation = "recommendation"
+)
+
+const DefaultPromptLanguage = "en"
+
+//go:embed prompts
+var embeddedPrompts embed.FS
+
+// PromptService renders versioned text/template prompts. The templates built
+// into the binary can be overridden and extended from Dir, which Watch
+// reloads when its files change.
+type PromptService struct {
+	Dir string
+
+	mu sync.RWMutex
+	// defaultVersion is rendered when no version is requested; empty means
+	// the highest version.
+	defaultVersion string
+	versions       map[string]*template.Template
+	modTime        time.Time
+	files          int
+}
+
+// NewPromptService loads the built-in templates and those in dir, if any.
+func NewPromptService(dir string) (*PromptService, error) {
+	s := &PromptService{Dir: dir}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+var (
+	defaultPromptsOnce sync.Once
+	defaultPrompts     *PromptService
+)
+
+// DefaultPrompts returns the built-in templates.
+func DefaultPrompts() *PromptService {
+	defaultPromptsOnce.Do(func() {
+		prompts, err := NewPromptService("")
+		if err != nil {
+			panic("built-in prompt templates: " + err.Error())
+		}
+		defaultPrompts = prompts
+	})
+	return defaultPrompts
+}
+
+// Reload parses all templates again. On error the templates loaded before
+// stay in use.
+func (s *PromptService) Reload() error {
+	versions := map[string]*template.Template{}
+	root, _ := fs.Sub(embeddedPrompts, "prompts")
+	if err := loadPrompts(root, versions); err != nil {
+		return err
+	}
+	var modTime time.Time
+	var files int
+	if s.Dir != "" {
+		var err error
+		if modTime, files, err = promptDirState(s.Dir); err != nil {
+			return err
+		}
+		if err := loadPrompts(os.DirFS(s.Dir), versions); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.defaultVersion != "" && versions[s.defaultVersion] == nil {
+		return fmt.Errorf("default prompt version %q has no templates", s.defaultVersion)
+	}
+	s.versions = versions
+	s.modTime = modTime
+	s.files = files
+	return nil
+}
+
+// loadPrompts parses the <version>/<name>.<lang>.tmpl files of root into
+// versions, replacing templates of the same version, name and language.
+func loadPrompts(root fs.FS, versions map[string]*template.Template) error {
+	files, err := fs.Glob(root, "*/*.tmpl")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		version, base := path.Split(file)
+		version = strings.TrimSuffix(version, "/")
+		name := strings.TrimSuffix(base, ".tmpl")
+		if strings.Count(name, ".") != 1 {
+			return fmt.Errorf("prompt template %s must be named <name>.<lang>.tmpl", file)
+		}
+		content, err := fs.ReadFile(root, file)
+		if err != nil {
+			return err
+		}
+		set, ok := versions[version]
+		if !ok {
+			set = template.New(version).Option("missingkey=error")
+			versions[version] = set
+		}
+		if _, err := set.New(name).Parse(string(content)); err != nil {
+			return fmt.Errorf("prompt template %s: %v", file, err)
+		}
+	}
+	return nil
+}
+
+// promptDirState returns the latest modification time and the number of the
+// template files in dir.
+func promptDirState(dir string) (time.Time, int, error) {
+	var latest time.Time
+	files := 0
+	err := fs.WalkDir(os.DirFS(dir), ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(name, ".tmpl") {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, files, err
+}
+
+// Watch reloads the templates whenever a file in Dir is added, removed or
+// modified, checking every interval until ctx is done.
+func (s *PromptService) Watch(ctx context.Context, interval time.Duration) {
+	if s.Dir == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		modTime, files, err := promptDirState(s.Dir)
+		if err != nil {
+			log.Println("Failed to check prompt templates:", err)
+			continue
+		}
+		s.mu.RLock()
+		changed := files != s.files || !modTime.Equal(s.modTime)
+		s.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := s.Reload(); err != nil {
+			log.Println("Failed to reload prompt templates:", err)
+			continue
+		}
+		log.Println("Reloaded prompt templates from", s.Dir)
+	}
+}
+
+// Versions lists the template versions in order.
+func (s *PromptService) Versions() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	versions := make([]string, 0, len(s.versions))
+	for version := range s.versions {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// SetDefaultVersion renders version when no version is requested. It must
+// have templates; empty means the highest version.
+func (s *PromptService) SetDefaultVersion(version string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version != "" && s.versions[version] == nil {
+		return fmt.Errorf("unknown prompt version %q", version)
+	}
+	s.defaultVersion = version
+	return nil
+}
+
+// Resolve returns the version to render for a requested one, which may be
+// empty for the default.
+func (s *PromptService) Resolve(version string) (string, error) {
+	if version == "" {
+		s.mu.RLock()
+		version = s.defaultVersion
+		s.mu.RUnlock()
+	}
+	versions := s.Versions()
+	if version == "" && len(versions) > 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, known := range versions {
+		if known == version {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("unknown prompt version %q", version)
+}
+
+// Render executes a template of a version in a language and returns the text
+// and the version rendered.
+func (s *PromptService) Render(version, name, lang string, data interface{}) (string, string, error) {
+	version, err := s.Resolve(version)
+	if err != nil {
+		return "", "", err
+	}
+	s.mu.RLock()
+	set := s.versions[version]
+	s.mu.RUnlock()
+
+	tmpl := set.Lookup(name + "." + strings.ToLower(lang))
+	if tmpl == nil {
+		tmpl = set.Lookup(name + "." + DefaultPromptLanguage)
+	}
+	if tmpl == nil {
+		return "", version, fmt.Errorf("prompt version %s has no %s template", version, name)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", version, err
+	}
+	return strings.TrimSpace(b.String()), version, nil
+}
@@ -0,0 +1,427 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Aggregates accepted in model.Query.
+const (
+	AggregateSum      = "sum"
+	AggregateAvg      = "avg"
+	AggregateMin      = "min"
+	AggregateMax      = "max"
+	AggregateCount    = "count"
+	AggregateDailyAvg = "daily_avg"
+)
+
+// Query columns used in filters and group_by. date, hour, weekday and month
+// are derived from the reading's wall clock time.
+var (
+	queryFilterColumns = []string{"appliance", "room", "status", "energy_consumption", "date", "hour", "weekday", "month"}
+	queryGroupColumns  = []string{"appliance", "room", "status", "date", "hour", "weekday", "month"}
+)
+
+// MaxQueryRows caps the rows a query returns.
+const MaxQueryRows = 100
+
+// QueryService validates structured queries and runs them over readings.
+type QueryService struct{}
+
+// ParseQuery extracts the JSON query from a model reply, which may wrap it in
+// prose or a code fence, and validates it. Unknown keys are rejected.
+func (s *QueryService) ParseQuery(reply string) (model.Query, error) {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return model.Query{}, errors.New("reply contains no JSON query")
+	}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(reply[start : end+1])))
+	decoder.DisallowUnknownFields()
+	var query model.Query
+	if err := decoder.Decode(&query); err != nil {
+		return model.Query{}, fmt.Errorf("invalid query: %v", err)
+	}
+	if err := s.Validate(&query); err != nil {
+		return model.Query{}, err
+	}
+	return query, nil
+}
+
+// Validate checks a query and normalizes its column names, operators and
+// aggregate to lower case.
+func (s *QueryService) Validate(query *model.Query) error {
+	query.Aggregate = strings.ToLower(strings.TrimSpace(query.Aggregate))
+	if query.Aggregate == "" {
+		query.Aggregate = AggregateSum
+	}
+	switch query.Aggregate {
+	case AggregateSum, AggregateAvg, AggregateMin, AggregateMax, AggregateCount, AggregateDailyAvg:
+	default:
+		return fmt.Errorf("unknown aggregate %q", query.Aggregate)
+	}
+
+	for i := range query.Filters {
+		filter := &query.Filters[i]
+		filter.Column = strings.ToLower(strings.TrimSpace(filter.Column))
+		filter.Op = strings.ToLower(strings.TrimSpace(filter.Op))
+		if !containsString(queryFilterColumns, filter.Column) {
+			return fmt.Errorf("cannot filter on %q", filter.Column)
+		}
+		switch filter.Op {
+		case "eq", "ne", "contains":
+			if _, ok := scalarString(filter.Value); !ok {
+				return fmt.Errorf("filter on %s needs a single value", filter.Column)
+			}
+		case "in":
+			values, ok := filter.Value.([]interface{})
+			if !ok || len(values) == 0 {
+				return fmt.Errorf("filter on %s with in needs a list of values", filter.Column)
+			}
+			for _, value := range values {
+				if _, ok := scalarString(value); !ok {
+					return fmt.Errorf("filter on %s with in needs a list of values", filter.Column)
+				}
+			}
+		case "gt", "gte", "lt", "lte":
+			text, _ := scalarString(filter.Value)
+			if _, err := strconv.ParseFloat(text, 64); err != nil && filter.Column != "date" {
+				return fmt.Errorf("filter on %s with %s needs a number", filter.Column, filter.Op)
+			}
+		default:
+			return fmt.Errorf("unknown filter operator %q", filter.Op)
+		}
+	}
+
+	if window := query.Window; window != nil {
+		for _, date := range []string{window.Start, window.End} {
+			if _, err := time.Parse(dateLayout, date); date != "" && err != nil {
+				return fmt.Errorf("window date %q must be YYYY-MM-DD", date)
+			}
+		}
+		for _, clock := range []string{window.From, window.To} {
+			if _, err := time.Parse("15:04", clock); clock != "" && err != nil {
+				return fmt.Errorf("window time %q must be HH:MM", clock)
+			}
+		}
+		window.Days = strings.ToLower(strings.TrimSpace(window.Days))
+		if window.Days != "" && window.Days != "weekdays" && window.Days != "weekends" {
+			return fmt.Errorf("window days must be weekdays or weekends, got %q", window.Days)
+		}
+	}
+
+	for i, column := range query.GroupBy {
+		query.GroupBy[i] = strings.ToLower(strings.TrimSpace(column))
+		if !containsString(queryGroupColumns, query.GroupBy[i]) {
+			return fmt.Errorf("cannot group by %q", column)
+		}
+	}
+	switch query.OrderBy {
+	case "", "value_desc", "value_asc":
+	default:
+		return fmt.Errorf("order_by must be value_desc or value_asc, got %q", query.OrderBy)
+	}
+	if query.Limit < 0 || query.Limit > MaxQueryRows {
+		return fmt.Errorf("limit must be between 0 and %d", MaxQueryRows)
+	}
+	return nil
+}
+
+// Execute validates the query and runs it over the readings. Groups are
+// ordered by their key unless the query orders by value.
+func (s *QueryService) Execute(readings []model.Reading, query model.Query) (model.QueryResult, error) {
+	if err := s.Validate(&query); err != nil {
+		return model.QueryResult{}, err
+	}
+
+	type group struct {
+		row  model.QueryRow
+		sum  float64
+		min  float64
+		max  float64
+		days map[string]bool
+	}
+	groups := map[string]*group{}
+	result := model.QueryResult{Query: query, Unit: "kWh"}
+	for _, r := range readings {
+		if !queryMatches(r, query) {
+			continue
+		}
+		result.Matched++
+
+		values := make(map[string]string, len(query.GroupBy))
+		keys := make([]string, len(query.GroupBy))
+		for i, column := range query.GroupBy {
+			values[column] = queryField(r, column)
+			keys[i] = values[column]
+		}
+		key := strings.Join(keys, "\x00")
+		g, ok := groups[key]
+		if !ok {
+			g = &group{row: model.QueryRow{Group: values}, min: math.Inf(1), max: math.Inf(-1), days: map[string]bool{}}
+			if len(values) == 0 {
+				g.row.Group = nil
+			}
+			groups[key] = g
+		}
+		g.row.Count++
+		g.sum += r.EnergyConsumption
+		g.min = math.Min(g.min, r.EnergyConsumption)
+		g.max = math.Max(g.max, r.EnergyConsumption)
+		g.days[r.Date] = true
+	}
+
+	result.Rows = make([]model.QueryRow, 0, len(groups))
+	for _, g := range groups {
+		switch query.Aggregate {
+		case AggregateSum:
+			g.row.Value = g.sum
+		case AggregateAvg:
+			g.row.Value = g.sum / float64(g.row.Count)
+		case AggregateMin:
+			g.row.Value = g.min
+		case AggregateMax:
+			g.row.Value = g.max
+		case AggregateCount:
+			g.row.Value = float64(g.row.Count)
+		case AggregateDailyAvg:
+			g.row.Value = g.sum / float64(len(g.days))
+		}
+		result.Rows = append(result.Rows, g.row)
+	}
+	sort.Slice(result.Rows, func(i, j int) bool {
+		a, b := result.Rows[i], result.Rows[j]
+		switch {
+		case query.OrderBy == "value_desc" && a.Value != b.Value:
+			return a.Value > b.Value
+		case query.OrderBy == "value_asc" && a.Value != b.Value:
+			return a.Value < b.Value
+		}
+		return groupKey(a, query.GroupBy) < groupKey(b, query.GroupBy)
+	})
+	if query.Limit > 0 && len(result.Rows) > query.Limit {
+		result.Rows = result.Rows[:query.Limit]
+	}
+	if len(result.Rows) > MaxQueryRows {
+		result.Rows = result.Rows[:MaxQueryRows]
+	}
+	if query.Aggregate == AggregateCount {
+		result.Unit = "readings"
+	}
+	return result, nil
+}
+
+// Describe renders the query as a short English phrase.
+func (s *QueryService) Describe(query model.Query) string {
+	var parts []string
+	parts = append(parts, query.Aggregate+" of energy_consumption")
+	for _, filter := range query.Filters {
+		value, _ := json.Marshal(filter.Value)
+		parts = append(parts, fmt.Sprintf("where %s %s %s", filter.Column, filter.Op, value))
+	}
+	if w := query.Window; w != nil {
+		if w.Start != "" || w.End != "" {
+			parts = append(parts, fmt.Sprintf("dates %s to %s", orAny(w.Start), orAny(w.End)))
+		}
+		if w.From != "" || w.To != "" {
+			parts = append(parts, fmt.Sprintf("times %s to %s", orAny(w.From), orAny(w.To)))
+		}
+		if w.Days != "" {
+			parts = append(parts, "on "+w.Days)
+		}
+	}
+	if len(query.GroupBy) > 0 {
+		parts = append(parts, "by "+strings.Join(query.GroupBy, ", "))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Summary renders the result as a short English answer.
+func (s *QueryService) Summary(result model.QueryResult) string {
+	if result.Matched == 0 {
+		return "No readings match the question (" + s.Describe(result.Query) + ")."
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s over %d readings:", s.Describe(result.Query), result.Matched)
+	for _, row := range result.Rows {
+		if len(row.Group) > 0 {
+			fmt.Fprintf(&sb, " %s %.2f %s;", groupKey(row, result.Query.GroupBy), row.Value, result.Unit)
+		} else {
+			fmt.Fprintf(&sb, " %.2f %s.", row.Value, result.Unit)
+		}
+	}
+	return strings.TrimSuffix(sb.String(), ";")
+}
+
+func queryMatches(r model.Reading, query model.Query) bool {
+	if w := query.Window; w != nil {
+		if (w.Start != "" && r.Date < w.Start) || (w.End != "" && r.Date > w.End) {
+			return false
+		}
+		if w.From != "" || w.To != "" {
+			from, to := w.From, w.To
+			if from == "" {
+				from = "00:00"
+			}
+			if to == "" {
+				to = "24:00"
+			}
+			inside := r.Time >= from && r.Time < to
+			if to < from {
+				inside = r.Time >= from || r.Time < to
+			}
+			if !inside {
+				return false
+			}
+		}
+		if w.Days != "" {
+			weekend := false
+			if day, err := time.Parse(dateLayout, r.Date); err == nil {
+				weekend = day.Weekday() == time.Saturday || day.Weekday() == time.Sunday
+			}
+			if weekend != (w.Days == "weekends") {
+				return false
+			}
+		}
+	}
+
+	for _, filter := range query.Filters {
+		field := queryField(r, filter.Column)
+		value, _ := scalarString(filter.Value)
+		switch filter.Op {
+		case "eq":
+			if !fieldEqual(field, value) {
+				return false
+			}
+		case "ne":
+			if fieldEqual(field, value) {
+				return false
+			}
+		case "contains":
+			if !strings.Contains(strings.ToLower(field), strings.ToLower(value)) {
+				return false
+			}
+		case "in":
+			found := false
+			for _, item := range filter.Value.([]interface{}) {
+				if text, _ := scalarString(item); fieldEqual(field, text) {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		default:
+			if !compareField(field, value, filter.Op) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fieldEqual compares numbers by value, so the hour "08" equals 8, and other
+// values ignoring case.
+func fieldEqual(field, value string) bool {
+	a, errA := strconv.ParseFloat(field, 64)
+	b, errB := strconv.ParseFloat(value, 64)
+	if errA == nil && errB == nil {
+		return a == b
+	}
+	return strings.EqualFold(field, value)
+}
+
+func compareField(field, value, op string) bool {
+	a, errA := strconv.ParseFloat(field, 64)
+	b, errB := strconv.ParseFloat(value, 64)
+	cmp := strings.Compare(field, value)
+	if errA == nil && errB == nil {
+		cmp = 0
+		if a < b {
+			cmp = -1
+		} else if a > b {
+			cmp = 1
+		}
+	}
+	switch op {
+	case "gt":
+		return cmp > 0
+	case "gte":
+		return cmp >= 0
+	case "lt":
+		return cmp < 0
+	default:
+		return cmp <= 0
+	}
+}
+
+func queryField(r model.Reading, column string) string {
+	switch column {
+	case "appliance":
+		return r.Appliance
+	case "room":
+		return r.Room
+	case "status":
+		return r.Status
+	case "energy_consumption":
+		return strconv.FormatFloat(r.EnergyConsumption, 'f', -1, 64)
+	case "date":
+		return r.Date
+	case "hour":
+		return fmt.Sprintf("%02d", readingHour(r))
+	case "weekday":
+		if day, err := time.Parse(dateLayout, r.Date); err == nil {
+			return day.Weekday().String()
+		}
+	case "month":
+		if len(r.Date) >= 7 {
+			return r.Date[:7]
+		}
+	}
+	return ""
+}
+
+func groupKey(row model.QueryRow, columns []string) string {
+	parts := make([]string, len(columns))
+	for i, column := range columns {
+		parts[i] = row.Group[column]
+	}
+	return strings.Join(parts, " / ")
+}
+
+func scalarString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return strings.TrimSpace(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func orAny(value string) string {
+	if value == "" {
+		return "any"
+	}
+	return value
+}
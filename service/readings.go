@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Column names of the energy CSV described in the README.
+const (
+	ColumnDate      = "Date"
+	ColumnTime      = "Time"
+	ColumnAppliance = "Appliance"
+	ColumnEnergy    = "Energy_Consumption"
+	ColumnRoom      = "Room"
+	ColumnStatus    = "Status"
+)
+
+// ColumnTimestamp is the optional column holding the UTC instant of a
+// reading in RFC 3339 form. Date and Time stay wall clock time.
+const ColumnTimestamp = "Timestamp"
+
+// EnergyColumns lists the energy schema columns in file order.
+var EnergyColumns = []string{ColumnDate, ColumnTime, ColumnAppliance, ColumnEnergy, ColumnRoom, ColumnStatus}
+
+// ParseReadings converts a table produced by ProcessFile into typed readings.
+// Every energy column must be present and Energy_Consumption must be numeric.
+// A Timestamp column, when present, sets Reading.Timestamp.
+func ParseReadings(table map[string][]string) ([]model.Reading, error) {
+	if len(table) == 0 {
+		return nil, errors.New("table is empty")
+	}
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return nil, fmt.Errorf("missing column %q", column)
+		}
+	}
+
+	rows := len(table[ColumnDate])
+	for _, column := range EnergyColumns {
+		if len(table[column]) != rows {
+			return nil, fmt.Errorf("column %q has %d values, expected %d", column, len(table[column]), rows)
+		}
+	}
+
+	readings := make([]model.Reading, 0, rows)
+	for i := 0; i < rows; i++ {
+		energy, err := strconv.ParseFloat(strings.TrimSpace(table[ColumnEnergy][i]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid %s %q", i+1, ColumnEnergy, table[ColumnEnergy][i])
+		}
+		reading := model.Reading{
+			Date:              table[ColumnDate][i],
+			Time:              table[ColumnTime][i],
+			Appliance:         table[ColumnAppliance][i],
+			EnergyConsumption: energy,
+			Room:              table[ColumnRoom][i],
+			Status:            table[ColumnStatus][i],
+		}
+		if stamps, ok := table[ColumnTimestamp]; ok && i < len(stamps) && strings.TrimSpace(stamps[i]) != "" {
+			reading.Timestamp, err = time.Parse(time.RFC3339, strings.TrimSpace(stamps[i]))
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid %s %q", i+1, ColumnTimestamp, stamps[i])
+			}
+		}
+		readings = append(readings, reading)
+	}
+	return readings, nil
+}
+
+// readingHour returns the hour of day of a reading's "HH:MM" time, or -1.
+func readingHour(r model.Reading) int {
+	parts := strings.SplitN(r.Time, ":", 2)
+	hour, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || hour < 0 || hour > 23 {
+		return -1
+	}
+	return hour
+}
+
+// ReadingsToTable converts readings back into the column table used by
+// ProcessFile, AnalyzeData and the dataset store. The Timestamp column is
+// added when any reading has one.
+func ReadingsToTable(readings []model.Reading) map[string][]string {
+	table := make(map[string][]string, len(EnergyColumns)+1)
+	for _, column := range EnergyColumns {
+		table[column] = make([]string, 0, len(readings))
+	}
+	for _, r := range readings {
+		if !r.Timestamp.IsZero() {
+			table[ColumnTimestamp] = make([]string, 0, len(readings))
+			break
+		}
+	}
+	for _, r := range readings {
+		if _, ok := table[ColumnTimestamp]; ok {
+			stamp := ""
+			if !r.Timestamp.IsZero() {
+				stamp = r.Timestamp.UTC().Format(time.RFC3339)
+			}
+			table[ColumnTimestamp] = append(table[ColumnTimestamp], stamp)
+		}
+		table[ColumnDate] = append(table[ColumnDate], r.Date)
+		table[ColumnTime] = append(table[ColumnTime], r.Time)
+		table[ColumnAppliance] = append(table[ColumnAppliance], r.Appliance)
+		table[ColumnEnergy] = append(table[ColumnEnergy], strconv.FormatFloat(r.EnergyConsumption, 'f', -1, 64))
+		table[ColumnRoom] = append(table[ColumnRoom], r.Room)
+		table[ColumnStatus] = append(table[ColumnStatus], r.Status)
+	}
+	return table
+}
+
+// ValidateReading checks a reading against the energy schema and normalizes
+// its Status to "On" or "Off". A reading with a Timestamp but no Date and
+// Time takes them from the Timestamp as written.
+func ValidateReading(r *model.Reading) error {
+	r.Date = strings.TrimSpace(r.Date)
+	r.Time = strings.TrimSpace(r.Time)
+	if r.Date == "" && r.Time == "" && !r.Timestamp.IsZero() {
+		r.Date = r.Timestamp.Format(dateLayout)
+		r.Time = r.Timestamp.Format("15:04")
+	}
+	r.Appliance = strings.TrimSpace(r.Appliance)
+	r.Room = strings.TrimSpace(r.Room)
+	if _, err := time.Parse(dateLayout, r.Date); err != nil {
+		return fmt.Errorf("invalid date %q, expected YYYY-MM-DD", r.Date)
+	}
+	if _, err := time.Parse("15:04", r.Time); err != nil {
+		return fmt.Errorf("invalid time %q, expected HH:MM", r.Time)
+	}
+	if r.Appliance == "" {
+		return errors.New("appliance is required")
+	}
+	if r.Room == "" {
+		return errors.New("room is required")
+	}
+	if math.IsNaN(r.EnergyConsumption) || math.IsInf(r.EnergyConsumption, 0) || r.EnergyConsumption < 0 {
+		return fmt.Errorf("invalid energy_consumption %v", r.EnergyConsumption)
+	}
+	switch strings.ToLower(strings.TrimSpace(r.Status)) {
+	case "on":
+		r.Status = "On"
+	case "off":
+		r.Status = "Off"
+	default:
+		return fmt.Errorf("invalid status %q, expected On or Off", r.Status)
+	}
+	return nil
+}
+
+// ValidateTable applies the typed reading validation to tables that follow
+// the energy schema and writes the normalized values back. Tables with other
+// columns are returned unchanged so generic tables still reach AnalyzeData.
+func ValidateTable(table map[string][]string) (map[string][]string, error) {
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return table, nil
+		}
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return nil, err
+	}
+	for i := range readings {
+		if err := ValidateReading(&readings[i]); err != nil {
+			return nil, fmt.Errorf("row %d: %v", i+1, err)
+		}
+	}
+	for column, values := range ReadingsToTable(readings) {
+		table[column] = values
+	}
+	return table, nil
+}
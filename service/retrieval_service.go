@@ -0,0 +1,245 @@
+package service
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// DefaultRetrievalLimit is how many documents are retrieved per chat turn.
+const DefaultRetrievalLimit = 8
+
+// citationPattern matches document IDs cited in an answer as [row-12] or
+// [summary:appliance:Heater].
+var citationPattern = regexp.MustCompile(`\[((?:row-\d+|summary:[^\]]+))\]`)
+
+// RetrievalService indexes each household's dataset rows and per appliance,
+// room and day summaries for lexical search. Indexes are rebuilt whenever the
+// readings change: when the dataset grows or is replaced, or when a new time
+// zone shifts their local dates and times.
+type RetrievalService struct {
+	mu      sync.Mutex
+	indexes map[string]*RetrievalIndex
+}
+
+func NewRetrievalService() *RetrievalService {
+	return &RetrievalService{indexes: make(map[string]*RetrievalIndex)}
+}
+
+// Index returns the household's index, building it if the readings are not
+// the ones last indexed.
+func (s *RetrievalService) Index(household string, readings []model.Reading) *RetrievalIndex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version := readingsVersion(readings)
+	if index, ok := s.indexes[household]; ok && index.version == version {
+		return index
+	}
+	index := NewRetrievalIndex(readings)
+	index.version = version
+	s.indexes[household] = index
+	return index
+}
+
+// readingsVersion hashes the readings as they are indexed.
+func readingsVersion(readings []model.Reading) uint64 {
+	h := fnv.New64a()
+	for _, r := range readings {
+		fmt.Fprintf(h, "%s|%s|%s|%s|%g|%s\n", r.Date, r.Time, r.Appliance, r.Room, r.EnergyConsumption, r.Status)
+	}
+	return h.Sum64()
+}
+
+// RetrievalIndex is an in-memory TF-IDF index with cosine ranking.
+type RetrievalIndex struct {
+	version   uint64
+	documents []model.RetrievedDocument
+	vectors   []map[string]float64
+	idf       map[string]float64
+}
+
+// NewRetrievalIndex indexes one document per reading, IDs following the
+// readings' order, plus summary documents of the totals per appliance, room
+// and day.
+func NewRetrievalIndex(readings []model.Reading) *RetrievalIndex {
+	var documents []model.RetrievedDocument
+	for i, r := range readings {
+		documents = append(documents, model.RetrievedDocument{
+			ID:   fmt.Sprintf("row-%d", i+1),
+			Text: fmt.Sprintf("%s %s %s %s in %s used %g kWh, status %s", r.Date, weekdayOf(r.Date), r.Time, r.Appliance, r.Room, r.EnergyConsumption, r.Status),
+		})
+	}
+	for _, summary := range []struct {
+		kind string
+		key  func(model.Reading) string
+	}{
+		{"appliance", func(r model.Reading) string { return r.Appliance }},
+		{"room", func(r model.Reading) string { return r.Room }},
+		{"date", func(r model.Reading) string { return r.Date }},
+	} {
+		totals := map[string]float64{}
+		counts := map[string]int{}
+		for _, r := range readings {
+			totals[summary.key(r)] += r.EnergyConsumption
+			counts[summary.key(r)]++
+		}
+		keys := make([]string, 0, len(totals))
+		for key := range totals {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			text := fmt.Sprintf("total for %s %s: %g kWh over %d readings, average %g kWh per reading", summary.kind, key, totals[key], counts[key], totals[key]/float64(counts[key]))
+			if summary.kind == "date" {
+				text = fmt.Sprintf("total for date %s %s: %g kWh over %d readings", key, weekdayOf(key), totals[key], counts[key])
+			}
+			documents = append(documents, model.RetrievedDocument{ID: "summary:" + summary.kind + ":" + key, Text: text})
+		}
+	}
+
+	index := &RetrievalIndex{documents: documents, idf: map[string]float64{}}
+	frequencies := make([]map[string]float64, len(documents))
+	for i, document := range documents {
+		frequencies[i] = termFrequencies(document.ID + " " + document.Text)
+		for term := range frequencies[i] {
+			index.idf[term]++
+		}
+	}
+	for term, count := range index.idf {
+		index.idf[term] = math.Log(1 + float64(len(documents))/count)
+	}
+	for _, tf := range frequencies {
+		index.vectors = append(index.vectors, index.weigh(tf))
+	}
+	return index
+}
+
+// Search returns up to limit documents ranked by cosine similarity to the
+// query. Documents sharing no term with the query are left out.
+func (x *RetrievalIndex) Search(query string, limit int) []model.RetrievedDocument {
+	if limit <= 0 {
+		limit = DefaultRetrievalLimit
+	}
+	vector := x.weigh(termFrequencies(query))
+	results := []model.RetrievedDocument{}
+	if len(vector) == 0 {
+		return results
+	}
+	for i, document := range x.vectors {
+		var score float64
+		for term, weight := range vector {
+			score += weight * document[term]
+		}
+		if score > 0 {
+			result := x.documents[i]
+			result.Score = score
+			results = append(results, result)
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// weigh turns term frequencies into a unit-length TF-IDF vector. Terms the
+// index has never seen are dropped.
+func (x *RetrievalIndex) weigh(tf map[string]float64) map[string]float64 {
+	vector := map[string]float64{}
+	var norm float64
+	for term, count := range tf {
+		idf, ok := x.idf[term]
+		if !ok {
+			continue
+		}
+		weight := (1 + math.Log(count)) * idf
+		vector[term] = weight
+		norm += weight * weight
+	}
+	norm = math.Sqrt(norm)
+	for term := range vector {
+		vector[term] /= norm
+	}
+	return vector
+}
+
+// termFrequencies splits text into lower-case terms. Dates, times and numbers
+// stay whole.
+func termFrequencies(text string) map[string]float64 {
+	tf := map[string]float64{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '-' && c != ':' && c != '.'
+	})
+	for _, word := range words {
+		if word = strings.Trim(word, "-:."); word != "" {
+			tf[word]++
+		}
+	}
+	return tf
+}
+
+func weekdayOf(date string) string {
+	at, err := time.Parse(dateLayout, date)
+	if err != nil {
+		return ""
+	}
+	return at.Weekday().String()
+}
+
+// RetrievalContext formats retrieved documents for the chat prompt and asks
+// the model to cite them.
+func RetrievalContext(documents []model.RetrievedDocument) string {
+	if len(documents) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("Relevant records from the dataset. Cite the IDs of the records you use in square brackets, for example [" + documents[0].ID + "].\n")
+	for _, document := range documents {
+		fmt.Fprintf(&b, "[%s] %s\n", document.ID, document.Text)
+	}
+	return b.String()
+}
+
+// Citations returns the IDs of retrieved documents cited in an answer, in
+// order of first citation.
+func Citations(answer string, documents []model.RetrievedDocument) []string {
+	retrieved := map[string]bool{}
+	for _, document := range documents {
+		retrieved[document.ID] = true
+	}
+	cited := []string{}
+	seen := map[string]bool{}
+	for _, match := range citationPattern.FindAllStringSubmatch(answer, -1) {
+		if id := match[1]; retrieved[id] && !seen[id] {
+			seen[id] = true
+			cited = append(cited, id)
+		}
+	}
+	return cited
+}
+
+// maxFallbackCitations is how many of the best documents Cite lists for an
+// answer that cites none.
+const maxFallbackCitations = 3
+
+// Cite returns the answer and the IDs it cites. An answer that cites none of
+// the retrieved documents gets the best ones appended as its sources.
+func Cite(answer string, documents []model.RetrievedDocument) (string, []string) {
+	cited := Citations(answer, documents)
+	if len(cited) > 0 || len(documents) == 0 {
+		return answer, cited
+	}
+	for i := 0; i < len(documents) && i < maxFallbackCitations; i++ {
+		cited = append(cited, documents[i].ID)
+	}
+	return answer + "\n\nSumber: [" + strings.Join(cited, "], [") + "]", cited
+}
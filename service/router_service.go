@@ -0,0 +1,299 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Query classes assigned by ClassifyQuery.
+const (
+	QueryTableLookup = "table_lookup"
+	QueryAggregate   = "aggregate"
+	QueryAdvice      = "advice"
+	QuerySmallTalk   = "small_talk"
+)
+
+// Backends a query can be routed to. A chat backend can use a model other
+// than the AIService's as "chat:<model>".
+const (
+	BackendAnalytics = "analytics"
+	BackendTapas     = "tapas"
+	BackendChat      = "chat"
+)
+
+// DefaultRouteTimeout is how long the router waits for one backend.
+const DefaultRouteTimeout = 30 * time.Second
+
+// ErrNotAnswerable is returned by a backend that cannot answer a query, such
+// as the analytics backend for a question it does not understand or any
+// dataset backend when no dataset was uploaded.
+var ErrNotAnswerable = errors.New("backend cannot answer this query")
+
+var (
+	smallTalkWords = []string{"halo", "hai", "hi", "hello", "hey", "terima kasih", "makasih", "thanks", "thank you", "selamat pagi", "selamat siang", "selamat sore", "selamat malam", "good morning", "good evening", "apa kabar", "how are you", "siapa kamu", "who are you"}
+	adviceWords    = []string{"saran", "tips", "tip", "hemat", "menghemat", "mengurangi", "kurangi", "sebaiknya", "bagaimana cara", "rekomendasi", "advice", "recommend", "should", "how can i", "how do i", "reduce", "save"}
+	aggregateWords = []string{"total", "jumlah", "berapa", "how much", "sum", "keseluruhan", "overall"}
+	lookupWords    = []string{"kapan", "when", "jam", "pukul", "status", "mana", "which", "where", "ruang", "ruangan", "room", "nilai", "value", "tanggal", "date"}
+	roomWords      = []string{"room", "ruang", "ruangan", "kamar"}
+	dailyWords     = []string{"per hari", "per day", "harian", "daily"}
+	timeWords      = []string{"kapan", "when", "jam", "pukul", "hour", "time", "waktu"}
+	countWords     = []string{"how many", "berapa banyak"}
+	// Things the readings alone cannot answer: costs, emissions, forecasts
+	// and shares.
+	uncomputedWords = []string{"biaya", "harga", "tagihan", "rupiah", "cost", "price", "bill", "emisi", "karbon", "carbon", "co2", "prediksi", "perkiraan", "forecast", "predict", "persen", "percent"}
+
+	clockTime = regexp.MustCompile(`\b\d{1,2}:\d{2}\b`)
+)
+
+// ClassifyQuery sorts a query into a class from its words, in English and
+// Indonesian. Questions that fit no class are treated as advice, so the chat
+// model answers them.
+func ClassifyQuery(query string) string {
+	lower := strings.ToLower(strings.TrimSpace(query))
+	switch {
+	case containsAny(lower, smallTalkWords) && len(strings.Fields(lower)) <= 6:
+		return QuerySmallTalk
+	case containsAny(lower, adviceWords):
+		return QueryAdvice
+	case containsAny(lower, aggregateWords) || containsAny(lower, averageWords) || superlative(lower) != 0:
+		return QueryAggregate
+	case containsAny(lower, lookupWords) || claimDate.MatchString(lower) || clockTime.MatchString(lower):
+		return QueryTableLookup
+	}
+	return QueryAdvice
+}
+
+// DefaultRoutes returns the backends tried first for each class, in order.
+func DefaultRoutes() map[string][]string {
+	return map[string][]string{
+		QueryTableLookup: {BackendTapas, BackendAnalytics, BackendChat},
+		QueryAggregate:   {BackendAnalytics, BackendTapas, BackendChat},
+		QueryAdvice:      {BackendChat},
+		QuerySmallTalk:   {BackendChat},
+	}
+}
+
+// QueryRouter decides which backends answer a query: those routed for its
+// class, then the Fallback list, each tried once and given Timeout to answer.
+type QueryRouter struct {
+	Routes   map[string][]string
+	Fallback []string
+	Timeout  time.Duration
+}
+
+func NewQueryRouter() *QueryRouter {
+	return &QueryRouter{Routes: DefaultRoutes(), Timeout: DefaultRouteTimeout}
+}
+
+// Plan returns the backends to try for a class, in order.
+func (r *QueryRouter) Plan(class string) []string {
+	var plan []string
+	seen := map[string]bool{}
+	for _, backend := range append(append([]string{}, r.Routes[class]...), r.Fallback...) {
+		if !seen[backend] {
+			seen[backend] = true
+			plan = append(plan, backend)
+		}
+	}
+	if len(plan) == 0 {
+		plan = []string{BackendChat}
+	}
+	return plan
+}
+
+// ParseBackends reads a comma-separated list of backends.
+func ParseBackends(list string) ([]string, error) {
+	var backends []string
+	for _, backend := range strings.Split(list, ",") {
+		backend = strings.TrimSpace(backend)
+		switch {
+		case backend == "":
+			continue
+		case backend == BackendAnalytics, backend == BackendTapas, backend == BackendChat:
+		case strings.HasPrefix(backend, BackendChat+":") && len(backend) > len(BackendChat)+1:
+		default:
+			return nil, fmt.Errorf("unknown backend %q", backend)
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// RouteRequest is a query to route. Readings are the household's dataset,
+// empty when none was uploaded; Tools, when set, lets chat backends call
+// analytics tools; Context grounds chat backends.
+type RouteRequest struct {
+	Query       string
+	Context     string
+	Readings    []model.Reading
+	Tools       ToolExecutor
+	Token       string
+	Translation *TranslationService
+}
+
+// Answer classifies a query and tries the backends the router plans for it
+// until one answers. Queries the guard rejects are not routed.
+func (s *AIService) Answer(request RouteRequest) (model.RoutedAnswer, error) {
+	router := s.Router
+	if router == nil {
+		router = NewQueryRouter()
+	}
+	timeout := router.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRouteTimeout
+	}
+
+	class := ClassifyQuery(request.Query)
+	routed := model.RoutedAnswer{Class: class, Attempts: []model.RouteAttempt{}}
+	if err := s.guard().CheckQuery(request.Query); err != nil {
+		return routed, err
+	}
+
+	var lastErr error
+	for _, backend := range router.Plan(class) {
+		start := time.Now()
+		answer, trace, err := s.callBackend(backend, request, timeout)
+		attempt := model.RouteAttempt{Backend: backend, LatencyMS: time.Since(start).Milliseconds()}
+		if err == nil {
+			routed.Attempts = append(routed.Attempts, attempt)
+			routed.Answer, routed.Backend, routed.Trace = answer, backend, trace
+			return routed, nil
+		}
+		attempt.Error = err.Error()
+		routed.Attempts = append(routed.Attempts, attempt)
+		lastErr = err
+	}
+	return routed, fmt.Errorf("no backend answered: %w", lastErr)
+}
+
+// callBackend asks one backend, giving up after timeout. A backend that
+// times out keeps running in the background; its answer is dropped.
+func (s *AIService) callBackend(backend string, request RouteRequest, timeout time.Duration) (string, []model.ToolTrace, error) {
+	type outcome struct {
+		answer string
+		trace  []model.ToolTrace
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		answer, trace, err := s.askBackend(backend, request)
+		done <- outcome{answer, trace, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.answer, o.trace, o.err
+	case <-timer.C:
+		return "", nil, fmt.Errorf("%s timed out after %s", backend, timeout)
+	}
+}
+
+func (s *AIService) askBackend(backend string, request RouteRequest) (string, []model.ToolTrace, error) {
+	switch {
+	case backend == BackendAnalytics:
+		answer, err := AnswerFromReadings(request.Query, request.Readings)
+		return answer, nil, err
+
+	case backend == BackendTapas:
+		if len(request.Readings) == 0 {
+			return "", nil, ErrNotAnswerable
+		}
+		answer, err := s.AnalyzeData(AnalysisTable(ReadingsToTable(request.Readings)), request.Query, request.Token, request.Translation)
+		return answer, nil, err
+
+	case backend == BackendChat || strings.HasPrefix(backend, BackendChat+":"):
+		ai := s
+		if name := strings.TrimPrefix(backend, BackendChat+":"); name != backend {
+			copied := *s
+			copied.ChatModel = name
+			ai = &copied
+		}
+		// Models or endpoints without tool support answer without tools.
+		if request.Tools != nil {
+			response, trace, err := ai.ChatWithTools(request.Context, request.Query, request.Token, request.Translation, request.Tools)
+			if err == nil || errors.Is(err, ErrPromptInjection) || errors.Is(err, ErrUnsafeOutput) {
+				return response.GeneratedText, trace, err
+			}
+		}
+		response, err := ai.ChatWithAI(request.Context, request.Query, request.Token, request.Translation)
+		return response.GeneratedText, nil, err
+	}
+	return "", nil, fmt.Errorf("unknown backend %q", backend)
+}
+
+// AnswerFromReadings answers totals, averages and which appliance or room
+// used the most or least energy straight from the readings, optionally on
+// the dates the query names. It returns ErrNotAnswerable for anything else,
+// including counts such as "berapa kali TV menyala" and how many of something
+// there are, so the router tries the next backend.
+func AnswerFromReadings(query string, readings []model.Reading) (string, error) {
+	lower := strings.ToLower(query)
+	if dates := claimDate.FindAllString(query, -1); len(dates) > 0 {
+		var onDates []model.Reading
+		for _, r := range readings {
+			for _, date := range dates {
+				if r.Date == date {
+					onDates = append(onDates, r)
+				}
+			}
+		}
+		readings = onDates
+	}
+	if len(readings) == 0 || containsAny(lower, timeWords) || containsAny(lower, timesWords) || containsAny(lower, uncomputedWords) ||
+		containsAny(lower, countWords) && !containsAny(lower, energyWords) {
+		return "", ErrNotAnswerable
+	}
+
+	facts := newAnswerFacts(readings)
+	mentions := facts.mentions(query)
+
+	if direction := superlative(lower); direction != 0 {
+		if len(mentions) > 0 {
+			return "", ErrNotAnswerable
+		}
+		kind, noun := "appliance", "Peralatan"
+		if containsAny(lower, roomWords) {
+			kind, noun = "room", "Ruangan"
+		}
+		amount := "banyak"
+		if direction < 0 {
+			amount = "sedikit"
+		}
+		name := facts.ranked(kind, direction)
+		return fmt.Sprintf("%s yang paling %s menggunakan energi adalah %s (%s kWh).",
+			noun, amount, name, formatClaimValue(facts.totals[claimSubject{kind, name}], "")), nil
+	}
+
+	subject := claimSubject{}
+	label := "seluruh peralatan"
+	if len(mentions) > 0 {
+		subject, label = mentions[0].claimSubject, mentions[0].name
+	}
+	var total float64
+	count := 0
+	days := map[string]bool{}
+	for _, r := range readings {
+		if subject.kind == "appliance" && r.Appliance != subject.name || subject.kind == "room" && r.Room != subject.name {
+			continue
+		}
+		total += r.EnergyConsumption
+		count++
+		days[r.Date] = true
+	}
+
+	switch {
+	case containsAny(lower, averageWords) && containsAny(lower, dailyWords):
+		return fmt.Sprintf("Rata-rata konsumsi energi %s adalah %s kWh per hari.", label, formatClaimValue(total/float64(len(days)), "")), nil
+	case containsAny(lower, averageWords):
+		return fmt.Sprintf("Rata-rata konsumsi energi %s adalah %s kWh per pembacaan.", label, formatClaimValue(total/float64(count), "")), nil
+	case containsAny(lower, aggregateWords):
+		return fmt.Sprintf("Total konsumsi energi %s adalah %s kWh.", label, formatClaimValue(total, "")), nil
+	}
+	return "", ErrNotAnswerable
+}
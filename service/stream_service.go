@@ -0,0 +1,345 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"a21hc3NpZ25tZW50/model"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// streamSampleSize is how much of a streamed file is inspected to detect its
+// encoding and dialect.
+const streamSampleSize = 64 * 1024
+
+// MaxAnalysisRows caps the table sent to the table-QA model. Larger energy
+// tables are summarized per appliance by AnalysisTable.
+const MaxAnalysisRows = 500
+
+// StreamFile parses a large delimited energy file row by row without holding
+// it in memory. Each row is validated like an uploaded reading and folded
+// into hourly totals per appliance and room, so memory grows with the number
+// of distinct hours and appliances rather than with the file size. Rows are
+// read as wall clock time in options.TimeZone (see ResolveTimes) and go
+// through normalizer, when it is not nil, before they are aggregated; the
+// caller commits normalizer once the table is stored. The
+// returned table holds one reading per hour, appliance and room. With
+// options.Cleaning set, negative values are clamped and repeated readings
+// dropped as rows are read, rows are folded into intervals no longer than
+// the resample interval, and the totals are then cleaned.
+func (s *FileService) StreamFile(r io.Reader, options model.ImportOptions, normalizer *Normalizer) (map[string][]string, *model.ConversionReport, error) {
+	loc, err := ImportZone(options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if options.Cleaning != nil {
+		if _, err := ParseCleaningOptions(*options.Cleaning); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	buffered := bufio.NewReaderSize(r, streamSampleSize)
+	sample, err := buffered.Peek(streamSampleSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, nil, err
+	}
+	if len(sample) == 0 {
+		return nil, nil, errors.New("csv file is empty or missing header")
+	}
+	if format := SniffFormat(string(sample)); format != FormatCSV || (options.Format != "" && options.Format != FormatCSV) {
+		return nil, nil, errors.New("only delimited text files can be streamed")
+	}
+
+	// Cut the sample at the last line break so a partial line or a split
+	// multi-byte character does not skew detection.
+	if i := bytes.LastIndexByte(sample, '\n'); i > 0 && len(sample) == streamSampleSize {
+		sample = sample[:i]
+	}
+
+	encoding := options.Encoding
+	var text io.Reader = buffered
+	if encoding == "" && bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}) {
+		buffered.Discard(3)
+		sample = sample[3:]
+		encoding = "utf-8"
+	}
+	if encoding == "" && utf8.Valid(sample) && !bytes.HasPrefix(sample, []byte{0xFF, 0xFE}) && !bytes.HasPrefix(sample, []byte{0xFE, 0xFF}) {
+		encoding = "utf-8"
+	}
+	decodedSample, name, err := DecodeText(string(sample), encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+	if name != "utf-8" {
+		enc, err := htmlindex.Get(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		text = transform.NewReader(buffered, enc.NewDecoder())
+	}
+
+	dialect, err := DetectDialect(decodedSample, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	dialect.Encoding = name
+
+	next := lineRecords(text, dialect)
+	columns := map[string]int{}
+	if dialect.Header {
+		header, err := next()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read header: %v", err)
+		}
+		for i, column := range header {
+			column = canonicalColumn(strings.TrimPrefix(column, "\ufeff"))
+			if _, ok := columns[column]; ok {
+				return nil, nil, fmt.Errorf("csv file has duplicate column %q", column)
+			}
+			columns[column] = i
+		}
+		for _, column := range EnergyColumns {
+			if _, ok := columns[column]; !ok {
+				return nil, nil, fmt.Errorf("large files must follow the energy schema; missing column %q", column)
+			}
+		}
+	} else {
+		for i, column := range EnergyColumns {
+			columns[column] = i
+		}
+	}
+
+	fields := 0
+	for _, column := range EnergyColumns {
+		if columns[column] >= fields {
+			fields = columns[column] + 1
+		}
+	}
+
+	report := &model.ConversionReport{Format: FormatCSV, Dialect: &dialect}
+	clamped := 0
+	resolver := newTimeResolver(loc)
+	aggregator := newIntervalAggregator(time.Hour, loc)
+	if options.Cleaning != nil {
+		interval, _ := ParseCleaningOptions(*options.Cleaning)
+		if interval > 0 && interval < time.Hour {
+			aggregator.interval = interval
+		}
+		aggregator.seen = map[string]bool{}
+	}
+	for {
+		record, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		report.RowsRead++
+		if len(record) < fields {
+			return nil, nil, fmt.Errorf("row %d has incorrect number of fields", report.RowsRead)
+		}
+
+		value := func(column string) string {
+			v := strings.TrimSpace(record[columns[column]])
+			if dialect.Decimal == "," && decimalCommaPattern.MatchString(v) {
+				v = strings.Replace(strings.ReplaceAll(v, ".", ""), ",", ".", 1)
+			}
+			return v
+		}
+		energy, err := strconv.ParseFloat(value(ColumnEnergy), 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("row %d: invalid %s %q", report.RowsRead, ColumnEnergy, value(ColumnEnergy))
+		}
+		reading := model.Reading{
+			Date:              value(ColumnDate),
+			Time:              value(ColumnTime),
+			Appliance:         value(ColumnAppliance),
+			EnergyConsumption: energy,
+			Room:              value(ColumnRoom),
+			Status:            value(ColumnStatus),
+		}
+		if options.Cleaning != nil && reading.EnergyConsumption < 0 {
+			reading.EnergyConsumption = 0
+			clamped++
+		}
+		if err := ValidateReading(&reading); err != nil {
+			return nil, nil, fmt.Errorf("row %d: %v", report.RowsRead, err)
+		}
+		if err := resolver.resolve(&reading); err != nil {
+			return nil, nil, fmt.Errorf("row %d: %v", report.RowsRead, err)
+		}
+		if normalizer != nil {
+			var ok bool
+			if reading, ok = normalizer.Next(reading); !ok {
+				report.RowsSkipped++
+				continue
+			}
+		}
+		aggregator.add(reading)
+		report.RowsConverted++
+	}
+	if normalizer != nil {
+		report.Normalization = &normalizer.Report
+	}
+
+	readings := aggregator.readings()
+	report.AggregatedRows = len(readings)
+	if options.Cleaning != nil {
+		readings, report.Cleaning, err = CleanReadings(readings, *options.Cleaning, loc)
+		if err != nil {
+			return nil, nil, err
+		}
+		report.Cleaning.NegativesClamped += clamped
+		report.Cleaning.DuplicatesRemoved += aggregator.duplicates
+	}
+	return ReadingsToTable(readings), report, nil
+}
+
+// lineRecords returns a function yielding one record per call and io.EOF at
+// the end. Double-quoted files use encoding/csv; other quote characters are
+// split line by line.
+func lineRecords(r io.Reader, dialect model.CSVDialect) func() ([]string, error) {
+	if dialect.Quote == "\"" {
+		reader := csv.NewReader(r)
+		reader.Comma, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+		reader.FieldsPerRecord = -1
+		reader.ReuseRecord = true
+		return reader.Read
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	return func() ([]string, error) {
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			return splitLine(line, dialect.Delimiter[0], dialect.Quote[0]), nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+}
+
+// intervalAggregator sums readings per interval, appliance and room. Hourly
+// intervals follow the wall clock hour; shorter ones are counted from local
+// midnight in loc like resampled readings. A bucket is "On" when any of its
+// readings is. When seen is not nil, repeated readings of an appliance and
+// room at the same time are dropped, keeping the first.
+type intervalAggregator struct {
+	interval   time.Duration
+	loc        *time.Location
+	buckets    map[string]*model.Reading
+	seen       map[string]bool
+	duplicates int
+}
+
+func newIntervalAggregator(interval time.Duration, loc *time.Location) *intervalAggregator {
+	return &intervalAggregator{interval: interval, loc: loc, buckets: map[string]*model.Reading{}}
+}
+
+// add folds a reading with a Timestamp into its bucket.
+func (a *intervalAggregator) add(r model.Reading) {
+	if a.seen != nil {
+		key := meterKey(r) + "\x00" + r.Timestamp.UTC().Format(time.RFC3339)
+		if a.seen[key] {
+			a.duplicates++
+			return
+		}
+		a.seen[key] = true
+	}
+	start := hourStart(r.Timestamp)
+	if a.interval < time.Hour {
+		start = intervalStart(r.Timestamp, a.interval, a.loc)
+	}
+	key := meterKey(r) + "\x00" + start.UTC().Format(time.RFC3339)
+	bucket, ok := a.buckets[key]
+	if !ok {
+		reading := atInstant(model.Reading{Appliance: r.Appliance, Room: r.Room, Status: "Off"}, start)
+		bucket = &reading
+		a.buckets[key] = bucket
+	}
+	bucket.EnergyConsumption += r.EnergyConsumption
+	if r.Status == "On" {
+		bucket.Status = "On"
+	}
+}
+
+func (a *intervalAggregator) readings() []model.Reading {
+	readings := make([]model.Reading, 0, len(a.buckets))
+	for _, bucket := range a.buckets {
+		readings = append(readings, *bucket)
+	}
+	sort.Slice(readings, func(i, j int) bool {
+		if !readings[i].Timestamp.Equal(readings[j].Timestamp) {
+			return readings[i].Timestamp.Before(readings[j].Timestamp)
+		}
+		if readings[i].Date != readings[j].Date {
+			return readings[i].Date < readings[j].Date
+		}
+		if readings[i].Time != readings[j].Time {
+			return readings[i].Time < readings[j].Time
+		}
+		if readings[i].Appliance != readings[j].Appliance {
+			return readings[i].Appliance < readings[j].Appliance
+		}
+		return readings[i].Room < readings[j].Room
+	})
+	return readings
+}
+
+// AnalysisTable returns the table to send to the table-QA model. Tables of up
+// to MaxAnalysisRows rows are sent as they are; larger energy tables are
+// reduced to total consumption per appliance and room, and other tables are
+// truncated.
+func AnalysisTable(table map[string][]string) map[string][]string {
+	if rowCount(table) <= MaxAnalysisRows {
+		return table
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		truncated := make(map[string][]string, len(table))
+		for column, values := range table {
+			truncated[column] = values[:MaxAnalysisRows]
+		}
+		return truncated
+	}
+
+	totals := map[[2]string]float64{}
+	for _, r := range readings {
+		totals[[2]string{r.Appliance, r.Room}] += r.EnergyConsumption
+	}
+	keys := make([][2]string, 0, len(totals))
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+
+	summary := map[string][]string{ColumnAppliance: {}, ColumnRoom: {}, ColumnEnergy: {}}
+	for _, key := range keys {
+		summary[ColumnAppliance] = append(summary[ColumnAppliance], key[0])
+		summary[ColumnRoom] = append(summary[ColumnRoom], key[1])
+		summary[ColumnEnergy] = append(summary[ColumnEnergy], strconv.FormatFloat(totals[key], 'f', 2, 64))
+	}
+	return summary
+}
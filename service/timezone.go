@@ -0,0 +1,181 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/householdRepository"
+)
+
+// wallClockLayout is how Date and Time read together.
+const wallClockLayout = dateLayout + " 15:04"
+
+// HouseholdService keeps household settings. Households without a time zone
+// use DefaultZone.
+type HouseholdService struct {
+	Repo        *repository.HouseholdRepository
+	DefaultZone *time.Location
+}
+
+func NewHouseholdService(repo *repository.HouseholdRepository) *HouseholdService {
+	return &HouseholdService{Repo: repo, DefaultZone: time.UTC}
+}
+
+// LoadZone loads an IANA time zone. Unlike time.LoadLocation it rejects the
+// empty name and "Local", whose meaning depends on the server.
+func LoadZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return nil, errors.New("time zone must be an IANA name such as Europe/Berlin")
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// SetTimeZone validates and stores the household's time zone.
+func (s *HouseholdService) SetTimeZone(household, name string) (model.HouseholdSettings, error) {
+	loc, err := LoadZone(name)
+	if err != nil {
+		return model.HouseholdSettings{}, err
+	}
+	settings, _ := s.Repo.GetSettings(household)
+	settings.TimeZone = loc.String()
+	s.Repo.SaveSettings(household, settings)
+	return settings, nil
+}
+
+// Settings returns the household's settings with the time zone filled in.
+func (s *HouseholdService) Settings(household string) model.HouseholdSettings {
+	settings, _ := s.Repo.GetSettings(household)
+	if settings.TimeZone == "" {
+		settings.TimeZone = s.Location(household).String()
+	}
+	return settings
+}
+
+// Location returns the household's time zone.
+func (s *HouseholdService) Location(household string) *time.Location {
+	if settings, ok := s.Repo.GetSettings(household); ok && settings.TimeZone != "" {
+		if loc, err := time.LoadLocation(settings.TimeZone); err == nil {
+			return loc
+		}
+	}
+	if s.DefaultZone != nil {
+		return s.DefaultZone
+	}
+	return time.UTC
+}
+
+// ResolveTimes gives every reading a Timestamp and rewrites its Date and Time
+// as wall clock time in loc. Readings without a Timestamp are read as wall
+// clock time in loc, in the order given (see timeResolver).
+func ResolveTimes(readings []model.Reading, loc *time.Location) error {
+	resolver := newTimeResolver(loc)
+	for i := range readings {
+		if err := resolver.resolve(&readings[i]); err != nil {
+			return fmt.Errorf("row %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// LocalizeTable applies ResolveTimes to a table that follows the energy
+// schema; other tables are returned unchanged.
+func LocalizeTable(table map[string][]string, loc *time.Location) (map[string][]string, error) {
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return table, nil
+		}
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return nil, err
+	}
+	if err := ResolveTimes(readings, loc); err != nil {
+		return nil, err
+	}
+	for column, values := range ReadingsToTable(readings) {
+		table[column] = values
+	}
+	return table, nil
+}
+
+// timeResolver turns wall clock readings into instants. A wall clock time
+// that occurs twice when clocks fall back is taken as its first occurrence,
+// unless the meter's previous reading is already at or past it, in which case
+// the series has moved on to the repeated hour. A time skipped when clocks
+// spring forward is moved forward by the gap.
+type timeResolver struct {
+	loc  *time.Location
+	last map[string]time.Time
+}
+
+func newTimeResolver(loc *time.Location) *timeResolver {
+	if loc == nil {
+		loc = time.UTC
+	}
+	return &timeResolver{loc: loc, last: map[string]time.Time{}}
+}
+
+func (t *timeResolver) resolve(r *model.Reading) error {
+	key := r.Appliance + "\x00" + r.Room
+	at := r.Timestamp
+	if at.IsZero() {
+		parsed, err := time.ParseInLocation(wallClockLayout, strings.TrimSpace(r.Date)+" "+strings.TrimSpace(r.Time), t.loc)
+		if err != nil {
+			return fmt.Errorf("invalid date and time %q %q", r.Date, r.Time)
+		}
+		at = parsed
+		if previous, ok := t.last[key]; ok && !previous.Before(at) {
+			if later, ok := laterOccurrence(at); ok {
+				at = later
+			}
+		}
+	}
+
+	at = at.In(t.loc)
+	r.Timestamp = at
+	r.Date = at.Format(dateLayout)
+	r.Time = at.Format("15:04")
+	if at.After(t.last[key]) {
+		t.last[key] = at
+	}
+	return nil
+}
+
+// laterOccurrence returns the second instant with the same wall clock time as
+// at when at falls in the hour repeated by a fall-back transition.
+func laterOccurrence(at time.Time) (time.Time, bool) {
+	_, before := at.Zone()
+	_, after := at.Add(3 * time.Hour).Zone()
+	shift := time.Duration(before-after) * time.Second
+	if shift <= 0 {
+		return at, false
+	}
+	later := at.Add(shift)
+	if later.Format(wallClockLayout) != at.Format(wallClockLayout) {
+		return at, false
+	}
+	return later, true
+}
+
+// hourStart returns the start of the wall clock hour containing at, keeping
+// at's offset so the two hours of a fall-back transition stay apart.
+func hourStart(at time.Time) time.Time {
+	return at.Add(-time.Duration(at.Minute())*time.Minute - time.Duration(at.Second())*time.Second - time.Duration(at.Nanosecond()))
+}
+
+// hourLabel names the wall clock hour of a reading. Readings with a Timestamp
+// are labeled in RFC 3339 form with their offset.
+func hourLabel(r model.Reading) string {
+	if r.Timestamp.IsZero() {
+		return fmt.Sprintf("%s %02d:00", r.Date, readingHour(r))
+	}
+	return hourStart(r.Timestamp).Format(time.RFC3339)
+}
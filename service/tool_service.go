@@ -0,0 +1,394 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Tools advertised to the chat model by AnalyticsTools.
+const (
+	ToolGetTotals    = "get_totals"
+	ToolGetPeakHours = "get_peak_hours"
+	ToolGetAnomalies = "get_anomalies"
+	ToolComputeCost  = "compute_cost"
+	ToolForecast     = "forecast"
+)
+
+// forecastBasisDays is how many of the most recent days a forecast averages.
+const forecastBasisDays = 7
+
+// DefaultAnomalyThreshold is how many standard deviations above its
+// appliance's mean a reading must be to count as an anomaly.
+const DefaultAnomalyThreshold = 3.0
+
+// maxAnomalies caps the anomalies DetectAnomalies returns.
+const maxAnomalies = 20
+
+// ToolExecutor runs the tools a chat model may call. Call returns a value
+// that is encoded as JSON for the model.
+type ToolExecutor interface {
+	Tools() []model.Tool
+	Call(name, arguments string) (interface{}, error)
+}
+
+// AnalyticsTools exposes analytics over a household's readings as tools.
+// Budget supplies the price for compute_cost when the model gives none.
+type AnalyticsTools struct {
+	Readings []model.Reading
+	Budget   *model.Budget
+}
+
+type totalsArguments struct {
+	GroupBy   string `json:"group_by"`
+	Appliance string `json:"appliance"`
+	Room      string `json:"room"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+}
+
+type peakHoursArguments struct {
+	Limit     int    `json:"limit"`
+	Appliance string `json:"appliance"`
+}
+
+type anomaliesArguments struct {
+	Threshold float64 `json:"threshold"`
+	Appliance string  `json:"appliance"`
+}
+
+type costArguments struct {
+	PricePerKWh float64 `json:"price_per_kwh"`
+	Appliance   string  `json:"appliance"`
+	Start       string  `json:"start"`
+	End         string  `json:"end"`
+}
+
+type forecastArguments struct {
+	Days int `json:"days"`
+}
+
+func (t *AnalyticsTools) Tools() []model.Tool {
+	appliance := map[string]interface{}{"type": "string", "description": "Only readings of this appliance"}
+	date := func(description string) map[string]interface{} {
+		return map[string]interface{}{"type": "string", "description": description + " date, YYYY-MM-DD"}
+	}
+	return []model.Tool{
+		newTool(ToolGetTotals, "Total energy use in kWh, overall or per appliance, room or date.", map[string]interface{}{
+			"group_by":  map[string]interface{}{"type": "string", "enum": []string{"none", "appliance", "room", "date"}},
+			"appliance": appliance,
+			"room":      map[string]interface{}{"type": "string", "description": "Only readings in this room"},
+			"start":     date("First"),
+			"end":       date("Last"),
+		}),
+		newTool(ToolGetPeakHours, "Hours of the day with the highest total energy use.", map[string]interface{}{
+			"limit":     map[string]interface{}{"type": "integer", "description": "Number of hours, default 3"},
+			"appliance": appliance,
+		}),
+		newTool(ToolGetAnomalies, "Readings far above their appliance's usual consumption.", map[string]interface{}{
+			"threshold": map[string]interface{}{"type": "number", "description": "Standard deviations above the mean, default 3"},
+			"appliance": appliance,
+		}),
+		newTool(ToolComputeCost, "Cost of the energy used, in total and per appliance.", map[string]interface{}{
+			"price_per_kwh": map[string]interface{}{"type": "number", "description": "Price of a kWh; defaults to the household budget's price"},
+			"appliance":     appliance,
+			"start":         date("First"),
+			"end":           date("Last"),
+		}),
+		newTool(ToolForecast, "Projected energy use for the coming days.", map[string]interface{}{
+			"days": map[string]interface{}{"type": "integer", "description": "Days to forecast, default 7"},
+		}),
+	}
+}
+
+func newTool(name, description string, properties map[string]interface{}) model.Tool {
+	return model.Tool{
+		Type: "function",
+		Function: model.ToolFunction{
+			Name:        name,
+			Description: description,
+			Parameters:  map[string]interface{}{"type": "object", "properties": properties},
+		},
+	}
+}
+
+// Call runs a tool with its JSON arguments.
+func (t *AnalyticsTools) Call(name, arguments string) (interface{}, error) {
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	decode := func(v interface{}) error {
+		if err := json.Unmarshal([]byte(arguments), v); err != nil {
+			return fmt.Errorf("invalid arguments for %s: %v", name, err)
+		}
+		return nil
+	}
+
+	switch name {
+	case ToolGetTotals:
+		var args totalsArguments
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		query := model.Query{Aggregate: AggregateSum, Filters: equalFilters(args.Appliance, args.Room)}
+		if args.GroupBy != "" && args.GroupBy != "none" {
+			query.GroupBy = []string{args.GroupBy}
+		}
+		if args.Start != "" || args.End != "" {
+			query.Window = &model.QueryWindow{Start: args.Start, End: args.End}
+		}
+		return (&QueryService{}).Execute(t.Readings, query)
+	case ToolGetPeakHours:
+		var args peakHoursArguments
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		return PeakHours(filterAppliance(t.Readings, args.Appliance), args.Limit), nil
+	case ToolGetAnomalies:
+		var args anomaliesArguments
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		return DetectAnomalies(filterAppliance(t.Readings, args.Appliance), args.Threshold), nil
+	case ToolComputeCost:
+		var args costArguments
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		price := args.PricePerKWh
+		if price == 0 && t.Budget != nil {
+			price = t.Budget.PricePerKWh
+		}
+		if price <= 0 {
+			return nil, errors.New("price_per_kwh is required because the household budget has no price")
+		}
+		readings := filterAppliance(t.Readings, args.Appliance)
+		if args.Start != "" || args.End != "" {
+			window := &model.QueryWindow{Start: args.Start, End: args.End}
+			query := model.Query{Window: window}
+			if err := (&QueryService{}).Validate(&query); err != nil {
+				return nil, err
+			}
+			var inWindow []model.Reading
+			for _, r := range readings {
+				if queryMatches(r, query) {
+					inWindow = append(inWindow, r)
+				}
+			}
+			readings = inWindow
+		}
+		return ComputeCost(readings, price), nil
+	case ToolForecast:
+		var args forecastArguments
+		if err := decode(&args); err != nil {
+			return nil, err
+		}
+		return ForecastUsage(t.Readings, args.Days)
+	}
+	return nil, fmt.Errorf("unknown tool %q", name)
+}
+
+func equalFilters(appliance, room string) []model.QueryFilter {
+	var filters []model.QueryFilter
+	if appliance != "" {
+		filters = append(filters, model.QueryFilter{Column: "appliance", Op: "eq", Value: appliance})
+	}
+	if room != "" {
+		filters = append(filters, model.QueryFilter{Column: "room", Op: "eq", Value: room})
+	}
+	return filters
+}
+
+func filterAppliance(readings []model.Reading, appliance string) []model.Reading {
+	if appliance == "" {
+		return readings
+	}
+	var filtered []model.Reading
+	for _, r := range readings {
+		if strings.EqualFold(r.Appliance, appliance) {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered
+}
+
+// PeakHours returns the hours of the day with the highest total consumption,
+// highest first. limit defaults to 3.
+func PeakHours(readings []model.Reading, limit int) []model.HourTotal {
+	if limit <= 0 {
+		limit = 3
+	}
+	var totals [24]float64
+	var seen [24]bool
+	for _, r := range readings {
+		if hour := readingHour(r); hour >= 0 {
+			totals[hour] += r.EnergyConsumption
+			seen[hour] = true
+		}
+	}
+	var hours []model.HourTotal
+	for hour, total := range totals {
+		if seen[hour] {
+			hours = append(hours, model.HourTotal{Hour: hour, EnergyKWh: total})
+		}
+	}
+	sort.SliceStable(hours, func(i, j int) bool { return hours[i].EnergyKWh > hours[j].EnergyKWh })
+	if len(hours) > limit {
+		hours = hours[:limit]
+	}
+	return hours
+}
+
+// DetectAnomalies returns readings more than threshold standard deviations
+// above the mean of their appliance, most unusual first. Appliances with
+// fewer than three readings are skipped; threshold defaults to
+// DefaultAnomalyThreshold.
+func DetectAnomalies(readings []model.Reading, threshold float64) []model.Anomaly {
+	if threshold <= 0 {
+		threshold = DefaultAnomalyThreshold
+	}
+	byAppliance := map[string][]model.Reading{}
+	for _, r := range readings {
+		byAppliance[r.Appliance] = append(byAppliance[r.Appliance], r)
+	}
+
+	anomalies := []model.Anomaly{}
+	for appliance, series := range byAppliance {
+		if len(series) < 3 {
+			continue
+		}
+		var sum, squares float64
+		for _, r := range series {
+			sum += r.EnergyConsumption
+		}
+		mean := sum / float64(len(series))
+		for _, r := range series {
+			squares += (r.EnergyConsumption - mean) * (r.EnergyConsumption - mean)
+		}
+		deviation := math.Sqrt(squares / float64(len(series)))
+		if deviation == 0 {
+			continue
+		}
+		for _, r := range series {
+			if score := (r.EnergyConsumption - mean) / deviation; score > threshold {
+				anomalies = append(anomalies, model.Anomaly{
+					Date:      r.Date,
+					Time:      r.Time,
+					Appliance: appliance,
+					Room:      r.Room,
+					EnergyKWh: r.EnergyConsumption,
+					MeanKWh:   mean,
+					Score:     score,
+				})
+			}
+		}
+	}
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].Score > anomalies[j].Score })
+	if len(anomalies) > maxAnomalies {
+		anomalies = anomalies[:maxAnomalies]
+	}
+	return anomalies
+}
+
+// ComputeCost prices the readings at pricePerKWh, in total and per
+// appliance, most expensive first.
+func ComputeCost(readings []model.Reading, pricePerKWh float64) model.CostReport {
+	report := model.CostReport{PricePerKWh: pricePerKWh, ByAppliance: []model.CostEntry{}}
+	totals := map[string]float64{}
+	for _, r := range readings {
+		totals[r.Appliance] += r.EnergyConsumption
+		report.TotalKWh += r.EnergyConsumption
+	}
+	for appliance, total := range totals {
+		report.ByAppliance = append(report.ByAppliance, model.CostEntry{Key: appliance, EnergyKWh: total, Cost: total * pricePerKWh})
+	}
+	sort.Slice(report.ByAppliance, func(i, j int) bool {
+		if report.ByAppliance[i].Cost != report.ByAppliance[j].Cost {
+			return report.ByAppliance[i].Cost > report.ByAppliance[j].Cost
+		}
+		return report.ByAppliance[i].Key < report.ByAppliance[j].Key
+	})
+	report.TotalCost = report.TotalKWh * pricePerKWh
+	return report
+}
+
+// ForecastUsage projects the next days' consumption from the average daily
+// total of the last forecastBasisDays days with readings. days defaults to 7.
+func ForecastUsage(readings []model.Reading, days int) (model.Forecast, error) {
+	if days <= 0 {
+		days = 7
+	}
+	daily := map[string]float64{}
+	for _, r := range readings {
+		daily[r.Date] += r.EnergyConsumption
+	}
+	if len(daily) == 0 {
+		return model.Forecast{}, errors.New("no readings to forecast from")
+	}
+	dates := make([]string, 0, len(daily))
+	for date := range daily {
+		dates = append(dates, date)
+	}
+	sort.Strings(dates)
+	if len(dates) > forecastBasisDays {
+		dates = dates[len(dates)-forecastBasisDays:]
+	}
+
+	var sum float64
+	for _, date := range dates {
+		sum += daily[date]
+	}
+	n := float64(len(dates))
+	forecast := model.Forecast{Days: days, BasedOnDays: len(dates), AverageDailyKWh: sum / n}
+	if len(dates) > 1 {
+		var covariance, variance float64
+		middle := (n - 1) / 2
+		for i, date := range dates {
+			covariance += (float64(i) - middle) * (daily[date] - forecast.AverageDailyKWh)
+			variance += (float64(i) - middle) * (float64(i) - middle)
+		}
+		forecast.TrendKWhPerDay = covariance / variance
+	}
+	forecast.TotalKWh = forecast.AverageDailyKWh * float64(days)
+	return forecast, nil
+}
+
+// SummarizeUsage finds the appliances with the least and most consumption
+// and builds recommendations for the limit largest consumers. It returns
+// false when there is no consumption to summarize.
+func SummarizeUsage(readings []model.Reading, limit int) (model.UsageSummary, []model.Recommendation, bool) {
+	costs := ComputeCost(readings, 1)
+	if len(costs.ByAppliance) == 0 || costs.TotalKWh <= 0 {
+		return model.UsageSummary{}, nil, false
+	}
+	most := costs.ByAppliance[0]
+	least := costs.ByAppliance[len(costs.ByAppliance)-1]
+	summary := model.UsageSummary{
+		Least:    least.Key,
+		Most:     most.Key,
+		LeastKWh: least.EnergyKWh,
+		MostKWh:  most.EnergyKWh,
+		TotalKWh: costs.TotalKWh,
+	}
+
+	var recommendations []model.Recommendation
+	for i := 0; i < len(costs.ByAppliance) && i < limit; i++ {
+		entry := costs.ByAppliance[i]
+		recommendation := model.Recommendation{
+			Appliance: entry.Key,
+			EnergyKWh: entry.EnergyKWh,
+			Share:     entry.EnergyKWh / costs.TotalKWh * 100,
+			PeakHour:  -1,
+		}
+		if peaks := PeakHours(filterAppliance(readings, entry.Key), 1); len(peaks) > 0 {
+			recommendation.PeakHour = peaks[0].Hour
+		}
+		recommendations = append(recommendations, recommendation)
+	}
+	return summary, recommendations, true
+}
@@ -5,12 +5,18 @@ import (
     "errors"
     "log"
     "strings"
+    "time"
+
+    "a21hc3NpZ25tZW50/model"
 
     hf "github.com/hupe1980/go-huggingface"
 )
 
 type TranslationService struct {
     Client *hf.InferenceClient
+    // Usage, when set, records each translation under Scope.
+    Usage *UsageService
+    Scope model.UsageScope
 }
 
 func NewTranslationService(apiKey string) *TranslationService {
@@ -19,6 +25,24 @@ func NewTranslationService(apiKey string) *TranslationService {
     }
 }
 
+// NewTranslationServiceAt returns a TranslationService that calls the
+// inference API at endpoint instead of DefaultInferenceEndpoint.
+func NewTranslationServiceAt(apiKey, endpoint string) *TranslationService {
+    return &TranslationService{
+        Client: hf.NewInferenceClient(apiKey, func(o *hf.InferenceClientOptions) {
+            o.InferenceEndpoint = strings.TrimSuffix(endpoint, "/")
+        }),
+    }
+}
+
+// WithScope returns a copy of the service that records translations under
+// scope.
+func (s *TranslationService) WithScope(scope model.UsageScope) *TranslationService {
+    copied := *s
+    copied.Scope = scope
+    return &copied
+}
+
 func (s *TranslationService) Translate(text, sourceLang, targetLang string) (string, error) {
     // Handling empty input
     if text == "" {
@@ -30,10 +54,19 @@ func (s *TranslationService) Translate(text, sourceLang, targetLang string) (str
     var translatedChunks []string
 
     for _, chunk := range chunks {
+        modelName := "Helsinki-NLP/opus-mt-" + sourceLang + "-" + targetLang
+        start := time.Now()
         res, err := s.Client.Translation(context.Background(), &hf.TranslationRequest{
             Inputs: []string{chunk},
-            Model:  "Helsinki-NLP/opus-mt-" + sourceLang + "-" + targetLang,
+            Model:  modelName,
         })
+        if s.Usage != nil {
+            output := ""
+            if len(res) > 0 {
+                output = res[0].TranslationText
+            }
+            s.Usage.Record(s.Scope, modelName, EstimateTokens(chunk), EstimateTokens(output), true, time.Since(start), err)
+        }
         if err != nil {
             log.Printf("Translation error for chunk: %v\n", err)
             return "", err
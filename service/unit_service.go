@@ -0,0 +1,241 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/sourceRepository"
+)
+
+// Source units accepted in model.SourceUnit.
+const (
+	UnitKWh = "kWh"
+	UnitWh  = "Wh"
+	UnitW   = "W"
+	UnitKW  = "kW"
+)
+
+// DefaultMaxPowerGap is how far apart two power samples may be and still be
+// integrated.
+const DefaultMaxPowerGap = time.Hour
+
+// maxNormalizationWarnings caps the warnings kept in a NormalizationReport.
+const maxNormalizationWarnings = 20
+
+// UnitService converts readings from sources that do not report kWh per
+// interval. Sources without a configured unit are taken to report kWh.
+type UnitService struct {
+	Repo        *repository.SourceRepository
+	MaxPowerGap time.Duration
+}
+
+func NewUnitService(repo *repository.SourceRepository) *UnitService {
+	return &UnitService{Repo: repo, MaxPowerGap: DefaultMaxPowerGap}
+}
+
+// SetUnit validates and stores a source's unit.
+func (s *UnitService) SetUnit(household string, unit model.SourceUnit) (model.SourceUnit, error) {
+	unit.Appliance = strings.TrimSpace(unit.Appliance)
+	if unit.Appliance == "" {
+		return unit, errors.New("appliance is required")
+	}
+	switch strings.ToLower(strings.TrimSpace(unit.Unit)) {
+	case "kwh":
+		unit.Unit = UnitKWh
+	case "wh":
+		unit.Unit = UnitWh
+	case "w":
+		unit.Unit = UnitW
+	case "kw":
+		unit.Unit = UnitKW
+	default:
+		return unit, fmt.Errorf("unit must be kWh, Wh, W or kW, got %q", unit.Unit)
+	}
+	if unit.Cumulative && (unit.Unit == UnitW || unit.Unit == UnitKW) {
+		return unit, errors.New("power samples cannot be cumulative")
+	}
+	s.Repo.SaveUnit(household, unit)
+	return unit, nil
+}
+
+// Normalize converts validated readings to kWh per interval and stores the
+// new last samples right away, for callers that store the readings whatever
+// happens next. See Normalizer.Normalize. The report is nil when the
+// household has no units configured.
+func (s *UnitService) Normalize(household string, readings []model.Reading) ([]model.Reading, *model.NormalizationReport) {
+	normalizer := s.Normalizer(household)
+	if normalizer == nil {
+		return readings, nil
+	}
+	normalized := normalizer.Normalize(readings)
+	normalizer.Commit()
+	return normalized, &normalizer.Report
+}
+
+// NormalizeTable normalizes a table that follows the energy schema. The
+// samples are not stored: the caller commits the returned normalizer once the
+// table itself is stored. Other tables, and tables of households without
+// units, are returned as is with a nil normalizer.
+func (s *UnitService) NormalizeTable(household string, table map[string][]string) (map[string][]string, *Normalizer, error) {
+	normalizer := s.Normalizer(household)
+	if normalizer == nil {
+		return table, nil, nil
+	}
+	for _, column := range EnergyColumns {
+		if _, ok := table[column]; !ok {
+			return table, nil, nil
+		}
+	}
+	readings, err := ParseReadings(table)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ReadingsToTable(normalizer.Normalize(readings)), normalizer, nil
+}
+
+// Normalizer converts readings one at a time for a streamed upload. It is nil
+// when the household has no units configured. Nothing is stored until Commit.
+func (s *UnitService) Normalizer(household string) *Normalizer {
+	if s == nil {
+		return nil
+	}
+	units := s.Repo.Units(household)
+	if len(units) == 0 {
+		return nil
+	}
+	return &Normalizer{
+		household: household,
+		units:     units,
+		samples:   s.Repo.Samples(household),
+		repo:      s.Repo,
+		maxGap:    s.MaxPowerGap,
+	}
+}
+
+// Normalizer holds the running state of one normalization pass. Readings of
+// each meter must arrive in time order.
+type Normalizer struct {
+	Report model.NormalizationReport
+
+	household string
+	units     map[string]model.SourceUnit
+	samples   map[string]model.MeterSample
+	repo      *repository.SourceRepository
+	maxGap    time.Duration
+	// stepwise integrates power samples as held until the next sample,
+	// for sources that only record a value when it changes.
+	stepwise bool
+}
+
+// Normalize converts validated readings in time order. Readings of
+// cumulative and power sources continue from the last sample seen from their
+// meter.
+func (n *Normalizer) Normalize(readings []model.Reading) []model.Reading {
+	sorted := append([]model.Reading(nil), readings...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].Timestamp.IsZero() && !sorted[j].Timestamp.IsZero() {
+			return sorted[i].Timestamp.Before(sorted[j].Timestamp)
+		}
+		if sorted[i].Date != sorted[j].Date {
+			return sorted[i].Date < sorted[j].Date
+		}
+		return sorted[i].Time < sorted[j].Time
+	})
+	normalized := make([]model.Reading, 0, len(sorted))
+	for _, reading := range sorted {
+		if reading, ok := n.Next(reading); ok {
+			normalized = append(normalized, reading)
+		}
+	}
+	return normalized
+}
+
+// Next converts a validated reading. It returns false for samples that are
+// not newer than the last one seen from their meter.
+func (n *Normalizer) Next(r model.Reading) (model.Reading, bool) {
+	unit, ok := n.units[r.Appliance]
+	if !ok || (unit.Unit == UnitKWh && !unit.Cumulative) {
+		return r, true
+	}
+	if unit.Unit == UnitWh && !unit.Cumulative {
+		r.EnergyConsumption /= 1000
+		n.Report.Scaled++
+		return r, true
+	}
+
+	at := r.Timestamp
+	if at.IsZero() {
+		var err error
+		if at, err = time.Parse(wallClockLayout, r.Date+" "+r.Time); err != nil {
+			n.warn("%s at %s %s: invalid timestamp", r.Appliance, r.Date, r.Time)
+			n.Report.Dropped++
+			return r, false
+		}
+	}
+	key := repository.SampleKey(r.Appliance, r.Room)
+	value := r.EnergyConsumption
+	previous, seen := n.samples[key]
+	if seen && !at.After(previous.Time) {
+		n.warn("%s at %s %s: sample is not newer than %s", r.Appliance, r.Date, r.Time, previous.Time.Format(time.RFC3339))
+		n.Report.Dropped++
+		return r, false
+	}
+	n.samples[key] = model.MeterSample{Time: at, Value: value}
+
+	scale := 1.0
+	if unit.Unit == UnitWh || unit.Unit == UnitW {
+		scale = 1000
+	}
+	r.EnergyConsumption = 0
+	if !seen {
+		return r, true
+	}
+
+	if unit.Cumulative {
+		delta := value - previous.Value
+		if delta < 0 {
+			// The counter restarted from zero since the previous sample.
+			delta = value
+			n.Report.CounterResets++
+			n.warn("%s at %s %s: counter reset from %g to %g", r.Appliance, r.Date, r.Time, previous.Value, value)
+		}
+		r.EnergyConsumption = delta / scale
+		n.Report.Differenced++
+		return r, true
+	}
+
+	elapsed := at.Sub(previous.Time)
+	if n.maxGap > 0 && elapsed > n.maxGap {
+		n.Report.Gaps++
+		n.warn("%s at %s %s: %s since the previous power sample, not integrated", r.Appliance, r.Date, r.Time, elapsed)
+		return r, true
+	}
+	if n.stepwise {
+		// The previous sample held until this one.
+		r.EnergyConsumption = previous.Value / scale * elapsed.Hours()
+	} else {
+		// Trapezoidal rule: the mean of both samples over the interval.
+		r.EnergyConsumption = (previous.Value + value) / 2 / scale * elapsed.Hours()
+	}
+	n.Report.Integrated++
+	return r, true
+}
+
+// Commit stores the last sample of every meter seen, so the next pass
+// continues from them. It does nothing on a nil Normalizer.
+func (n *Normalizer) Commit() {
+	if n == nil || n.repo == nil {
+		return
+	}
+	n.repo.SaveSamples(n.household, n.samples)
+}
+
+func (n *Normalizer) warn(format string, args ...interface{}) {
+	if len(n.Report.Warnings) < maxNormalizationWarnings {
+		n.Report.Warnings = append(n.Report.Warnings, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"unicode/utf8"
+
+	"a21hc3NpZ25tZW50/model"
+	repository "a21hc3NpZ25tZW50/repository/usageRepository"
+)
+
+// ErrQuotaExceeded is returned for requests from a user or household that
+// has used up its daily quota.
+var ErrQuotaExceeded = errors.New("usage quota exceeded")
+
+// DefaultModelPrice is charged for models without a configured price. It is
+// a rough estimate; configure real prices with UsageService.Prices.
+var DefaultModelPrice = model.ModelPrice{InputPer1K: 0.0005, OutputPer1K: 0.0015}
+
+// charsPerToken approximates tokens for responses without a usage field.
+const charsPerToken = 4
+
+// DefaultUsageRetentionDays is how many days of usage records are kept.
+const DefaultUsageRetentionDays = 90
+
+// UsageService records the tokens, latency and estimated cost of model calls,
+// aggregates them and enforces daily quotas. Days are UTC dates.
+//
+// Quotas are kept per user and household name as the caller reports them;
+// until requests are authenticated they are advisory, since a client can
+// send another name to get a fresh quota.
+type UsageService struct {
+	Repo *repository.UsageRepository
+	// Prices maps model names to prices; other models cost DefaultModelPrice.
+	Prices         map[string]model.ModelPrice
+	UserQuota      model.UsageQuota
+	HouseholdQuota model.UsageQuota
+	// RetentionDays is how many days of records Record keeps, today
+	// included; zero keeps them all.
+	RetentionDays int
+	// Now returns the current time; nil means time.Now.
+	Now func() time.Time
+}
+
+func NewUsageService(repo *repository.UsageRepository) *UsageService {
+	return &UsageService{Repo: repo, Prices: map[string]model.ModelPrice{}, RetentionDays: DefaultUsageRetentionDays}
+}
+
+// EstimateTokens approximates the number of tokens in text.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// ParseTokenUsage reads the prompt and completion tokens of an
+// OpenAI-compatible response's usage field.
+func ParseTokenUsage(body []byte) (int, int, bool) {
+	var response struct {
+		Usage *struct {
+			PromptTokens     int `json:"prompt_tokens"`
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.Usage == nil {
+		return 0, 0, false
+	}
+	return response.Usage.PromptTokens, response.Usage.CompletionTokens, true
+}
+
+// Cost estimates what a call to a model costs.
+func (s *UsageService) Cost(modelName string, inputTokens, outputTokens int) float64 {
+	price, ok := s.Prices[modelName]
+	if !ok {
+		price = DefaultModelPrice
+	}
+	cost := float64(inputTokens)/1000*price.InputPer1K + float64(outputTokens)/1000*price.OutputPer1K
+	return math.Round(cost*1e6) / 1e6
+}
+
+// Record logs a model call made in scope and returns the record. Records
+// older than RetentionDays are dropped.
+func (s *UsageService) Record(scope model.UsageScope, modelName string, inputTokens, outputTokens int, estimated bool, latency time.Duration, callErr error) model.UsageRecord {
+	at := s.clock().UTC()
+	record := model.UsageRecord{
+		UsageScope:   scope,
+		Time:         at,
+		Day:          at.Format(dateLayout),
+		Model:        modelName,
+		InputTokens:  inputTokens,
+		OutputTokens: outputTokens,
+		Estimated:    estimated,
+		LatencyMS:    latency.Milliseconds(),
+		Cost:         s.Cost(modelName, inputTokens, outputTokens),
+	}
+	if callErr != nil {
+		record.Error = callErr.Error()
+	}
+	s.Repo.Add(record)
+	if s.RetentionDays > 0 {
+		s.Repo.Prune(at.AddDate(0, 0, 1-s.RetentionDays).Format(dateLayout))
+	}
+	return record
+}
+
+func (s *UsageService) clock() time.Time {
+	if s.Now == nil {
+		return time.Now()
+	}
+	return s.Now()
+}
+
+// CheckQuota returns ErrQuotaExceeded when the user or the household has
+// reached its quota today. The names are not verified, so the check is
+// advisory: it stops well-behaved clients, not one that changes its name.
+func (s *UsageService) CheckQuota(user, household string) error {
+	today := s.clock().UTC().Format(dateLayout)
+	var byUser, byHousehold model.UsageTotal
+	for _, record := range s.Repo.List(today, today) {
+		if record.User == user {
+			addUsage(&byUser, record)
+		}
+		if record.Household == household {
+			addUsage(&byHousehold, record)
+		}
+	}
+	if err := quotaError("user "+user, byUser, s.UserQuota); err != nil {
+		return err
+	}
+	return quotaError("household "+household, byHousehold, s.HouseholdQuota)
+}
+
+func quotaError(who string, used model.UsageTotal, quota model.UsageQuota) error {
+	if tokens := used.InputTokens + used.OutputTokens; quota.Tokens > 0 && tokens >= quota.Tokens {
+		return fmt.Errorf("%w: %s used %d of %d tokens today", ErrQuotaExceeded, who, tokens, quota.Tokens)
+	}
+	if quota.Cost > 0 && used.Cost >= quota.Cost {
+		return fmt.Errorf("%w: %s used %.4f of %.4f in cost today", ErrQuotaExceeded, who, used.Cost, quota.Cost)
+	}
+	return nil
+}
+
+// Report aggregates the calls made on the days from from to to, inclusive.
+// Empty bounds are open.
+func (s *UsageService) Report(from, to string) model.UsageReport {
+	report := model.UsageReport{From: from, To: to}
+	groups := map[string]map[string]*model.UsageTotal{}
+	for _, record := range s.Repo.List(from, to) {
+		addUsage(&report.Total, record)
+		for dimension, key := range map[string]string{
+			"user":      record.User,
+			"household": record.Household,
+			"day":       record.Day,
+			"model":     record.Model,
+			"endpoint":  record.Endpoint,
+		} {
+			if groups[dimension] == nil {
+				groups[dimension] = map[string]*model.UsageTotal{}
+			}
+			if groups[dimension][key] == nil {
+				groups[dimension][key] = &model.UsageTotal{Key: key}
+			}
+			addUsage(groups[dimension][key], record)
+		}
+	}
+	finishUsage(&report.Total)
+	report.ByUser = usageTotals(groups["user"])
+	report.ByHousehold = usageTotals(groups["household"])
+	report.ByDay = usageTotals(groups["day"])
+	report.ByModel = usageTotals(groups["model"])
+	report.ByEndpoint = usageTotals(groups["endpoint"])
+	return report
+}
+
+// addUsage adds a record to a total, keeping the latency sum in
+// AvgLatencyMS until finishUsage divides it.
+func addUsage(total *model.UsageTotal, record model.UsageRecord) {
+	total.Requests++
+	if record.Error != "" {
+		total.Errors++
+	}
+	total.InputTokens += record.InputTokens
+	total.OutputTokens += record.OutputTokens
+	total.Cost += record.Cost
+	total.AvgLatencyMS += record.LatencyMS
+}
+
+func finishUsage(total *model.UsageTotal) {
+	if total.Requests > 0 {
+		total.AvgLatencyMS /= int64(total.Requests)
+	}
+	total.Cost = math.Round(total.Cost*1e6) / 1e6
+}
+
+func usageTotals(group map[string]*model.UsageTotal) []model.UsageTotal {
+	totals := make([]model.UsageTotal, 0, len(group))
+	for _, total := range group {
+		finishUsage(total)
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Key < totals[j].Key })
+	return totals
+}
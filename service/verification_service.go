@@ -0,0 +1,394 @@
+package service
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"a21hc3NpZ25tZW50/model"
+)
+
+// Claim kinds and statuses produced by VerifyAnswer.
+const (
+	ClaimTopAppliance    = "top_appliance"
+	ClaimBottomAppliance = "bottom_appliance"
+	ClaimTopRoom         = "top_room"
+	ClaimBottomRoom      = "bottom_room"
+	ClaimEnergy          = "energy"
+
+	ClaimConfirmed    = "confirmed"
+	ClaimContradicted = "contradicted"
+)
+
+// claimTolerance is the relative difference allowed between a stated and a
+// computed value, so rounded figures still match.
+const claimTolerance = 0.02
+
+var (
+	sentenceEnd  = regexp.MustCompile(`[.!?](\s+|$)|\n+`)
+	energyNumber = regexp.MustCompile(`(?i)(\d+(?:[.,]\d+)?)\s*kwh\b`)
+	bareNumber   = regexp.MustCompile(`^\s*(\d+(?:[.,]\d+)?)\s*$`)
+	claimDate    = regexp.MustCompile(`\d{4}-\d{2}-\d{2}`)
+
+	// Superlatives in English and Indonesian, since answers are translated.
+	mostWords    = []string{"most", "highest", "largest", "biggest", "top", "paling banyak", "paling boros", "tertinggi", "terbesar", "terboros"}
+	leastWords   = []string{"least", "lowest", "smallest", "fewest", "paling sedikit", "paling hemat", "terendah", "terkecil"}
+	averageWords = []string{"average", "avg", "mean", "per day", "per reading", "rata-rata", "per hari"}
+	energyWords  = []string{"kwh", "energy", "energi", "electricity", "listrik", "consumption", "konsumsi", "power", "daya"}
+	timesWords   = []string{"berapa kali", "how many times", "how often", "seberapa sering", "jumlah kali"}
+)
+
+// VerifyAnswer pulls claims out of a model answer and checks them against the
+// readings: which appliance or room used the most or least energy, and kWh
+// figures for an appliance, a room or the whole dataset. A kWh figure matches
+// when it equals the subject's total, average per reading or per day, largest
+// reading, or its total on a date named in the same sentence. Contradicted
+// superlatives, and contradicted figures in sentences about totals, are
+// corrected in the returned answer. A sentence that says both "most" and
+// "least" is checked mention by mention against the nearest superlative and
+// never corrected. The question supplies the superlative, or the subject, of
+// one-sentence answers that are only a name or a number, as the table model
+// gives; a bare number is only read as kWh when the question asks about
+// energy.
+func VerifyAnswer(question, answer string, readings []model.Reading) model.Verification {
+	verification := model.Verification{Answer: answer, Claims: []model.Claim{}}
+	if len(readings) == 0 || strings.TrimSpace(answer) == "" {
+		return verification
+	}
+	facts := newAnswerFacts(readings)
+
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+
+	sentences := splitSentences(answer)
+	for _, span := range sentences {
+		sentence := answer[span[0]:span[1]]
+		lower := strings.ToLower(sentence)
+		mentions := facts.mentions(sentence)
+
+		direction := superlative(lower)
+		if direction == 0 && len(sentences) == 1 {
+			direction = superlative(strings.ToLower(question))
+		}
+		if containsAny(lower, mostWords) && containsAny(lower, leastWords) {
+			for _, m := range mentions {
+				actual := facts.ranked(m.kind, nearestSuperlative(lower, m))
+				claim := model.Claim{
+					Text:    strings.TrimSpace(sentence),
+					Kind:    superlativeKind(m.kind, nearestSuperlative(lower, m)),
+					Subject: m.name,
+					Stated:  sentence[m.start:m.end],
+					Actual:  actual,
+					Status:  ClaimConfirmed,
+				}
+				if !strings.EqualFold(claim.Stated, actual) {
+					claim.Status = ClaimContradicted
+				}
+				verification.Claims = append(verification.Claims, claim)
+			}
+		} else if direction != 0 {
+			for _, kind := range []string{"appliance", "room"} {
+				mention, ok := firstMention(mentions, kind)
+				if !ok {
+					continue
+				}
+				actual := facts.ranked(kind, direction)
+				claim := model.Claim{
+					Text:    strings.TrimSpace(sentence),
+					Kind:    superlativeKind(kind, direction),
+					Subject: mention.name,
+					Stated:  sentence[mention.start:mention.end],
+					Actual:  actual,
+					Status:  ClaimConfirmed,
+				}
+				if !strings.EqualFold(claim.Stated, actual) {
+					claim.Status = ClaimContradicted
+					claim.Corrected = true
+					edits = append(edits, edit{span[0] + mention.start, span[0] + mention.end, actual})
+				}
+				verification.Claims = append(verification.Claims, claim)
+				break
+			}
+		}
+
+		numbers := energyNumber.FindAllStringSubmatchIndex(sentence, -1)
+		bare := false
+		if len(numbers) == 0 && len(sentences) == 1 && asksAboutEnergy(question) {
+			numbers = bareNumber.FindAllStringSubmatchIndex(sentence, -1)
+			bare = true
+		}
+		dates := claimDate.FindAllString(sentence, -1)
+		aboutTotal := strings.Contains(lower, "total") && !containsAny(lower, averageWords)
+		for _, match := range numbers {
+			stated := sentence[match[2]:match[3]]
+			value, err := strconv.ParseFloat(strings.Replace(stated, ",", ".", 1), 64)
+			if err != nil {
+				continue
+			}
+			subject := subjectOf(mentions, match[2])
+			if bare {
+				// A bare figure is about what the question named.
+				subject = subjectOf(facts.mentions(question), len(question))
+			}
+			claim := model.Claim{
+				Text:    strings.TrimSpace(sentence),
+				Kind:    ClaimEnergy,
+				Subject: subject.name,
+				Stated:  stated,
+				Status:  ClaimContradicted,
+			}
+			total := facts.totals[subject.claimSubject]
+			for _, candidate := range facts.candidates(subject.claimSubject, dates) {
+				if math.Abs(candidate-value) <= math.Max(0.01, claimTolerance*math.Abs(candidate)) {
+					claim.Status = ClaimConfirmed
+					claim.Actual = formatClaimValue(candidate, stated)
+					break
+				}
+			}
+			if claim.Status == ClaimContradicted {
+				claim.Actual = formatClaimValue(total, stated)
+				if aboutTotal {
+					claim.Corrected = true
+					edits = append(edits, edit{span[0] + match[2], span[0] + match[3], claim.Actual})
+				}
+			}
+			verification.Claims = append(verification.Claims, claim)
+		}
+	}
+
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	for _, e := range edits {
+		verification.Answer = verification.Answer[:e.start] + e.text + verification.Answer[e.end:]
+	}
+
+	confirmed := false
+	verification.Verified = true
+	for _, claim := range verification.Claims {
+		switch claim.Status {
+		case ClaimConfirmed:
+			confirmed = true
+		case ClaimContradicted:
+			verification.Verified = false
+		}
+	}
+	verification.Verified = verification.Verified && confirmed
+	return verification
+}
+
+// answerFacts holds the analytics claims are checked against.
+type answerFacts struct {
+	readings []model.Reading
+	names    []claimSubject
+	totals   map[claimSubject]float64
+}
+
+// claimSubject is an appliance, a room, or the whole dataset when kind is
+// empty.
+type claimSubject struct {
+	kind, name string
+}
+
+type mention struct {
+	claimSubject
+	start, end int
+}
+
+func newAnswerFacts(readings []model.Reading) *answerFacts {
+	facts := &answerFacts{readings: readings, totals: map[claimSubject]float64{}}
+	for _, r := range readings {
+		for _, subject := range []claimSubject{{"appliance", r.Appliance}, {"room", r.Room}} {
+			if _, ok := facts.totals[subject]; !ok && strings.TrimSpace(subject.name) != "" {
+				facts.names = append(facts.names, subject)
+			}
+			facts.totals[subject] += r.EnergyConsumption
+		}
+		facts.totals[claimSubject{}] += r.EnergyConsumption
+	}
+	// Longer names first, so "Living Room Lamp" is not read as "Living Room".
+	sort.SliceStable(facts.names, func(i, j int) bool { return len(facts.names[i].name) > len(facts.names[j].name) })
+	return facts
+}
+
+// mentions returns the appliances and rooms named in a sentence, in order.
+// Overlapping names keep the longest.
+func (f *answerFacts) mentions(sentence string) []mention {
+	var found []mention
+	taken := make([]bool, len(sentence))
+	for _, subject := range f.names {
+		pattern := regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(subject.name) + `\b`)
+		for _, loc := range pattern.FindAllStringIndex(sentence, -1) {
+			if taken[loc[0]] || taken[loc[1]-1] {
+				continue
+			}
+			for i := loc[0]; i < loc[1]; i++ {
+				taken[i] = true
+			}
+			found = append(found, mention{subject, loc[0], loc[1]})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].start < found[j].start })
+	return found
+}
+
+// ranked returns the appliance or room with the highest total when direction
+// is positive and the lowest when negative.
+func (f *answerFacts) ranked(kind string, direction int) string {
+	best := ""
+	var bestTotal float64
+	for _, subject := range f.names {
+		if subject.kind != kind {
+			continue
+		}
+		total := f.totals[subject]
+		if best == "" || (direction > 0 && total > bestTotal) || (direction < 0 && total < bestTotal) {
+			best, bestTotal = subject.name, total
+		}
+	}
+	return best
+}
+
+// candidates returns the values a kWh figure about subject may state.
+func (f *answerFacts) candidates(subject claimSubject, dates []string) []float64 {
+	var count int
+	var largest float64
+	days := map[string]float64{}
+	for _, r := range f.readings {
+		if subject.kind == "appliance" && r.Appliance != subject.name || subject.kind == "room" && r.Room != subject.name {
+			continue
+		}
+		count++
+		largest = math.Max(largest, r.EnergyConsumption)
+		days[r.Date] += r.EnergyConsumption
+	}
+	total := f.totals[subject]
+	candidates := []float64{total, largest}
+	if count > 0 {
+		candidates = append(candidates, total/float64(count), total/float64(len(days)))
+	}
+	for _, date := range dates {
+		if value, ok := days[date]; ok {
+			candidates = append(candidates, value)
+		}
+	}
+	return candidates
+}
+
+// subjectOf returns the appliance or room a figure at offset is about: the
+// nearest one named before it, else the first named after it, else the whole
+// dataset.
+func subjectOf(mentions []mention, offset int) mention {
+	var subject mention
+	for _, m := range mentions {
+		if m.start < offset {
+			subject = m
+		} else if subject.kind == "" {
+			return m
+		}
+	}
+	return subject
+}
+
+func firstMention(mentions []mention, kind string) (mention, bool) {
+	for _, m := range mentions {
+		if m.kind == kind {
+			return m, true
+		}
+	}
+	return mention{}, false
+}
+
+// superlative returns 1 when text says "most", -1 when it says "least" and 0
+// otherwise.
+func superlative(text string) int {
+	switch {
+	case containsAny(text, leastWords):
+		return -1
+	case containsAny(text, mostWords):
+		return 1
+	}
+	return 0
+}
+
+// nearestSuperlative returns the direction of the superlative word closest to
+// a mention in text.
+func nearestSuperlative(text string, m mention) int {
+	direction, best := 0, len(text)+1
+	for _, group := range []struct {
+		words     []string
+		direction int
+	}{{mostWords, 1}, {leastWords, -1}} {
+		for _, word := range group.words {
+			pattern := regexp.MustCompile(`\b` + regexp.QuoteMeta(word) + `\b`)
+			for _, loc := range pattern.FindAllStringIndex(text, -1) {
+				distance := loc[0] - m.end
+				if loc[1] <= m.start {
+					distance = m.start - loc[1]
+				}
+				if distance >= 0 && distance < best {
+					direction, best = group.direction, distance
+				}
+			}
+		}
+	}
+	return direction
+}
+
+// asksAboutEnergy reports whether a question asks for an amount of energy
+// rather than, say, how many times something happened.
+func asksAboutEnergy(question string) bool {
+	lower := strings.ToLower(question)
+	return containsAny(lower, energyWords) && !containsAny(lower, timesWords)
+}
+
+func superlativeKind(kind string, direction int) string {
+	switch {
+	case kind == "appliance" && direction > 0:
+		return ClaimTopAppliance
+	case kind == "appliance":
+		return ClaimBottomAppliance
+	case direction > 0:
+		return ClaimTopRoom
+	}
+	return ClaimBottomRoom
+}
+
+// containsAny reports whether text contains any of the words as a whole word.
+func containsAny(text string, words []string) bool {
+	for _, word := range words {
+		if regexp.MustCompile(`\b` + regexp.QuoteMeta(word) + `\b`).MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSentences returns the byte spans of the sentences of text.
+func splitSentences(text string) [][2]int {
+	var spans [][2]int
+	start := 0
+	for _, loc := range sentenceEnd.FindAllStringIndex(text, -1) {
+		if strings.TrimSpace(text[start:loc[1]]) != "" {
+			spans = append(spans, [2]int{start, loc[1]})
+		}
+		start = loc[1]
+	}
+	if strings.TrimSpace(text[start:]) != "" {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+// formatClaimValue formats a computed value to two decimals, with a decimal
+// comma when the stated figure used one.
+func formatClaimValue(value float64, stated string) string {
+	formatted := strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64)
+	if strings.Contains(stated, ",") {
+		formatted = strings.Replace(formatted, ".", ",", 1)
+	}
+	return formatted
+}